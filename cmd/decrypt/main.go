@@ -0,0 +1,102 @@
+// Command decrypt restores recordings encrypted by the recorder.
+//
+//	decrypt -key $ENCRYPTION_KEY recording.mp4.enc
+//	decrypt -private-key private.pem -o - recording.mp4.enc | ffplay -
+//
+// Each file is written next to it without the .enc extension, unless -o is set.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+)
+
+func main() {
+	masterKey := flag.String("key", os.Getenv("ENCRYPTION_KEY"), "master key the recordings were encrypted with, ENCRYPTION_KEY by default")
+	privateKeyFile := flag.String("private-key", "", "PEM file of the private key matching ENCRYPTION_PUBLIC_KEY")
+	output := flag.String("o", "", "output file, - for stdout, only with a single input")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-key key | -private-key file] [-o output] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*output != "" && flag.NArg() > 1) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	key, err := unwrapper(*masterKey, *privateKeyFile)
+	if err != nil {
+		fail(err)
+	}
+
+	for _, input := range flag.Args() {
+		out := *output
+		if out == "" {
+			if !strings.HasSuffix(input, crypt.Extension) {
+				fail(fmt.Errorf("%s: no %s extension, set the output with -o", input, crypt.Extension))
+			}
+			out = strings.TrimSuffix(input, crypt.Extension)
+		}
+		if err = decrypt(input, out, key); err != nil {
+			fail(fmt.Errorf("%s: %w", input, err))
+		}
+	}
+}
+
+func unwrapper(masterKey string, privateKeyFile string) (crypt.Unwrapper, error) {
+	switch {
+	case privateKeyFile != "":
+		return crypt.LoadPrivateKey(privateKeyFile)
+	case masterKey != "":
+		return crypt.ParseMasterKey(masterKey)
+	default:
+		return nil, errors.New("set -key or -private-key")
+	}
+}
+
+// decrypt writes to a temporary file, so a corrupt recording doesn't leave a partial output
+func decrypt(input string, output string, key crypt.Unwrapper) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := crypt.NewReader(in, key)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
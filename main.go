@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/cluster"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/http/rest"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/queue"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/rules"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/schedule"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
@@ -23,6 +36,17 @@ func getEnvOrFail(key string) string {
 	return val
 }
 
+// Keys of every instance sharing a Redis server start with this
+const redisPrefix = "livekit-recorder:"
+
+func newRedisClient() *redis.Client {
+	opts, err := redis.ParseURL(getEnvOrFail("REDIS_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return redis.NewClient(opts)
+}
+
 func main() {
 	// Get env variables
 	port := getEnvOrFail("APP_PORT")
@@ -55,6 +79,10 @@ func main() {
 		webhooks = strings.Split(webhookUrls, ",")
 	}
 
+	// Cancelled on shutdown, which stops background work and uploads in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Check that ffmpeg is installed
 	_, err := exec.LookPath("ffmpeg")
 	if err != nil {
@@ -79,23 +107,326 @@ func main() {
 	s3Bucket := os.Getenv("S3_BUCKET")
 	var uploader upload.Uploader
 	if s3Region != "" && s3Bucket != "" {
+		tags, err := upload.ParseS3Tags(os.Getenv("S3_TAGS"))
+		if err != nil {
+			log.Fatal(err)
+		}
 		uploader, err = upload.NewS3Uploader(upload.S3Config{
-			Region:    s3Region,
-			Bucket:    s3Bucket,
-			Directory: os.Getenv("S3_DIRECTORY"),
+			Region:          s3Region,
+			Bucket:          s3Bucket,
+			Directory:       os.Getenv("S3_DIRECTORY"),
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			PathStyle:       strings.EqualFold(os.Getenv("S3_PATH_STYLE"), "true"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("S3_SESSION_TOKEN"),
+			AssumeRoleARN:   os.Getenv("S3_ASSUME_ROLE_ARN"),
+			StorageClass:    os.Getenv("S3_STORAGE_CLASS"),
+			SSE:             os.Getenv("S3_SSE"),
+			SSEKMSKeyID:     os.Getenv("S3_SSE_KMS_KEY_ID"),
+			Tags:            tags,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Otherwise, upload to Google Cloud Storage only if a bucket is provided
+	if gcsBucket := os.Getenv("GCS_BUCKET"); gcsBucket != "" {
+		if uploader != nil {
+			log.Fatal("set only one of S3, GCS, Azure, SFTP, WebDAV or UPLOAD_DIR")
+		}
+		var chunkSize int64
+		if size := os.Getenv("GCS_CHUNK_SIZE"); size != "" {
+			if chunkSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+				log.Fatal(err)
+			}
+		}
+		uploader, err = upload.NewGCSUploader(upload.GCSConfig{
+			Bucket:          gcsBucket,
+			Directory:       os.Getenv("GCS_DIRECTORY"),
+			Endpoint:        os.Getenv("GCS_ENDPOINT"),
+			CredentialsFile: os.Getenv("GCS_CREDENTIALS_FILE"),
+			ChunkSize:       chunkSize,
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	// Or to Azure Blob Storage only if a container is provided
+	if azureContainer := os.Getenv("AZURE_CONTAINER"); azureContainer != "" {
+		if uploader != nil {
+			log.Fatal("set only one of S3, GCS, Azure, SFTP, WebDAV or UPLOAD_DIR")
+		}
+		var blockSize int64
+		if size := os.Getenv("AZURE_BLOCK_SIZE"); size != "" {
+			if blockSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+				log.Fatal(err)
+			}
+		}
+		uploader, err = upload.NewAzureUploader(upload.AzureConfig{
+			Account:    os.Getenv("AZURE_ACCOUNT"),
+			Container:  azureContainer,
+			Directory:  os.Getenv("AZURE_DIRECTORY"),
+			AccountKey: os.Getenv("AZURE_ACCOUNT_KEY"),
+			SASToken:   os.Getenv("AZURE_SAS_TOKEN"),
+			Endpoint:   os.Getenv("AZURE_ENDPOINT"),
+			BlockSize:  blockSize,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Or deliver them to an SFTP server only if one is provided
+	if sftpAddress := os.Getenv("SFTP_ADDRESS"); sftpAddress != "" {
+		if uploader != nil {
+			log.Fatal("set only one of S3, GCS, Azure, SFTP, WebDAV or UPLOAD_DIR")
+		}
+		uploader, err = upload.NewSFTPUploader(upload.SFTPConfig{
+			Address:               sftpAddress,
+			User:                  os.Getenv("SFTP_USER"),
+			Password:              os.Getenv("SFTP_PASSWORD"),
+			KeyFile:               os.Getenv("SFTP_KEY_FILE"),
+			KeyPassphrase:         os.Getenv("SFTP_KEY_PASSPHRASE"),
+			KnownHostsFile:        os.Getenv("SFTP_KNOWN_HOSTS"),
+			InsecureIgnoreHostKey: strings.EqualFold(os.Getenv("SFTP_INSECURE_IGNORE_HOST_KEY"), "true"),
+			Directory:             os.Getenv("SFTP_DIRECTORY"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Or to a WebDAV server
+	if webDAVURL := os.Getenv("WEBDAV_URL"); webDAVURL != "" {
+		if uploader != nil {
+			log.Fatal("set only one of S3, GCS, Azure, SFTP, WebDAV or UPLOAD_DIR")
+		}
+		uploader, err = upload.NewWebDAVUploader(upload.WebDAVConfig{
+			URL:       webDAVURL,
+			Directory: os.Getenv("WEBDAV_DIRECTORY"),
+			User:      os.Getenv("WEBDAV_USER"),
+			Password:  os.Getenv("WEBDAV_PASSWORD"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Or move recordings into a directory only if one is provided
+	if uploadDir := os.Getenv("UPLOAD_DIR"); uploadDir != "" {
+		if uploader != nil {
+			log.Fatal("set only one of S3, GCS, Azure, SFTP, WebDAV or UPLOAD_DIR")
+		}
+		uploader, err = upload.NewFileUploader(upload.FileConfig{
+			Root:     uploadDir,
+			Template: os.Getenv("UPLOAD_DIR_TEMPLATE"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Fan out to more destinations only if a file lists them, the uploader above being the primary one
+	primary := uploader
+	if destinationsFile := os.Getenv("UPLOAD_DESTINATIONS"); destinationsFile != "" {
+		destinations, err := upload.LoadDestinations(destinationsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if uploader != nil {
+			destinations = append([]upload.Destination{{Name: "default", Uploader: uploader}}, destinations...)
+		}
+		policy, err := upload.ParsePolicy(os.Getenv("UPLOAD_POLICY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if uploader, err = upload.NewFanOutUploader(policy, destinations...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Initialise recording service
 	service, err := recording.NewService(lkURL, lkAPIKey, lkAPISecret, webhooks)
 	if err != nil {
 		log.Fatal(err)
 	}
+	service.SetContext(ctx)
 	service.SetUploader(uploader)
 
+	// Limit recordings only if the limits are provided, requests can override them
+	var limits recording.Limits
+	if maxDuration := os.Getenv("MAX_DURATION"); maxDuration != "" {
+		if limits.MaxDuration, err = time.ParseDuration(maxDuration); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if maxSize := os.Getenv("MAX_SIZE"); maxSize != "" {
+		if limits.MaxSize, err = strconv.ParseUint(maxSize, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if onLimit := os.Getenv("ON_LIMIT"); onLimit != "" {
+		if limits.OnLimit, err = recording.ParseLimitAction(onLimit); err != nil {
+			log.Fatal(err)
+		}
+	}
+	service.SetDefaultLimits(limits)
+
+	// Split recordings into segments only if the rotation is provided, requests can override it
+	var rotation participant.Rotation
+	if segmentDuration := os.Getenv("SEGMENT_DURATION"); segmentDuration != "" {
+		if rotation.Duration, err = time.ParseDuration(segmentDuration); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if segmentSize := os.Getenv("SEGMENT_SIZE"); segmentSize != "" {
+		if rotation.Size, err = strconv.ParseUint(segmentSize, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	service.SetDefaultRotation(rotation)
+
+	// Guard the disk only if the thresholds are provided
+	guard := recording.DiskGuard{Dir: participant.RecordingsDir}
+	if minFree := os.Getenv("DISK_MIN_FREE"); minFree != "" {
+		if guard.MinFree, err = strconv.ParseUint(minFree, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if emergencyFree := os.Getenv("DISK_EMERGENCY_FREE"); emergencyFree != "" {
+		if guard.EmergencyFree, err = strconv.ParseUint(emergencyFree, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	service.SetDiskGuard(guard)
+
+	// Cap the load of the instance only if the limits are provided
+	var capacity recording.Capacity
+	if maxRooms := os.Getenv("MAX_ROOMS"); maxRooms != "" {
+		if capacity.MaxRooms, err = strconv.Atoi(maxRooms); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if maxTracks := os.Getenv("MAX_TRACKS"); maxTracks != "" {
+		if capacity.MaxTracks, err = strconv.Atoi(maxTracks); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if maxBandwidth := os.Getenv("MAX_BANDWIDTH"); maxBandwidth != "" {
+		if capacity.MaxBandwidth, err = strconv.ParseUint(maxBandwidth, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	service.SetCapacity(capacity)
+
+	// Persist recordings only if a store path is provided
+	var st *store.Store
+	storePath := os.Getenv("STORE_PATH")
+	if storePath != "" {
+		st, err = store.Open(storePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = service.SetStore(st); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Stream recordings while they are recorded only if enabled. Uploads only resume after a restart with a store.
+	// Streamed tracks only go to the primary uploader, even with more destinations.
+	if strings.EqualFold(os.Getenv("S3_STREAMING"), "true") {
+		multipart, ok := primary.(upload.MultipartUploader)
+		if !ok {
+			log.Fatal("S3_STREAMING requires S3 settings in the environment")
+		}
+		var partSize int64
+		if size := os.Getenv("S3_PART_SIZE"); size != "" {
+			if partSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+				log.Fatal(err)
+			}
+		}
+		streamer := upload.NewStreamer(multipart, st, participant.RecordingsDir, partSize)
+		if err = streamer.Resume(ctx); err != nil {
+			log.Fatal(err)
+		}
+		service.SetStreamer(streamer)
+	}
+
+	// Encrypt recordings only if a key is set, either the master key itself or the public key of whoever decrypts them
+	masterKey, publicKeyFile := os.Getenv("ENCRYPTION_KEY"), os.Getenv("ENCRYPTION_PUBLIC_KEY")
+	if masterKey != "" && publicKeyFile != "" {
+		log.Fatal("set only one of ENCRYPTION_KEY or ENCRYPTION_PUBLIC_KEY")
+	}
+	// The master key also seals upload URLs in the store, without it they are lost on restart
+	var targetKey *crypt.MasterKey
+	if masterKey != "" {
+		key, err := crypt.ParseMasterKey(masterKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		service.SetEncryption(key)
+		targetKey = key
+	}
+	if publicKeyFile != "" {
+		key, err := crypt.LoadPublicKey(publicKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		service.SetEncryption(key)
+	}
+
+	// Upload URLs come from API requests, keep them away from the internal network unless allowed
+	var policy upload.HTTPPolicy
+	if hosts := os.Getenv("UPLOAD_URL_HOSTS"); hosts != "" {
+		policy.Hosts = strings.Split(hosts, ",")
+	}
+	policy.AllowPrivate = strings.EqualFold(os.Getenv("UPLOAD_URL_ALLOW_PRIVATE"), "true")
+	service.SetUploadPolicy(policy)
+
+	// Upload finished recordings through a queue, which retries them. Uploads only survive restarts with a store.
+	uploadConfig := upload.QueueConfig{Policy: policy, TargetKey: targetKey}
+	if attempts := os.Getenv("UPLOAD_MAX_ATTEMPTS"); attempts != "" {
+		if uploadConfig.MaxAttempts, err = strconv.Atoi(attempts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if backoff := os.Getenv("UPLOAD_MIN_BACKOFF"); backoff != "" {
+		if uploadConfig.MinBackoff, err = time.ParseDuration(backoff); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if backoff := os.Getenv("UPLOAD_MAX_BACKOFF"); backoff != "" {
+		if uploadConfig.MaxBackoff, err = time.ParseDuration(backoff); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if workers := os.Getenv("UPLOAD_WORKERS"); workers != "" {
+		if uploadConfig.Workers, err = strconv.Atoi(workers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	uploads, err := upload.NewQueue(uploader, st, uploadConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.SetUploadQueue(uploads)
+	go uploads.Run(ctx)
+	uploadController := rest.NewUploadController(uploads)
+
+	// Start scheduled recordings. Schedules only survive restarts with a store.
+	if st == nil {
+		log.Warn("STORE_PATH not set, schedules will be lost on restart")
+	}
+	scheduler, err := schedule.NewScheduler(service, st)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go scheduler.Run(ctx)
+	scheduleController := rest.NewScheduleController(scheduler)
+
 	// Initialise recording controller
 	creds := rest.LiveKitCredentials{
 		BaseURL:   lkURL,
@@ -104,6 +435,81 @@ func main() {
 	}
 	controller := rest.NewRecordingController(creds, service)
 
+	// Name of the instance in the cluster
+	node := os.Getenv("NODE_ID")
+	if node == "" {
+		if node, err = os.Hostname(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Share participant recordings with other instances only if a coordinator is provided
+	var recorder queue.Recorder = service
+	switch coordinator := strings.ToLower(os.Getenv("COORDINATOR")); coordinator {
+	case "":
+	case "memory", "redis":
+		var ttl time.Duration
+		if leaseTTL := os.Getenv("LEASE_TTL"); leaseTTL != "" {
+			if ttl, err = time.ParseDuration(leaseTTL); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var c cluster.Coordinator = cluster.NewMemory()
+		if coordinator == "redis" {
+			c = cluster.NewRedis(newRedisClient(), redisPrefix)
+		}
+		assigner := cluster.NewAssigner(c, service, node, ttl)
+		assigner.SetTargetKey(targetKey)
+		go assigner.Run(ctx)
+		controller.SetAssigner(assigner)
+		scheduler.SetRecorder(assigner)
+		recorder = assigner
+	default:
+		log.Fatalf("unknown coordinator %s", coordinator)
+	}
+
+	// Queue start and stop requests only if a queue is provided
+	var jobs queue.Queue
+	switch backend := strings.ToLower(os.Getenv("QUEUE")); backend {
+	case "":
+	case "bolt":
+		if st == nil {
+			log.Fatal("QUEUE=bolt requires STORE_PATH")
+		}
+		jobs = queue.NewBolt(st)
+	case "redis":
+		jobs = queue.NewRedis(newRedisClient(), redisPrefix)
+	default:
+		log.Fatalf("unknown queue %s", backend)
+	}
+	if jobs != nil {
+		workers := 1
+		if count := os.Getenv("QUEUE_WORKERS"); count != "" {
+			if workers, err = strconv.Atoi(count); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for i := 1; i <= workers; i++ {
+			worker := queue.NewWorker(jobs, recorder, fmt.Sprintf("%s/%d", node, i))
+			worker.SetRoomRecorder(service)
+			worker.SetTargetKey(targetKey)
+			go worker.Run(ctx)
+		}
+		controller.SetQueue(jobs)
+		controller.SetTargetKey(targetKey)
+	}
+	jobController := rest.NewJobController(jobs)
+
+	// Load auto-record rules only if a rules file is provided
+	rulesFile := os.Getenv("RULES_FILE")
+	if rulesFile != "" {
+		engine, err := rules.Load(rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		controller.SetRules(engine)
+	}
+
 	// Initialise server
 	e := echo.New()
 
@@ -112,19 +518,65 @@ func main() {
 		Format: "(${host}) ${time_rfc3339} ${level}: ${method} ${uri} ${status} ${error}\n",
 	}))
 
+	// Replay responses to start and stop requests sent again with the same key. Instances sharing Redis share
+	// them, and with a store they survive restarts.
+	idempotencyStore := rest.NewMemoryIdempotencyStore()
+	if strings.EqualFold(os.Getenv("COORDINATOR"), "redis") || strings.EqualFold(os.Getenv("QUEUE"), "redis") {
+		idempotencyStore = rest.NewRedisIdempotencyStore(newRedisClient(), redisPrefix)
+	} else if st != nil {
+		idempotencyStore = rest.NewBoltIdempotencyStore(st)
+	}
+	idempotency := rest.NewIdempotency(idempotencyStore)
+
 	// Attach handlers
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Welcome to CGC")
 	})
 	e.GET("/health-check", func(c echo.Context) error {
-		return c.NoContent(http.StatusOK)
+		// Always healthy, so ongoing recordings aren't restarted while the disk is running out. /load reports admission.
+		status, err := service.DiskStatus()
+		if err != nil {
+			return c.JSON(http.StatusOK, echo.Map{"diskError": err.Error()})
+		}
+		return c.JSON(http.StatusOK, echo.Map{"disk": status})
 	})
 
+	e.GET("/load", controller.GetLoad)
+
 	// Attach egress handlers
-	e.POST("/recordings/start", controller.StartRecording)
-	e.POST("/recordings/stop", controller.StopRecording)
+	e.GET("/recordings", controller.ListRecordings)
+	e.POST("/recordings/start", controller.StartRecording, idempotency.Middleware)
+	e.POST("/recordings/stop", controller.StopRecording, idempotency.Middleware)
 	e.POST("/recordings/webhooks", controller.ReceiveWebhooks)
+	e.POST("/recordings/rooms/start", controller.StartRoomRecording, idempotency.Middleware)
+	e.POST("/recordings/rooms/stop", controller.StopRoomRecording, idempotency.Middleware)
+
+	// Attach job handlers, only if requests are queued
+	if jobs != nil {
+		e.GET("/jobs", jobController.ListJobs)
+		e.GET("/jobs/:id", jobController.GetJob)
+	}
+
+	// Attach upload handlers
+	e.GET("/uploads", uploadController.ListUploads)
+	e.GET("/uploads/:id", uploadController.GetUpload)
+	e.POST("/uploads/:id/retry", uploadController.RetryUpload)
+
+	// Attach schedule handlers
+	e.GET("/schedules", scheduleController.ListSchedules)
+	e.POST("/schedules", scheduleController.CreateSchedule)
+	e.DELETE("/schedules/:id", scheduleController.CancelSchedule)
 
-	// Start server
-	e.Logger.Fatal(e.Start(":" + port))
+	// Start server, until shutting down
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(shutdownCtx); err != nil {
+			log.Error(err)
+		}
+	}()
+	if err = e.Start(":" + port); err != nil && err != http.ErrServerClosed {
+		e.Logger.Fatal(err)
+	}
 }
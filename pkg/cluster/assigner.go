@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/labstack/gommon/log"
+)
+
+// DefaultLeaseTTL is how long an instance may be unreachable before its recordings are reassigned
+const DefaultLeaseTTL = 15 * time.Second
+
+// Assigner records each wanted participant on exactly one instance of the cluster.
+// Leases are renewed while recording, and recordings of an instance which dies are taken over by the others.
+type Assigner struct {
+	coordinator Coordinator
+	service     recording.Service
+	node        string
+	ttl         time.Duration
+
+	// Seals the upload targets of assignments
+	targetKey *crypt.MasterKey
+
+	// Recordings leased by this instance. Key: assignment key
+	lock  sync.Mutex
+	owned map[string]Assignment
+}
+
+func NewAssigner(coordinator Coordinator, service recording.Service, node string, ttl time.Duration) *Assigner {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Assigner{
+		coordinator: coordinator,
+		service:     service,
+		node:        node,
+		ttl:         ttl,
+		owned:       make(map[string]Assignment),
+	}
+}
+
+// SetTargetKey seals the upload targets of assignments. Requests with one are refused without it.
+func (a *Assigner) SetTargetKey(key *crypt.MasterKey) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.targetKey = key
+}
+
+// StartRecording wants the participant recorded by one instance, this one if nobody else records them yet
+func (a *Assigner) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	a.lock.Lock()
+	key := a.targetKey
+	a.lock.Unlock()
+
+	as, err := assignmentOf(req, key)
+	if err != nil {
+		return err
+	}
+	if err = a.coordinator.Put(ctx, as); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err = a.claim(ctx, as)
+
+	// Another instance with room to spare takes it over
+	if errors.Is(err, recording.ErrAtCapacity) || errors.Is(err, recording.ErrInsufficientStorage) {
+		log.Infof("leaving recording to other instances | error: %v, room: %s, participant: %s", err, as.Room, as.Participant)
+		return nil
+	}
+	return err
+}
+
+// StopRecording ends the recording in the whole cluster. The instance recording it stops on its next renewal.
+func (a *Assigner) StopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	key := assignmentKey(req.Room, req.Participant)
+	if err := a.coordinator.Remove(ctx, key); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, found := a.owned[key]; !found {
+		return nil
+	}
+	return a.abandon(ctx, key, true)
+}
+
+// Recorded returns true if the participant is wanted in the cluster, whichever instance records them
+func (a *Assigner) Recorded(ctx context.Context, room string, participant string) (bool, error) {
+	assignments, err := a.coordinator.Assignments(ctx)
+	if err != nil {
+		return false, err
+	}
+	key := assignmentKey(room, participant)
+	for _, as := range assignments {
+		if as.Key() == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// StopRoom forgets every recording of a room which has finished
+func (a *Assigner) StopRoom(ctx context.Context, room string) error {
+	assignments, err := a.coordinator.Assignments(ctx)
+	if err != nil {
+		return err
+	}
+	for _, as := range assignments {
+		if as.Room != room {
+			continue
+		}
+		if err = a.StopRecording(ctx, recording.StopRecordingRequest{Room: as.Room, Participant: as.Participant}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run renews leases and takes over unleased recordings until the context is cancelled
+func (a *Assigner) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.releaseAll()
+			return
+		case <-ticker.C:
+			a.tick(ctx)
+		}
+	}
+}
+
+func (a *Assigner) tick(ctx context.Context) {
+	assignments, err := a.coordinator.Assignments(ctx)
+	if err != nil {
+		log.Errorf("cannot list assignments | error: %v", err)
+		return
+	}
+	wanted := make(map[string]Assignment)
+	for _, as := range assignments {
+		wanted[as.Key()] = as
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Keep the leases of recordings still wanted and still running here
+	for key, as := range a.owned {
+		if _, found := wanted[key]; !found {
+			log.Infof("recording no longer wanted | room: %s, participant: %s", as.Room, as.Participant)
+			a.abandon(ctx, key, true)
+			continue
+		}
+		if !a.isRecording(as) {
+			// Ended here for good, e.g. on a limit, so no other instance should pick it up
+			log.Infof("recording ended, removing assignment | room: %s, participant: %s", as.Room, as.Participant)
+			if err = a.coordinator.Remove(ctx, key); err != nil {
+				log.Errorf("cannot remove assignment | error: %v, key: %s", err, key)
+			}
+			a.abandon(ctx, key, false)
+			continue
+		}
+		acquired, err := a.coordinator.Acquire(ctx, key, a.node, a.ttl)
+		if err != nil {
+			// Keep recording, the lease may still be renewed before it expires
+			log.Errorf("cannot renew lease | error: %v, key: %s", err, key)
+			continue
+		}
+		if !acquired {
+			log.Warnf("lease lost to another instance | room: %s, participant: %s", as.Room, as.Participant)
+			a.abandon(ctx, key, true)
+		}
+	}
+
+	// Take over recordings nobody holds, e.g. from an instance which died
+	for key, as := range wanted {
+		if _, found := a.owned[key]; found {
+			continue
+		}
+		if err = a.claim(ctx, as); err != nil {
+			log.Debugf("cannot take over recording | error: %v, room: %s, participant: %s", err, as.Room, as.Participant)
+		}
+	}
+}
+
+// claim leases the assignment and records it here. Nothing happens if another instance holds it. Must hold the lock.
+func (a *Assigner) claim(ctx context.Context, as Assignment) error {
+	key := as.Key()
+	acquired, err := a.coordinator.Acquire(ctx, key, a.node, a.ttl)
+	if err != nil || !acquired {
+		return err
+	}
+
+	req, err := as.request(a.targetKey)
+	if err == nil {
+		err = a.service.StartRecording(ctx, req)
+	}
+	if err != nil {
+		// Let another instance try
+		if err := a.coordinator.Release(ctx, key, a.node); err != nil {
+			log.Errorf("cannot release lease | error: %v, key: %s", err, key)
+		}
+		return err
+	}
+	a.owned[key] = as
+	log.Infof("recording assigned here | node: %s, room: %s, participant: %s", a.node, as.Room, as.Participant)
+	return nil
+}
+
+// abandon releases a recording of this instance, stopping it if needed. Must hold the lock.
+func (a *Assigner) abandon(ctx context.Context, key string, stop bool) error {
+	as := a.owned[key]
+	delete(a.owned, key)
+
+	var err error
+	if stop {
+		err = a.service.StopRecording(ctx, recording.StopRecordingRequest{Room: as.Room, Participant: as.Participant})
+		if errors.Is(err, recording.ErrRoomNotRecorded) {
+			err = nil
+		}
+	}
+	if releaseErr := a.coordinator.Release(ctx, key, a.node); releaseErr != nil {
+		log.Errorf("cannot release lease | error: %v, key: %s", releaseErr, key)
+	}
+	return err
+}
+
+// isRecording checks that the participant is still pending or recording here. Must hold the lock.
+func (a *Assigner) isRecording(as Assignment) bool {
+	for _, r := range a.service.ListRecordings(recording.RecordingFilter{Room: as.Room, Participant: as.Participant}) {
+		if r.Status == participant.StatusPending || r.Status == participant.StatusRecording {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAll lets other instances take over right away when shutting down
+func (a *Assigner) releaseAll() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for key := range a.owned {
+		if err := a.coordinator.Release(context.Background(), key, a.node); err != nil {
+			log.Errorf("cannot release lease | error: %v, key: %s", err, key)
+		}
+		delete(a.owned, key)
+	}
+}
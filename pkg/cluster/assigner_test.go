@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/require"
+)
+
+// mockService keeps the recordings of one instance
+type mockService struct {
+	recording.Service
+	recording map[string]bool
+	err       error
+}
+
+func newMockService() *mockService {
+	return &mockService{recording: make(map[string]bool)}
+}
+
+func (m *mockService) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.recording[assignmentKey(req.Room, req.Participant)] = true
+	return nil
+}
+
+func (m *mockService) StopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	delete(m.recording, assignmentKey(req.Room, req.Participant))
+	return nil
+}
+
+func (m *mockService) ListRecordings(filter recording.RecordingFilter) []participant.ParticipantData {
+	if !m.recording[assignmentKey(filter.Room, filter.Participant)] {
+		return nil
+	}
+	return []participant.ParticipantData{{Room: filter.Room, Identity: filter.Participant, Status: participant.StatusRecording}}
+}
+
+var request = recording.StartRecordingRequest{Room: "room", Participant: "alice"}
+
+func TestMemoryLease(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	acquired, err := m.Acquire(ctx, "key", "a", time.Second)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	acquired, _ = m.Acquire(ctx, "key", "b", time.Second)
+	require.False(t, acquired)
+
+	// Only the holder can release
+	require.NoError(t, m.Release(ctx, "key", "b"))
+	acquired, _ = m.Acquire(ctx, "key", "b", time.Second)
+	require.False(t, acquired)
+
+	now = now.Add(time.Second)
+	acquired, _ = m.Acquire(ctx, "key", "b", time.Second)
+	require.True(t, acquired)
+}
+
+func TestRecordedOnce(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	a, b := newMockService(), newMockService()
+	first := NewAssigner(m, a, "a", time.Second)
+	second := NewAssigner(m, b, "b", time.Second)
+
+	require.NoError(t, first.StartRecording(ctx, request))
+	require.NoError(t, second.StartRecording(ctx, request))
+	second.tick(ctx)
+
+	require.True(t, a.recording["room/alice"])
+	require.Empty(t, b.recording)
+	recorded, err := second.Recorded(ctx, "room", "alice")
+	require.NoError(t, err)
+	require.True(t, recorded)
+
+	// Stopping on any instance stops the owner on its next renewal
+	require.NoError(t, second.StopRecording(ctx, recording.StopRecordingRequest{Room: "room", Participant: "alice"}))
+	first.tick(ctx)
+	require.Empty(t, a.recording)
+	recorded, err = first.Recorded(ctx, "room", "alice")
+	require.NoError(t, err)
+	require.False(t, recorded)
+}
+
+func TestReassignedWhenOwnerDies(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	a, b := newMockService(), newMockService()
+	first := NewAssigner(m, a, "a", time.Second)
+	second := NewAssigner(m, b, "b", time.Second)
+
+	require.NoError(t, first.StartRecording(ctx, request))
+
+	// The first instance stops renewing
+	now = now.Add(time.Second)
+	second.tick(ctx)
+	require.True(t, b.recording["room/alice"])
+}
+
+func TestLeftToOtherInstancesAtCapacity(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	a, b := newMockService(), newMockService()
+	a.err = recording.ErrAtCapacity
+	first := NewAssigner(m, a, "a", time.Second)
+	second := NewAssigner(m, b, "b", time.Second)
+
+	require.NoError(t, first.StartRecording(ctx, request))
+	second.tick(ctx)
+	require.True(t, b.recording["room/alice"])
+}
+
+func TestEndedRecordingIsNotReassigned(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	a, b := newMockService(), newMockService()
+	first := NewAssigner(m, a, "a", time.Second)
+	second := NewAssigner(m, b, "b", time.Second)
+
+	require.NoError(t, first.StartRecording(ctx, request))
+
+	// e.g. stopped on a limit
+	delete(a.recording, "room/alice")
+	first.tick(ctx)
+	second.tick(ctx)
+
+	require.Empty(t, b.recording)
+	assignments, err := m.Assignments(ctx)
+	require.NoError(t, err)
+	require.Empty(t, assignments)
+}
+
+func TestAssignmentRoundTrip(t *testing.T) {
+	req := recording.StartRecordingRequest{
+		ID:          "RC_1",
+		Room:        "room",
+		Participant: "alice",
+		Profile:     recording.MediaMuxedAV,
+		Sources:     []livekit.TrackSource{livekit.TrackSource_CAMERA},
+		Limits:      recording.Limits{MaxDuration: time.Hour, MaxSize: 1 << 30, OnLimit: recording.LimitStop},
+		Rotation:    participant.Rotation{Duration: 10 * time.Minute},
+		Priority:    2,
+		Upload:      &upload.HTTPTarget{URL: "https://bucket.example.com/a.mp4", Method: "PUT"},
+	}
+	key, err := crypt.ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	as, err := assignmentOf(req, key)
+	require.NoError(t, err)
+	opened, err := as.request(key)
+	require.NoError(t, err)
+	require.Equal(t, req, opened)
+
+	// The upload target is only shared sealed, and refused without a key
+	shared, err := json.Marshal(as)
+	require.NoError(t, err)
+	require.NotContains(t, string(shared), "bucket.example.com")
+	_, err = assignmentOf(req, nil)
+	require.ErrorIs(t, err, upload.ErrTargetKeyMissing)
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/livekit/protocol/livekit"
+)
+
+// Coordinator is shared by the instances of a cluster. It keeps the recordings wanted in the cluster,
+// and leases which make sure each of them is recorded by a single instance.
+type Coordinator interface {
+	// Acquire takes the lease of key for node, or extends it if node already holds it.
+	// Returns false if another node holds it.
+	Acquire(ctx context.Context, key string, node string, ttl time.Duration) (bool, error)
+
+	// Release gives up the lease of key, only if node holds it
+	Release(ctx context.Context, key string, node string) error
+
+	// Wanted recordings are kept until they are removed, whichever instance records them
+	Put(ctx context.Context, a Assignment) error
+	Remove(ctx context.Context, key string) error
+	Assignments(ctx context.Context) ([]Assignment, error)
+}
+
+// Assignment is a participant recording wanted somewhere in the cluster
+type Assignment struct {
+	ID          string                 `json:"id,omitempty"`
+	Room        string                 `json:"room"`
+	Participant string                 `json:"participant"`
+	Profile     recording.MediaProfile `json:"profile,omitempty"`
+	Sources     []livekit.TrackSource  `json:"sources,omitempty"`
+	Limits      recording.Limits       `json:"limits"`
+	Rotation    participant.Rotation   `json:"rotation"`
+	Priority    int                    `json:"priority,omitempty"`
+
+	// Sealed with the master key, since the upload target carries credentials
+	SealedUpload []byte `json:"sealedUpload,omitempty"`
+}
+
+func (a Assignment) Key() string {
+	return assignmentKey(a.Room, a.Participant)
+}
+
+func assignmentKey(room string, participant string) string {
+	return room + "/" + participant
+}
+
+// assignmentOf shares a request with the cluster, with its upload target sealed with key, or refused without one
+func assignmentOf(req recording.StartRecordingRequest, key *crypt.MasterKey) (Assignment, error) {
+	as := Assignment{
+		ID:          req.ID,
+		Room:        req.Room,
+		Participant: req.Participant,
+		Profile:     req.Profile,
+		Sources:     req.Sources,
+		Limits:      req.Limits,
+		Rotation:    req.Rotation,
+		Priority:    req.Priority,
+	}
+	if req.Upload != nil {
+		sealed, err := upload.SealTarget(key, *req.Upload)
+		if err != nil {
+			return Assignment{}, err
+		}
+		as.SealedUpload = sealed
+	}
+	return as, nil
+}
+
+func (a Assignment) request(key *crypt.MasterKey) (recording.StartRecordingRequest, error) {
+	req := recording.StartRecordingRequest{
+		ID:          a.ID,
+		Room:        a.Room,
+		Participant: a.Participant,
+		Profile:     a.Profile,
+		Sources:     a.Sources,
+		Limits:      a.Limits,
+		Rotation:    a.Rotation,
+		Priority:    a.Priority,
+	}
+	if a.SealedUpload != nil {
+		target, err := upload.OpenTarget(key, a.SealedUpload)
+		if err != nil {
+			return recording.StartRecordingRequest{}, err
+		}
+		req.Upload = target
+	}
+	return req, nil
+}
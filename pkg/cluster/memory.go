@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type lease struct {
+	node    string
+	expires time.Time
+}
+
+// Memory coordinates the instances of a single process, for a single node or tests
+type Memory struct {
+	lock        sync.Mutex
+	leases      map[string]lease
+	assignments map[string]Assignment
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		leases:      make(map[string]lease),
+		assignments: make(map[string]Assignment),
+		now:         time.Now,
+	}
+}
+
+func (m *Memory) Acquire(ctx context.Context, key string, node string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	if l, found := m.leases[key]; found && l.node != node && now.Before(l.expires) {
+		return false, nil
+	}
+	m.leases[key] = lease{node: node, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Release(ctx context.Context, key string, node string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if l, found := m.leases[key]; found && l.node == node {
+		delete(m.leases, key)
+	}
+	return nil
+}
+
+func (m *Memory) Put(ctx context.Context, a Assignment) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.assignments[a.Key()] = a
+	return nil
+}
+
+func (m *Memory) Remove(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.assignments, key)
+	return nil
+}
+
+func (m *Memory) Assignments(ctx context.Context) ([]Assignment, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	assignments := []Assignment{}
+	for _, a := range m.assignments {
+		assignments = append(assignments, a)
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].Key() < assignments[j].Key()
+	})
+	return assignments, nil
+}
@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// Takes the lease if it is free, or extends it if the node already holds it
+	acquireScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if owner == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// Redis coordinates instances through any Redis-compatible server. Leases expire on their own if an instance dies.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis namespaces every key with prefix, so several clusters can share a server
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client, prefix}
+}
+
+func (r *Redis) leaseKey(key string) string {
+	return r.prefix + "lease:" + key
+}
+
+func (r *Redis) assignmentsKey() string {
+	return r.prefix + "assignments"
+}
+
+func (r *Redis) Acquire(ctx context.Context, key string, node string, ttl time.Duration) (bool, error) {
+	acquired, err := acquireScript.Run(ctx, r.client, []string{r.leaseKey(key)}, node, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return acquired == 1, nil
+}
+
+func (r *Redis) Release(ctx context.Context, key string, node string) error {
+	return releaseScript.Run(ctx, r.client, []string{r.leaseKey(key)}, node).Err()
+}
+
+func (r *Redis) Put(ctx context.Context, a Assignment) error {
+	value, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, r.assignmentsKey(), a.Key(), value).Err()
+}
+
+func (r *Redis) Remove(ctx context.Context, key string) error {
+	return r.client.HDel(ctx, r.assignmentsKey(), key).Err()
+}
+
+func (r *Redis) Assignments(ctx context.Context) ([]Assignment, error) {
+	values, err := r.client.HGetAll(ctx, r.assignmentsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	assignments := []Assignment{}
+	for _, value := range values {
+		var a Assignment
+		if err = json.Unmarshal([]byte(value), &a); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].Key() < assignments[j].Key()
+	})
+	return assignments, nil
+}
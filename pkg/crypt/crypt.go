@@ -0,0 +1,323 @@
+// Package crypt encrypts recordings with AES-256-GCM, in chunks so they can be written and read as streams.
+//
+// Each recording has its own data key, stored in the header of its files wrapped with a master key or an
+// RSA public key. A file is the header followed by chunks of ChunkSize bytes, each sealed with a nonce made of
+// a random prefix, the number of the chunk and whether it is the last one, so chunks can't be reordered,
+// dropped or cut off without the file failing to decrypt.
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	magic   = "LKRE"
+	version = 1
+
+	// Bytes of cleartext in each chunk
+	ChunkSize = 64 << 10
+
+	// Appended to the names of encrypted files
+	Extension = ".enc"
+
+	prefixSize   = 7
+	maxChunkSize = 16 << 20
+)
+
+var (
+	ErrNotEncrypted       = errors.New("not an encrypted recording")
+	ErrUnsupportedVersion = errors.New("unsupported version of encrypted recording")
+	ErrCorrupt            = errors.New("encrypted recording is corrupt or truncated")
+	ErrClosed             = errors.New("encrypted writer is closed")
+)
+
+// DataKey encrypts the files of a recording. Only its wrapped form is stored, in the header of each file.
+type DataKey struct {
+	key     []byte
+	aead    cipher.AEAD
+	wrapped wrappedKey
+}
+
+// NewDataKey generates a data key, wrapped with w
+func NewDataKey(w Wrapper) (*DataKey, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := w.wrap(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{key: key, aead: aead, wrapped: wrapped}, nil
+}
+
+// unwrap lets the recorder read back its own files, even when it can't unwrap keys
+func (d *DataKey) unwrap(w wrappedKey) ([]byte, error) {
+	if w.method != d.wrapped.method || !bytes.Equal(w.keyID, d.wrapped.keyID) || !bytes.Equal(w.key, d.wrapped.key) {
+		return nil, ErrWrongKey
+	}
+	return d.key, nil
+}
+
+type header struct {
+	wrapped   wrappedKey
+	chunkSize uint32
+	prefix    []byte
+}
+
+func (h header) marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString(magic)
+	b.WriteByte(version)
+	b.WriteByte(h.wrapped.method)
+	b.WriteByte(byte(len(h.wrapped.keyID)))
+	b.Write(h.wrapped.keyID)
+	writeUint(&b, uint32(len(h.wrapped.key)), 2)
+	b.Write(h.wrapped.key)
+	writeUint(&b, h.chunkSize, 4)
+	b.Write(h.prefix)
+	return b.Bytes()
+}
+
+func writeUint(b *bytes.Buffer, v uint32, size int) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	b.Write(buf[4-size:])
+}
+
+// readHeader returns the header and its bytes, which are authenticated with every chunk
+func readHeader(r io.Reader) (header, []byte, error) {
+	var raw bytes.Buffer
+	read := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, ErrCorrupt
+			}
+			return nil, err
+		}
+		raw.Write(b)
+		return b, nil
+	}
+
+	start, err := read(len(magic) + 3)
+	if err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			err = ErrNotEncrypted
+		}
+		return header{}, nil, err
+	}
+	if string(start[:len(magic)]) != magic {
+		return header{}, nil, ErrNotEncrypted
+	}
+	if start[len(magic)] != version {
+		return header{}, nil, ErrUnsupportedVersion
+	}
+	h := header{wrapped: wrappedKey{method: start[len(magic)+1]}}
+	if h.wrapped.keyID, err = read(int(start[len(magic)+2])); err != nil {
+		return header{}, nil, err
+	}
+	size, err := read(2)
+	if err != nil {
+		return header{}, nil, err
+	}
+	if h.wrapped.key, err = read(int(binary.BigEndian.Uint16(size))); err != nil {
+		return header{}, nil, err
+	}
+	chunkSize, err := read(4)
+	if err != nil {
+		return header{}, nil, err
+	}
+	h.chunkSize = binary.BigEndian.Uint32(chunkSize)
+	if h.chunkSize == 0 || h.chunkSize > maxChunkSize {
+		return header{}, nil, ErrCorrupt
+	}
+	if h.prefix, err = read(prefixSize); err != nil {
+		return header{}, nil, err
+	}
+	return h, raw.Bytes(), nil
+}
+
+// nonce of the chunk, the last one is flagged so the file can't be truncated at a chunk boundary
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// Writer encrypts what is written to it in chunks
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+	closed  bool
+	err     error
+}
+
+// NewWriter writes the header to w. Close must be called to write the last chunk.
+func NewWriter(w io.Writer, key *DataKey) (*Writer, error) {
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	h := header{wrapped: key.wrapped, chunkSize: ChunkSize, prefix: prefix}
+	aad := h.marshal()
+	if _, err := w.Write(aad); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   key.aead,
+		aad:    aad,
+		prefix: prefix,
+		buf:    make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+key.aead.Overhead()),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		take := ChunkSize - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		n += take
+
+		// A full chunk is never the last, Close seals whatever is left, even if it's nothing
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *Writer) seal(last bool) error {
+	if w.counter == math.MaxUint32 {
+		w.err = errors.New("encrypted recording is too long")
+		return w.err
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], nonce(w.prefix, w.counter, last), w.buf, w.aad)
+	if _, err := w.w.Write(w.sealed); err != nil {
+		w.err = err
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the last chunk, without which the file can't be decrypted. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Reader decrypts a file written by Writer
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	in      []byte
+	plain   []byte
+	done    bool
+}
+
+// NewReader reads the header, and unwraps the data key with key
+func NewReader(r io.Reader, key Unwrapper) (*Reader, error) {
+	h, aad, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := key.unwrap(h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      r,
+		aead:   aead,
+		aad:    aad,
+		prefix: h.prefix,
+		in:     make([]byte, int(h.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk. Only the last one is shorter than a full chunk.
+func (r *Reader) next() error {
+	n, err := io.ReadFull(r.r, r.in)
+	last := false
+	switch {
+	case err == nil:
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case errors.Is(err, io.EOF):
+		return ErrCorrupt
+	default:
+		return err
+	}
+	if n < r.aead.Overhead() {
+		return ErrCorrupt
+	}
+	plain, err := r.aead.Open(r.in[:0], nonce(r.prefix, r.counter, last), r.in[:n], r.aad)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.plain = plain
+	r.counter++
+	r.done = last
+	return nil
+}
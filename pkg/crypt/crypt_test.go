@@ -0,0 +1,146 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func masterKey(t *testing.T) *MasterKey {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	m, err := ParseMasterKey(hex.EncodeToString(key))
+	require.NoError(t, err)
+	return m
+}
+
+func encrypt(t *testing.T, key *DataKey, data []byte) []byte {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return out.Bytes()
+}
+
+func decrypt(key Unwrapper, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := masterKey(t)
+	key, err := NewDataKey(m)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		data := make([]byte, size)
+		_, err = rand.Read(data)
+		require.NoError(t, err)
+
+		encrypted := encrypt(t, key, data)
+		require.False(t, size > 16 && bytes.Contains(encrypted, data))
+
+		// With the master key, and with the data key the recorder keeps
+		for _, unwrapper := range []Unwrapper{m, key} {
+			decrypted, err := decrypt(unwrapper, encrypted)
+			require.NoError(t, err, "size %d", size)
+			require.Equal(t, data, decrypted, "size %d", size)
+		}
+	}
+}
+
+func TestTamperedOrTruncated(t *testing.T) {
+	m := masterKey(t)
+	key, err := NewDataKey(m)
+	require.NoError(t, err)
+	encrypted := encrypt(t, key, bytes.Repeat([]byte("a"), 2*ChunkSize+10))
+	headerSize := len(encrypted) - (2*(ChunkSize+16) + 10 + 16)
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = decrypt(m, tampered)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	// Cut off at a chunk boundary, so the last chunk is missing
+	_, err = decrypt(m, encrypted[:headerSize+ChunkSize+16])
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = decrypt(m, encrypted[:len(encrypted)-5])
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = decrypt(m, []byte("ftypisom"))
+	require.ErrorIs(t, err, ErrNotEncrypted)
+}
+
+func TestWrongKey(t *testing.T) {
+	key, err := NewDataKey(masterKey(t))
+	require.NoError(t, err)
+	_, err = decrypt(masterKey(t), encrypt(t, key, []byte("data")))
+	require.ErrorIs(t, err, ErrWrongKey)
+}
+
+func TestPublicKey(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	publicFile := filepath.Join(dir, "public.pem")
+	privateFile := filepath.Join(dir, "private.pem")
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644))
+	require.NoError(t, os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(private),
+	}), 0600))
+
+	publicKey, err := LoadPublicKey(publicFile)
+	require.NoError(t, err)
+	privateKey, err := LoadPrivateKey(privateFile)
+	require.NoError(t, err)
+
+	key, err := NewDataKey(publicKey)
+	require.NoError(t, err)
+	decrypted, err := decrypt(privateKey, encrypt(t, key, []byte("data")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), decrypted)
+
+	_, err = decrypt(masterKey(t), encrypt(t, key, []byte("data")))
+	require.ErrorIs(t, err, ErrWrongKey)
+}
+
+func TestParseMasterKey(t *testing.T) {
+	_, err := ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+
+	_, err = ParseMasterKey("00ff")
+	require.ErrorIs(t, err, ErrInvalidMasterKey)
+}
+
+func TestSealAndOpen(t *testing.T) {
+	key := masterKey(t)
+	sealed, err := key.Seal([]byte("secret"))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "secret")
+
+	data, err := key.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), data)
+
+	_, err = masterKey(t).Open(sealed)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
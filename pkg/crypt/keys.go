@@ -0,0 +1,235 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// How the data key is wrapped in the header of the files
+const (
+	methodMasterKey byte = 1 // AES-256-GCM with the master key
+	methodRSA       byte = 2 // RSA-OAEP with SHA-256
+
+	keySize   = 32
+	keyIDSize = 8
+	minRSA    = 2048
+)
+
+var (
+	ErrInvalidMasterKey = errors.New("master key must be 32 bytes, hex or base64 encoded")
+	ErrInvalidRSAKey    = errors.New("key must be a PEM encoded RSA key of at least 2048 bits")
+	ErrWrongKey         = errors.New("recording is encrypted with another key")
+)
+
+// wrappedKey is a data key as it is stored
+type wrappedKey struct {
+	method byte
+	// Identifies the key which wrapped it
+	keyID []byte
+	key   []byte
+}
+
+// Wrapper protects data keys, see MasterKey and PublicKey
+type Wrapper interface {
+	wrap(dataKey []byte) (wrappedKey, error)
+}
+
+// Unwrapper recovers data keys, see MasterKey and PrivateKey
+type Unwrapper interface {
+	unwrap(w wrappedKey) ([]byte, error)
+}
+
+// MasterKey is a symmetric key, needed to both encrypt and decrypt
+type MasterKey struct {
+	aead cipher.AEAD
+	id   []byte
+}
+
+// ParseMasterKey reads a 32 byte key, hex or base64 encoded
+func ParseMasterKey(s string) (*MasterKey, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != keySize {
+		return nil, ErrInvalidMasterKey
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &MasterKey{aead: aead, id: keyID(key)}, nil
+}
+
+func (m *MasterKey) wrap(dataKey []byte) (wrappedKey, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{
+		method: methodMasterKey,
+		keyID:  m.id,
+		key:    m.aead.Seal(nonce, nonce, dataKey, m.id),
+	}, nil
+}
+
+func (m *MasterKey) unwrap(w wrappedKey) ([]byte, error) {
+	if w.method != methodMasterKey || !bytes.Equal(w.keyID, m.id) {
+		return nil, ErrWrongKey
+	}
+	size := m.aead.NonceSize()
+	if len(w.key) < size {
+		return nil, ErrCorrupt
+	}
+	key, err := m.aead.Open(nil, w.key[:size], w.key[size:], m.id)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return key, nil
+}
+
+// Seal encrypts a small value, such as a secret kept on disk
+func (m *MasterKey) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, data, m.id), nil
+}
+
+// Open decrypts a value sealed with the same key
+func (m *MasterKey) Open(sealed []byte) ([]byte, error) {
+	size := m.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, ErrCorrupt
+	}
+	data, err := m.aead.Open(nil, sealed[:size], sealed[size:], m.id)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+// PublicKey wraps data keys so that only the holder of the private key can decrypt recordings
+type PublicKey struct {
+	key *rsa.PublicKey
+	id  []byte
+}
+
+// LoadPublicKey reads a PEM encoded RSA public key, in PKIX or PKCS #1 form
+func LoadPublicKey(filename string) (*PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidRSAKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok || rsaKey.N.BitLen() < minRSA {
+		return nil, ErrInvalidRSAKey
+	}
+	return &PublicKey{key: rsaKey, id: publicKeyID(rsaKey)}, nil
+}
+
+func (p *PublicKey) wrap(dataKey []byte) (wrappedKey, error) {
+	key, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, p.key, dataKey, nil)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{method: methodRSA, keyID: p.id, key: key}, nil
+}
+
+// PrivateKey decrypts recordings wrapped with its public key
+type PrivateKey struct {
+	key *rsa.PrivateKey
+	id  []byte
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key, in PKCS #8 or PKCS #1 form
+func LoadPrivateKey(filename string) (*PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidRSAKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok || rsaKey.N.BitLen() < minRSA {
+		return nil, ErrInvalidRSAKey
+	}
+	return &PrivateKey{key: rsaKey, id: publicKeyID(&rsaKey.PublicKey)}, nil
+}
+
+func (p *PrivateKey) unwrap(w wrappedKey) ([]byte, error) {
+	if w.method != methodRSA || !bytes.Equal(w.keyID, p.id) {
+		return nil, ErrWrongKey
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, p.key, w.key, nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return key, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidRSAKey
+	}
+	return block, nil
+}
+
+// keyID is a short fingerprint, so a wrong key is told apart from a corrupt file
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+func publicKeyID(key *rsa.PublicKey) []byte {
+	return keyID(x509.MarshalPKCS1PublicKey(key))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,21 @@
+package disk
+
+import "syscall"
+
+// Usage of the filesystem holding a path, in bytes
+type Usage struct {
+	Total uint64 `json:"total"`
+	// Available to unprivileged users
+	Free uint64 `json:"free"`
+}
+
+func Stat(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Total: uint64(st.Blocks) * uint64(st.Bsize),
+		Free:  uint64(st.Bavail) * uint64(st.Bsize),
+	}, nil
+}
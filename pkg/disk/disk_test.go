@@ -0,0 +1,19 @@
+package disk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	usage, err := Stat(t.TempDir())
+	require.NoError(t, err)
+	require.NotZero(t, usage.Total)
+	require.LessOrEqual(t, usage.Free, usage.Total)
+}
+
+func TestStatMissingPath(t *testing.T) {
+	_, err := Stat("/does/not/exist")
+	require.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// Responses are replayed for this long after the first request
+	idempotencyTTL = 24 * time.Hour
+	// A key stays reserved for this long while its request is carried out, in case the instance stops meanwhile
+	idempotencyPendingTTL = 5 * time.Minute
+)
+
+var (
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is in progress")
+	ErrIdempotencyMismatch   = errors.New("idempotency key was used for a different request")
+)
+
+// IdempotentResponse is kept for a key, reserved without a response while its request is carried out
+type IdempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// IdempotencyStore keeps responses until they expire
+type IdempotencyStore interface {
+	// Reserve keeps r for the key, unless a response which hasn't expired is kept already, which is returned instead
+	Reserve(ctx context.Context, key string, r IdempotentResponse) (*IdempotentResponse, error)
+	Save(ctx context.Context, key string, r IdempotentResponse) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Idempotency replays the response of a request sent again with the same Idempotency-Key header.
+// Server errors are not kept, so those requests can be retried.
+type Idempotency struct {
+	store IdempotencyStore
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+// NewIdempotency keeps responses in st. They are replayed after a restart with a store, and by every instance with Redis.
+func NewIdempotency(st IdempotencyStore) *Idempotency {
+	return &Idempotency{
+		store: st,
+		now:   time.Now,
+	}
+}
+
+// Middleware applies to requests carrying the header, others go through untouched
+func (i *Idempotency) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+
+		// The same key can't be reused for another request
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(c.Request().Method+" "+c.Path()+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		ctx := c.Request().Context()
+		response, err := i.store.Reserve(ctx, key, IdempotentResponse{Fingerprint: fingerprint, Expires: i.now().Add(idempotencyPendingTTL)})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		if response != nil {
+			if response.Fingerprint != fingerprint {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, ErrIdempotencyMismatch)
+			}
+			if !response.Done {
+				return echo.NewHTTPError(http.StatusConflict, ErrIdempotencyInProgress)
+			}
+			for name, values := range response.Header {
+				c.Response().Header()[name] = values
+			}
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.Blob(response.Status, response.Header.Get(echo.HeaderContentType), response.Body)
+		}
+
+		// Capture the response, including errors written by the error handler
+		recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		if err = next(c); err != nil {
+			c.Error(err)
+		}
+		i.finish(ctx, key, fingerprint, c.Response().Status, c.Response().Header(), recorder.body.Bytes())
+		return nil
+	}
+}
+
+func (i *Idempotency) finish(ctx context.Context, key string, fingerprint string, status int, header http.Header, body []byte) {
+	if status >= http.StatusInternalServerError {
+		if err := i.store.Delete(ctx, key); err != nil {
+			log.Errorf("cannot release idempotency key | error: %v, key: %s", err, key)
+		}
+		return
+	}
+	err := i.store.Save(ctx, key, IdempotentResponse{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      status,
+		Header:      header.Clone(),
+		Body:        body,
+		Expires:     i.now().Add(idempotencyTTL),
+	})
+	if err != nil {
+		log.Errorf("cannot keep idempotent response | error: %v, key: %s", err, key)
+	}
+}
+
+// memoryIdempotency keeps responses for a single instance, until it restarts
+type memoryIdempotency struct {
+	lock      sync.Mutex
+	responses map[string]IdempotentResponse
+}
+
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotency{responses: make(map[string]IdempotentResponse)}
+}
+
+func (m *memoryIdempotency) Reserve(ctx context.Context, key string, r IdempotentResponse) (*IdempotentResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	for k, existing := range m.responses {
+		if now.After(existing.Expires) {
+			delete(m.responses, k)
+		}
+	}
+	if existing, found := m.responses[key]; found {
+		return &existing, nil
+	}
+	m.responses[key] = r
+	return nil, nil
+}
+
+func (m *memoryIdempotency) Save(ctx context.Context, key string, r IdempotentResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.responses[key] = r
+	return nil
+}
+
+func (m *memoryIdempotency) Delete(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.responses, key)
+	return nil
+}
+
+// responseRecorder keeps a copy of the body written to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.ResponseWriter.(http.Hijacker).Hijack()
+}
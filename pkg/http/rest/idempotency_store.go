@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	idempotencyBucket = "idempotency"
+
+	// Expired responses are removed from the store this often
+	idempotencyPurgeInterval = time.Hour
+)
+
+// boltIdempotency keeps responses in the embedded store, so they are replayed after a restart
+type boltIdempotency struct {
+	store *store.Store
+
+	lock   sync.Mutex
+	purged time.Time
+}
+
+func NewBoltIdempotencyStore(st *store.Store) IdempotencyStore {
+	return &boltIdempotency{store: st}
+}
+
+func (b *boltIdempotency) Reserve(ctx context.Context, key string, r IdempotentResponse) (*IdempotentResponse, error) {
+	b.purge()
+
+	var existing *IdempotentResponse
+	err := b.store.Update(idempotencyBucket, key, func(current []byte) (interface{}, error) {
+		if current != nil {
+			var kept IdempotentResponse
+			if err := json.Unmarshal(current, &kept); err != nil {
+				return nil, err
+			}
+			if !time.Now().After(kept.Expires) {
+				existing = &kept
+				return nil, nil
+			}
+		}
+		return r, nil
+	})
+	return existing, err
+}
+
+func (b *boltIdempotency) Save(ctx context.Context, key string, r IdempotentResponse) error {
+	return b.store.Put(idempotencyBucket, key, r)
+}
+
+func (b *boltIdempotency) Delete(ctx context.Context, key string) error {
+	return b.store.Delete(idempotencyBucket, key)
+}
+
+// purge removes expired responses, at most once per interval
+func (b *boltIdempotency) purge() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.purged) < idempotencyPurgeInterval {
+		return
+	}
+	b.purged = now
+
+	var expired []string
+	err := b.store.ForEach(idempotencyBucket, func(key string, value []byte) error {
+		var r IdempotentResponse
+		if err := json.Unmarshal(value, &r); err != nil || now.After(r.Expires) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot list idempotency keys | error: %v", err)
+		return
+	}
+	for _, key := range expired {
+		if err = b.store.Delete(idempotencyBucket, key); err != nil {
+			log.Errorf("cannot remove idempotency key | error: %v, key: %s", err, key)
+		}
+	}
+}
+
+// redisIdempotency shares responses between instances, which Redis expires on its own
+type redisIdempotency struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisIdempotencyStore namespaces every key with prefix, so several clusters can share a server
+func NewRedisIdempotencyStore(client *redis.Client, prefix string) IdempotencyStore {
+	return &redisIdempotency{client, prefix}
+}
+
+func (r *redisIdempotency) key(key string) string {
+	return r.prefix + "idempotency:" + key
+}
+
+func (r *redisIdempotency) Reserve(ctx context.Context, key string, response IdempotentResponse) (*IdempotentResponse, error) {
+	value, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	// The kept response may expire between both calls, then the key is reserved again
+	for attempt := 0; attempt < 2; attempt++ {
+		added, err := r.client.SetNX(ctx, r.key(key), value, time.Until(response.Expires)).Result()
+		if err != nil || added {
+			return nil, err
+		}
+		current, err := r.client.Get(ctx, r.key(key)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var existing IdempotentResponse
+		if err = json.Unmarshal(current, &existing); err != nil {
+			return nil, err
+		}
+		return &existing, nil
+	}
+	return nil, errors.New("idempotency key keeps expiring")
+}
+
+func (r *redisIdempotency) Save(ctx context.Context, key string, response IdempotentResponse) error {
+	value, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.key(key), value, time.Until(response.Expires)).Err()
+}
+
+func (r *redisIdempotency) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.key(key)).Err()
+}
@@ -0,0 +1,125 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func newIdempotentServer(handler echo.HandlerFunc) *echo.Echo {
+	return newIdempotentServerWith(NewIdempotency(NewMemoryIdempotencyStore()), handler)
+}
+
+func newIdempotentServerWith(idempotency *Idempotency, handler echo.HandlerFunc) *echo.Echo {
+	e := echo.New()
+	e.POST("/recordings/start", handler, idempotency.Middleware)
+	return e
+}
+
+func send(e *echo.Echo, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/recordings/start", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	calls := 0
+	e := newIdempotentServer(func(c echo.Context) error {
+		calls++
+		return c.JSON(http.StatusOK, map[string]int{"call": calls})
+	})
+
+	first := send(e, "key", `{"room":"room"}`)
+	second := send(e, "key", `{"room":"room"}`)
+	require.Equal(t, 1, calls)
+	require.Equal(t, http.StatusOK, second.Code)
+	require.JSONEq(t, first.Body.String(), second.Body.String())
+	require.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	// Requests without a key are not deduplicated
+	send(e, "", `{"room":"room"}`)
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotencyRejectsDifferentRequest(t *testing.T) {
+	e := newIdempotentServer(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	send(e, "key", `{"room":"room"}`)
+	rec := send(e, "key", `{"room":"other"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestIdempotencyReplaysClientErrors(t *testing.T) {
+	calls := 0
+	e := newIdempotentServer(func(c echo.Context) error {
+		calls++
+		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
+	})
+
+	send(e, "key", `{}`)
+	rec := send(e, "key", `{}`)
+	require.Equal(t, 1, calls)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestIdempotencyRetriesServerErrors(t *testing.T) {
+	calls := 0
+	e := newIdempotentServer(func(c echo.Context) error {
+		calls++
+		return echo.NewHTTPError(http.StatusInternalServerError, "unavailable")
+	})
+
+	send(e, "key", `{}`)
+	send(e, "key", `{}`)
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotencySurvivesRestart(t *testing.T) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer st.Close()
+
+	calls := 0
+	handler := func(c echo.Context) error {
+		calls++
+		return c.JSON(http.StatusOK, map[string]int{"call": calls})
+	}
+	first := send(newIdempotentServerWith(NewIdempotency(NewBoltIdempotencyStore(st)), handler), "key", `{"room":"room"}`)
+
+	// Another instance reading the same store replays the response
+	e := newIdempotentServerWith(NewIdempotency(NewBoltIdempotencyStore(st)), handler)
+	second := send(e, "key", `{"room":"room"}`)
+	require.Equal(t, 1, calls)
+	require.JSONEq(t, first.Body.String(), second.Body.String())
+	require.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+}
+
+func TestIdempotencyExpires(t *testing.T) {
+	calls := 0
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore())
+	e := newIdempotentServerWith(idempotency, func(c echo.Context) error {
+		calls++
+		return c.NoContent(http.StatusOK)
+	})
+
+	// Responses kept by an earlier day are gone
+	idempotency.now = func() time.Time { return time.Now().Add(-2 * idempotencyTTL) }
+	send(e, "key", `{}`)
+	idempotency.now = time.Now
+	send(e, "key", `{}`)
+	require.Equal(t, 2, calls)
+}
@@ -0,0 +1,63 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/queue"
+	"github.com/labstack/echo/v4"
+)
+
+type JobController struct {
+	queue queue.Queue
+}
+
+type ListJobsRequest struct {
+	Status string `query:"status"`
+}
+
+var ErrInvalidJobStatus = errors.New("status must be one of queued, claimed, done, failed")
+
+func NewJobController(q queue.Queue) JobController {
+	return JobController{q}
+}
+
+func (jc *JobController) ListJobs(c echo.Context) error {
+	// Bind query parameters
+	data := new(ListJobsRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	status := queue.Status(data.Status)
+	switch status {
+	case "", queue.StatusQueued, queue.StatusClaimed, queue.StatusDone, queue.StatusFailed:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidJobStatus)
+	}
+
+	// Call queue
+	jobs, err := jc.queue.List(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	matched := []queue.Job{}
+	for _, job := range jobs {
+		if status == "" || job.Status == status {
+			matched = append(matched, job.Redacted())
+		}
+	}
+	return c.JSON(http.StatusOK, matched)
+}
+
+func (jc *JobController) GetJob(c echo.Context) error {
+	job, err := jc.queue.Get(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, queue.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, job.Redacted())
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"errors"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/cluster"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/queue"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/rules"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/livekit/protocol/auth"
@@ -23,25 +29,156 @@ type LiveKitCredentials struct {
 }
 
 type RecordingController struct {
-	creds LiveKitCredentials
+	creds    LiveKitCredentials
+	rules    *rules.Engine
+	assigner *cluster.Assigner
+	queue    queue.Queue
 	recording.Service
+
+	// Seals the upload targets of queued requests
+	targetKey *crypt.MasterKey
 }
 
 type StartRecordingRequest struct {
+	// Optional, generated if empty. Requests with the same ID are only queued once.
+	ID          string `json:"id"`
 	Room        string `json:"room"`
 	Participant string `json:"participant"`
+	Profile     string `json:"profile"`
+	Priority    int    `json:"priority"`
+	LimitsRequest
+	RotationRequest
+
+	// Optional, where the recording is sent instead of the configured storage
+	Upload *upload.HTTPTarget `json:"upload"`
+}
+
+// RotationRequest overrides the default rotation of a recording
+type RotationRequest struct {
+	SegmentDuration string `json:"segmentDuration"`
+	SegmentSize     uint64 `json:"segmentSize"`
+}
+
+// LimitsRequest overrides the default limits of a recording
+type LimitsRequest struct {
+	MaxDuration string `json:"maxDuration"`
+	MaxSize     uint64 `json:"maxSize"`
+	OnLimit     string `json:"onLimit"`
 }
 
 type StopRecordingRequest struct {
+	// Optional, requests with the same ID are only queued once
+	ID          string `json:"id"`
 	Room        string `json:"room"`
 	Participant string `json:"participant"`
 }
 
+type StartRoomRecordingRequest struct {
+	// Optional, requests with the same ID are only queued once
+	ID       string `json:"id"`
+	Room     string `json:"room"`
+	Profile  string `json:"profile"`
+	Priority int    `json:"priority"`
+	LimitsRequest
+	RotationRequest
+}
+
+type StopRoomRecordingRequest struct {
+	// Optional, requests with the same ID are only queued once
+	ID   string `json:"id"`
+	Room string `json:"room"`
+}
+
+type ListRecordingsRequest struct {
+	Room        string `query:"room"`
+	Participant string `query:"participant"`
+	Status      string `query:"status"`
+	From        string `query:"from"`
+	To          string `query:"to"`
+}
+
 func NewRecordingController(creds LiveKitCredentials, service recording.Service) RecordingController {
-	return RecordingController{creds, service}
+	return RecordingController{creds: creds, Service: service}
+}
+
+// SetQueue queues start and stop requests for workers instead of carrying them out right away
+func (rc *RecordingController) SetQueue(q queue.Queue) {
+	rc.queue = q
 }
 
-var ErrEmptyFields = errors.New("one or more fields is empty")
+// SetTargetKey seals the upload targets of queued requests. Queued requests with one are refused without it.
+func (rc *RecordingController) SetTargetKey(key *crypt.MasterKey) {
+	rc.targetKey = key
+}
+
+// SetAssigner shares participant recordings with the other instances of a cluster, so each is recorded once
+func (rc *RecordingController) SetAssigner(assigner *cluster.Assigner) {
+	rc.assigner = assigner
+}
+
+// startRecording records the participant here, or on any instance of the cluster if there is one
+func (rc *RecordingController) startRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	if rc.assigner != nil {
+		return rc.assigner.StartRecording(ctx, req)
+	}
+	return rc.Service.StartRecording(ctx, req)
+}
+
+func (rc *RecordingController) stopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	if rc.assigner != nil {
+		return rc.assigner.StopRecording(ctx, req)
+	}
+	return rc.Service.StopRecording(ctx, req)
+}
+
+// SetRules decides which participants are recorded from webhooks. Without rules, everyone joining is recorded.
+func (rc *RecordingController) SetRules(engine *rules.Engine) {
+	rc.rules = engine
+}
+
+var (
+	ErrEmptyFields    = errors.New("one or more fields is empty")
+	ErrInvalidStatus  = errors.New("invalid status")
+	ErrInvalidTime    = errors.New("time must be in RFC3339 format")
+	ErrInvalidLimit   = errors.New("max duration must be a positive duration, e.g. 1h30m")
+	ErrInvalidSegment = errors.New("segment duration must be a positive duration, e.g. 15m")
+)
+
+// Clients should retry after this long, or on another instance
+const retryAfter = 30 * time.Second
+
+// retryLater rejects a request which can be retried
+func retryLater(c echo.Context, err error) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	return echo.NewHTTPError(http.StatusServiceUnavailable, err)
+}
+
+func (r RotationRequest) parse() (participant.Rotation, error) {
+	var rotation = participant.Rotation{Size: r.SegmentSize}
+	var err error
+	if r.SegmentDuration != "" {
+		if rotation.Duration, err = time.ParseDuration(r.SegmentDuration); err != nil || rotation.Duration <= 0 {
+			return rotation, ErrInvalidSegment
+		}
+	}
+	return rotation, nil
+}
+
+func (l LimitsRequest) parse() (recording.Limits, error) {
+	var limits = recording.Limits{MaxSize: l.MaxSize}
+	var err error
+	if l.MaxDuration != "" {
+		if limits.MaxDuration, err = time.ParseDuration(l.MaxDuration); err != nil || limits.MaxDuration <= 0 {
+			return limits, ErrInvalidLimit
+		}
+	}
+	if l.OnLimit != "" {
+		if limits.OnLimit, err = recording.ParseLimitAction(l.OnLimit); err != nil {
+			return limits, err
+		}
+	}
+	return limits, nil
+}
 
 func (rc *RecordingController) StartRecording(c echo.Context) error {
 	// Bind request data
@@ -54,17 +191,75 @@ func (rc *RecordingController) StartRecording(c echo.Context) error {
 	if data.Room == "" || data.Participant == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
 	}
+	var profile = recording.MediaAuto
+	if data.Profile != "" {
+		var err error
+		if profile, err = recording.ParseMediaProfile(data.Profile); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	}
+	limits, err := data.LimitsRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	rotation, err := data.RotationRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if data.Upload != nil {
+		if err = data.Upload.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if rotation != (participant.Rotation{}) {
+			return echo.NewHTTPError(http.StatusBadRequest, recording.ErrRotationWithUpload)
+		}
+		if limits.OnLimit == recording.LimitRollover {
+			return echo.NewHTTPError(http.StatusBadRequest, recording.ErrRolloverWithUpload)
+		}
+	}
 
-	// Call service
-	err := rc.Service.StartRecording(c.Request().Context(), recording.StartRecordingRequest{
+	req := recording.StartRecordingRequest{
+		ID:          data.ID,
 		Room:        data.Room,
 		Participant: data.Participant,
-	})
+		Profile:     profile,
+		Limits:      limits,
+		Rotation:    rotation,
+		Priority:    data.Priority,
+		Upload:      data.Upload,
+	}
+
+	// Queue the request if there is a queue
+	if rc.queue != nil {
+		job, err := queue.NewStartJob(req, rc.targetKey)
+		if errors.Is(err, upload.ErrTargetKeyMissing) {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		return rc.enqueue(c, job)
+	}
+
+	// Call service
+	err = rc.startRecording(c.Request().Context(), req)
+	if errors.Is(err, upload.ErrUploadHostNotAllowed) || errors.Is(err, upload.ErrTargetKeyMissing) {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if errors.Is(err, recording.ErrInsufficientStorage) {
+		return echo.NewHTTPError(http.StatusInsufficientStorage, err)
+	}
+	if errors.Is(err, recording.ErrAtCapacity) {
+		return retryLater(c, err)
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	// Return success
+	// Return the recording, which a participant already recorded keeps, unless another instance of the cluster took it
+	if started, found := rc.Service.ActiveRecording(req.Room, req.Participant); found {
+		return c.JSON(http.StatusOK, started)
+	}
 	return c.NoContent(http.StatusOK)
 }
 
@@ -80,11 +275,77 @@ func (rc *RecordingController) StopRecording(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
 	}
 
-	// Call service
-	err := rc.Service.StopRecording(c.Request().Context(), recording.StopRecordingRequest{
+	req := recording.StopRecordingRequest{
 		Room:        data.Room,
 		Participant: data.Participant,
-	})
+	}
+
+	// Queue the request if there is a queue
+	if rc.queue != nil {
+		return rc.enqueue(c, queue.NewStopJob(data.ID, req))
+	}
+
+	// Call service. Stopping a recording which is already gone succeeds, so retries are safe.
+	err := rc.stopRecording(c.Request().Context(), req)
+	if err != nil && !errors.Is(err, recording.ErrRoomNotRecorded) {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	// Return success
+	return c.NoContent(http.StatusOK)
+}
+
+func (rc *RecordingController) StartRoomRecording(c echo.Context) error {
+	// Bind request data
+	data := new(StartRoomRecordingRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	if data.Room == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
+	}
+	var profile = recording.MediaAuto
+	if data.Profile != "" {
+		var err error
+		if profile, err = recording.ParseMediaProfile(data.Profile); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	}
+	limits, err := data.LimitsRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	rotation, err := data.RotationRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	req := recording.StartRoomRecordingRequest{
+		Room:     data.Room,
+		Profile:  profile,
+		Limits:   limits,
+		Rotation: rotation,
+		Priority: data.Priority,
+	}
+
+	// Queue the request if there is a queue
+	if rc.queue != nil {
+		return rc.enqueue(c, queue.NewStartRoomJob(data.ID, req))
+	}
+
+	// Call service
+	err = rc.Service.StartRoomRecording(c.Request().Context(), req)
+	if errors.Is(err, recording.ErrRoomAlreadyRecorded) {
+		return echo.NewHTTPError(http.StatusConflict, err)
+	}
+	if errors.Is(err, recording.ErrInsufficientStorage) {
+		return echo.NewHTTPError(http.StatusInsufficientStorage, err)
+	}
+	if errors.Is(err, recording.ErrAtCapacity) {
+		return retryLater(c, err)
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
@@ -93,6 +354,75 @@ func (rc *RecordingController) StopRecording(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+func (rc *RecordingController) StopRoomRecording(c echo.Context) error {
+	// Bind request data
+	data := new(StopRoomRecordingRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	if data.Room == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
+	}
+
+	req := recording.StopRoomRecordingRequest{
+		Room: data.Room,
+	}
+
+	// Queue the request if there is a queue
+	if rc.queue != nil {
+		return rc.enqueue(c, queue.NewStopRoomJob(data.ID, req))
+	}
+
+	// Call service
+	summary, err := rc.Service.StopRoomRecording(c.Request().Context(), req)
+	if errors.Is(err, recording.ErrRoomNotRecorded) {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	// Return the room recording summary
+	return c.JSON(http.StatusOK, summary)
+}
+
+func (rc *RecordingController) ListRecordings(c echo.Context) error {
+	// Bind query parameters
+	data := new(ListRecordingsRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	filter := recording.RecordingFilter{
+		Room:        data.Room,
+		Participant: data.Participant,
+	}
+	if data.Status != "" {
+		status, ok := participant.ParseStatus(data.Status)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidStatus)
+		}
+		filter.Status = status
+	}
+	var err error
+	if data.From != "" {
+		if filter.From, err = time.Parse(time.RFC3339, data.From); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidTime)
+		}
+	}
+	if data.To != "" {
+		if filter.To, err = time.Parse(time.RFC3339, data.To); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidTime)
+		}
+	}
+
+	// Call service
+	return c.JSON(http.StatusOK, rc.Service.ListRecordings(filter))
+}
+
 func (rc *RecordingController) ReceiveWebhooks(c echo.Context) error {
 	authProvider := auth.NewFileBasedKeyProviderFromMap(map[string]string{
 		rc.creds.APIKey: rc.creds.APISecret,
@@ -112,72 +442,29 @@ func (rc *RecordingController) ReceiveWebhooks(c echo.Context) error {
 
 	// Handle events
 	if event.GetEvent() == "participant_joined" && event.Room != nil && event.Participant != nil {
-		if strings.HasPrefix(event.Participant.Identity, "RB_") {
+		if recording.IsBot(event.Participant.Identity) {
 			log.Debugf("bot has joined room | identity: %s", event.Participant.Identity)
 			return c.NoContent(http.StatusOK)
 		}
 		log.Debugf("participant has joined room | identity: %s", event.Participant.Identity)
 
-		// Use goroutine to poll and check that the participant is in ready state
-		go func(room string, participant string) {
-			var state = event.Participant.State
-			var err error
-			ctx := context.TODO()
-			ticker := time.NewTicker(time.Second * 2)
-			deadline := time.After(time.Second * 10)
-
-			log.Debugf("participant state: %s | identity: %s", state.String(), participant)
-
-			defer func() {
-				// Stop ticker
-				ticker.Stop()
-
-				// Handle error
-				if err != nil {
-					log.Errorf("cannot start recording | error: %v, room: %s, participant: %s", err, room, participant)
-					return
-				}
-
-				// Start recording
-				log.Debugf("received start recording request | room: %s, participant: %s", room, participant)
-				err = rc.Service.StartRecording(ctx, recording.StartRecordingRequest{
-					Room:        room,
-					Participant: participant,
-				})
-				if err != nil {
-					log.Errorf("webhook cannot start recording | error: %v, participant: %s", err, participant)
-				}
-			}()
-
-			// Check state periodically: only start recording if participant state is ACTIVE
-			var p *livekit.ParticipantInfo
-			for {
-				select {
-				case <-ticker.C:
-					p, err = rc.LKRoomService().GetParticipant(ctx, &livekit.RoomParticipantIdentity{
-						Room:     room,
-						Identity: participant,
-					})
-					if err != nil {
-						return
-					}
-					state = p.State
-					log.Debugf("participant state: %s | identity: %s", state.String(), participant)
-
-					// Stop polling only if the participant's state is ACTIVE, meaning they are already publishing video
-					if state == livekit.ParticipantInfo_ACTIVE {
-						return
-					}
-				case <-deadline:
-					err = errors.New("too long")
-					return
-				}
+		// The bot subscribes to the participant's tracks as they get published
+		if err = rc.autoRecord(c.Request().Context(), &event, nil); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+
+	if event.GetEvent() == "track_published" && event.Room != nil && event.Participant != nil && event.Track != nil {
+		// Without rules, tracks are already handled when the participant joins
+		if rc.rules != nil && !recording.IsBot(event.Participant.Identity) {
+			if err = rc.autoRecord(c.Request().Context(), &event, &event.Track.Source); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err)
 			}
-		}(event.Room.Name, event.Participant.Identity)
+		}
 	}
 
 	if event.GetEvent() == "participant_left" && event.Room != nil && event.Participant != nil {
-		if strings.HasPrefix(event.Participant.Identity, "RB_") {
+		if recording.IsBot(event.Participant.Identity) {
 			log.Debugf("bot has left room | identity: %s", event.Participant.Identity)
 			return c.NoContent(http.StatusOK)
 		}
@@ -185,8 +472,79 @@ func (rc *RecordingController) ReceiveWebhooks(c echo.Context) error {
 	}
 
 	if event.GetEvent() == "room_finished" && event.Room != nil {
+		if rc.assigner != nil {
+			if err = rc.assigner.StopRoom(c.Request().Context(), event.Room.Name); err != nil {
+				log.Errorf("cannot forget room recordings | error: %v, room: %s", err, event.Room.Name)
+			}
+		}
 		rc.Service.DisconnectFrom(event.Room.Name)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+// autoRecord starts recording the participant of the event if the rules allow it
+func (rc *RecordingController) autoRecord(ctx context.Context, event *livekit.WebhookEvent, source *livekit.TrackSource) error {
+	req := recording.StartRecordingRequest{
+		Room:        event.Room.Name,
+		Participant: event.Participant.Identity,
+	}
+
+	if rc.rules != nil {
+		decision := rc.rules.Evaluate(rules.Subject{
+			Room:     event.Room.Name,
+			Identity: event.Participant.Identity,
+			Metadata: event.Participant.Metadata,
+			Source:   source,
+			Time:     time.Now(),
+		})
+		if !decision.Record {
+			log.Debugf("rules decided not to record | room: %s, participant: %s, rule: %s", req.Room, req.Participant, decision.Rule)
+			return nil
+		}
+		req.Profile = decision.Profile
+		req.Sources = decision.Sources
+		log.Debugf("rules decided to record | room: %s, participant: %s, rule: %s", req.Room, req.Participant, decision.Rule)
+	}
+
+	log.Debugf("received start recording request | room: %s, participant: %s", req.Room, req.Participant)
+	var err error
+	if rc.queue != nil {
+		// LiveKit retries a delivery with the same event ID, which then queues a single job
+		if event.Id != "" {
+			req.ID = "RC_" + event.Id
+		}
+		var job queue.Job
+		if job, err = queue.NewStartJob(req, rc.targetKey); err == nil {
+			_, _, err = rc.queue.Enqueue(ctx, job)
+		}
+	} else {
+		err = rc.startRecording(ctx, req)
+	}
+	// A full instance would refuse the retried webhook again, so the refusal is acknowledged
+	if errors.Is(err, recording.ErrAtCapacity) || errors.Is(err, recording.ErrInsufficientStorage) {
+		log.Warnf("webhook refused recording | error: %v, room: %s, participant: %s", err, req.Room, req.Participant)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("webhook cannot start recording | error: %v, participant: %s", err, req.Participant)
+	}
+	return err
+}
+
+// enqueue accepts a job, or returns the one already queued with the same ID
+func (rc *RecordingController) enqueue(c echo.Context, job queue.Job) error {
+	job, added, err := rc.queue.Enqueue(c.Request().Context(), job)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if !added {
+		log.Debugf("job already queued | id: %s, status: %s", job.ID, job.Status)
+	}
+	return c.JSON(http.StatusAccepted, job.Redacted())
+}
+
+// GetLoad reports how loaded the instance is, for least-loaded routing
+func (rc *RecordingController) GetLoad(c echo.Context) error {
+	return c.JSON(http.StatusOK, rc.Service.Load())
+}
@@ -0,0 +1,40 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/require"
+)
+
+// refusingService refuses every recording with err
+type refusingService struct {
+	recording.Service
+	err error
+}
+
+func (s *refusingService) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	return s.err
+}
+
+func TestWebhookAcknowledgesRefusals(t *testing.T) {
+	service := &refusingService{}
+	rc := NewRecordingController(LiveKitCredentials{}, service)
+	event := &livekit.WebhookEvent{
+		Event:       "participant_joined",
+		Room:        &livekit.Room{Name: "room"},
+		Participant: &livekit.ParticipantInfo{Identity: "alice"},
+	}
+
+	// LiveKit would only retry it on the same instance
+	for _, err := range []error{recording.ErrAtCapacity, recording.ErrInsufficientStorage} {
+		service.err = err
+		require.NoError(t, rc.autoRecord(context.Background(), event, nil))
+	}
+
+	service.err = errors.New("unavailable")
+	require.Error(t, rc.autoRecord(context.Background(), event, nil))
+}
@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/schedule"
+	"github.com/labstack/echo/v4"
+)
+
+type ScheduleController struct {
+	scheduler *schedule.Scheduler
+}
+
+type CreateScheduleRequest struct {
+	Room        string `json:"room"`
+	Participant string `json:"participant"`
+	Profile     string `json:"profile"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Priority    int    `json:"priority"`
+	LimitsRequest
+	RotationRequest
+}
+
+func NewScheduleController(scheduler *schedule.Scheduler) ScheduleController {
+	return ScheduleController{scheduler}
+}
+
+func (sc *ScheduleController) CreateSchedule(c echo.Context) error {
+	// Bind request data
+	data := new(CreateScheduleRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	if data.Room == "" || data.Start == "" || data.End == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, ErrEmptyFields)
+	}
+	var profile = recording.MediaAuto
+	var err error
+	if data.Profile != "" {
+		if profile, err = recording.ParseMediaProfile(data.Profile); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	}
+	limits, err := data.LimitsRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	rotation, err := data.RotationRequest.parse()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	var start, end time.Time
+	if start, err = time.Parse(time.RFC3339, data.Start); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidTime)
+	}
+	if end, err = time.Parse(time.RFC3339, data.End); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidTime)
+	}
+
+	// Call scheduler
+	sch, err := sc.scheduler.Add(schedule.Schedule{
+		Room:        data.Room,
+		Participant: data.Participant,
+		Profile:     profile,
+		Limits:      limits,
+		Rotation:    rotation,
+		Priority:    data.Priority,
+		Start:       start,
+		End:         end,
+	})
+	if errors.Is(err, schedule.ErrInvalidWindow) {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	// Return the created schedule
+	return c.JSON(http.StatusCreated, sch)
+}
+
+func (sc *ScheduleController) ListSchedules(c echo.Context) error {
+	return c.JSON(http.StatusOK, sc.scheduler.List())
+}
+
+func (sc *ScheduleController) CancelSchedule(c echo.Context) error {
+	sch, err := sc.scheduler.Cancel(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, schedule.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	if errors.Is(err, schedule.ErrAlreadyEnded) {
+		return echo.NewHTTPError(http.StatusConflict, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	// Return the cancelled schedule
+	return c.JSON(http.StatusOK, sch)
+}
@@ -0,0 +1,67 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/labstack/echo/v4"
+)
+
+type UploadController struct {
+	queue *upload.Queue
+}
+
+type ListUploadsRequest struct {
+	Status string `query:"status"`
+}
+
+var ErrInvalidUploadStatus = errors.New("status must be one of pending, uploading, done, dead")
+
+func NewUploadController(q *upload.Queue) UploadController {
+	return UploadController{q}
+}
+
+func (uc *UploadController) ListUploads(c echo.Context) error {
+	// Bind query parameters
+	data := new(ListUploadsRequest)
+	if err := c.Bind(data); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	// Sanitise request
+	status := upload.UploadStatus(data.Status)
+	switch status {
+	case "", upload.UploadPending, upload.UploadUploading, upload.UploadDone, upload.UploadDead:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, ErrInvalidUploadStatus)
+	}
+
+	return c.JSON(http.StatusOK, uc.queue.List(status))
+}
+
+func (uc *UploadController) GetUpload(c echo.Context) error {
+	u, err := uc.queue.Get(c.Param("id"))
+	if errors.Is(err, upload.ErrUploadNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, u)
+}
+
+// RetryUpload attempts a dead or pending upload again right away
+func (uc *UploadController) RetryUpload(c echo.Context) error {
+	u, err := uc.queue.Retry(c.Param("id"))
+	if errors.Is(err, upload.ErrUploadNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	if errors.Is(err, upload.ErrUploadNotRetryable) {
+		return echo.NewHTTPError(http.StatusConflict, err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, u)
+}
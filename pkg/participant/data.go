@@ -1,10 +1,96 @@
 package participant
 
-import "time"
+import (
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRecording Status = "recording"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+)
+
+var statuses = map[string]Status{
+	string(StatusPending):   StatusPending,
+	string(StatusRecording): StatusRecording,
+	string(StatusDone):      StatusDone,
+	string(StatusFailed):    StatusFailed,
+}
+
+// ParseStatus returns the status matching s, or false if there is none
+func ParseStatus(s string) (Status, bool) {
+	status, ok := statuses[s]
+	return status, ok
+}
+
+// EndReason explains why a recording ended
+type EndReason string
+
+const (
+	EndReasonStopped          EndReason = "stopped"
+	EndReasonParticipantLeft  EndReason = "participant_left"
+	EndReasonTrackAdded       EndReason = "track_added"
+	EndReasonTrackUnpublished EndReason = "track_unpublished"
+	EndReasonDisconnected     EndReason = "disconnected"
+	EndReasonMaxDuration      EndReason = "max_duration"
+	EndReasonMaxSize          EndReason = "max_size"
+	EndReasonDiskFull         EndReason = "disk_full"
+)
+
+type Stats struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Gap is a period in which the recording was interrupted, e.g. while reconnecting
+type Gap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Segment is one of the files of a rotated recording
+type Segment struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Output string    `json:"output"`
+	Tracks []string  `json:"tracks,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
 
 type ParticipantData struct {
-	Identity string    `json:"identity"`
-	Start    time.Time `json:"start"`
-	End      time.Time `json:"end"`
-	Output   string    `json:"output"`
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	Identity  string    `json:"identity"`
+	Status    Status    `json:"status"`
+	Priority  int       `json:"priority,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EndReason EndReason `json:"endReason,omitempty"`
+	Output    string    `json:"output"`
+	// Raw track objects, when tracks are streamed or the disk filled up instead of being containerised
+	Tracks   []string  `json:"tracks,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Stats    Stats     `json:"stats"`
+	Gaps     []Gap     `json:"gaps,omitempty"`
+	Segments []Segment `json:"segments,omitempty"`
+	// Uploads of the files of the recording, when they go through the upload queue
+	Uploads []FileUpload `json:"uploads,omitempty"`
+	// The files of the recording are encrypted, see cmd/decrypt
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// FileUpload follows the upload of a file of the recording
+type FileUpload struct {
+	ID     string              `json:"id"`
+	Output string              `json:"output"`
+	Status upload.UploadStatus `json:"status"`
+	Error  string              `json:"error,omitempty"`
+
+	// Of the file that was uploaded
+	Checksums *upload.Checksums `json:"checksums,omitempty"`
 }
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recorder"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
 	"github.com/labstack/gommon/log"
@@ -26,7 +30,15 @@ type Participant interface {
 	RegisterAudio(track *webrtc.TrackRemote) error
 
 	Start()
-	Stop()
+	Stop(reason EndReason)
+	Discard()
+
+	// RotateIfDue starts a new segment if the current one is over the rotation duration or size
+	RotateIfDue(now time.Time)
+
+	// Interrupt marks the start of a gap, until the tracks are resumed
+	Interrupt()
+	Resume(track *webrtc.TrackRemote) error
 }
 
 type participant struct {
@@ -34,7 +46,18 @@ type participant struct {
 	data     ParticipantData
 	state    state
 	uploader upload.Uploader
+	uploads  *upload.Queue
+	streamer *upload.Streamer
 	pli      lksdk.PLIWriter
+	rotation Rotation
+	key      *crypt.DataKey
+
+	// Guards the filenames, segments and uploads, which change from the recorders' goroutines when rotating
+	lock         sync.Mutex
+	rotating     bool
+	segmentStart time.Time
+	segmentBytes uint64
+	processing   sync.WaitGroup
 
 	// Filenames
 	vf string
@@ -49,38 +72,168 @@ type participant struct {
 	ar recorder.Recorder
 }
 
-func NewParticipant(identity string, uploader upload.Uploader, pli lksdk.PLIWriter) Participant {
+// Options configure how a participant is recorded and where the output goes
+type Options struct {
+	// Optional, cancelling it stops recording and uploading, e.g. on shutdown
+	Context context.Context
+
+	Uploader upload.Uploader
+
+	// Optional, uploads through the queue so they are retried, instead of once in the background
+	Uploads *upload.Queue
+
+	// Optional, streams the raw tracks to the bucket while recording instead of uploading the output at the end
+	Streamer *upload.Streamer
+
+	Rotation Rotation
+
+	// Optional, encrypts the raw tracks and the output, so they are never written in clear
+	Encryption *crypt.DataKey
+
+	// Lower priority recordings are stopped first when the disk runs out
+	Priority int
+}
+
+func NewParticipant(id string, room string, identity string, pli lksdk.PLIWriter, opts Options) Participant {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	return &participant{
-		ctx: context.TODO(),
+		ctx: ctx,
 		data: ParticipantData{
-			Identity: identity,
+			ID:        id,
+			Room:      room,
+			Identity:  identity,
+			Status:    stateCreated.status(),
+			Priority:  opts.Priority,
+			Encrypted: opts.Encryption != nil,
 		},
 		state:    stateCreated,
-		uploader: uploader,
+		uploader: opts.Uploader,
+		uploads:  opts.Uploads,
+		streamer: opts.Streamer,
 		pli:      pli,
+		rotation: opts.Rotation,
+		key:      opts.Encryption,
 	}
 }
 
-func (p *participant) createRecorder(track *webrtc.TrackRemote) (recorder.Recorder, error) {
+func rawFilename(track *webrtc.TrackRemote) (string, error) {
 	fileID := shortuuid.New()
 	if fileID == "" {
-		return nil, errors.New("empty file ID")
+		return "", errors.New("empty file ID")
 	}
 
 	fileExt := recorder.GetMediaExtension(track.Codec().MimeType)
 	if fileExt == "" {
-		return nil, errors.New("unsupported media")
+		return "", errors.New("unsupported media")
+	}
+
+	return fmt.Sprintf("%s/%s.%s", RecordingsDir, fileID, fileExt), nil
+}
+
+// newSink creates the sink of a raw track, streamed to the bucket if there is a streamer
+func (p *participant) newSink(track *webrtc.TrackRemote) (recorder.Sink, error) {
+	fileName, err := rawFilename(track)
+	if err != nil {
+		return nil, err
+	}
+	if p.key != nil {
+		fileName += crypt.Extension
 	}
 
-	fileName := fmt.Sprintf("%s/%s.%s", RecordingsDir, fileID, fileExt)
+	var sink recorder.Sink
+	if p.streamer != nil {
+		key := strings.TrimPrefix(fileName, RecordingsDir+"/")
+		sink, err = p.streamer.NewSink(p.ctx, upload.Object{
+			Key:         key,
+			ContentType: upload.ContentType(key),
+			Size:        -1,
+			Metadata:    p.metadata(),
+		})
+	} else {
+		sink, err = recorder.NewFileSink(fileName)
+	}
+	if err != nil || p.key == nil {
+		return sink, err
+	}
+
+	encrypted, err := recorder.NewEncryptedSink(sink, p.key)
+	if err != nil {
+		p.removeSink(sink)
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// metadata is stored with every uploaded object of the recording
+func (p *participant) metadata() map[string]string {
+	return map[string]string{
+		upload.MetadataRoom:        p.data.Room,
+		upload.MetadataIdentity:    p.data.Identity,
+		upload.MetadataRecordingID: p.data.ID,
+	}
+}
+
+// removeSink throws away a sink which isn't needed anymore
+func (p *participant) removeSink(sink recorder.Sink) {
+	// Whatever was written is thrown away, there is no need to finish encrypting it
+	if e, ok := sink.(*recorder.EncryptedSink); ok {
+		sink = e.Unwrap()
+	}
+	if s, ok := sink.(*upload.StreamSink); ok {
+		if err := s.Abort(); err != nil {
+			log.Errorf("cannot abort stream | error: %v, key: %s", err, s.Name())
+		}
+		return
+	}
+	if err := sink.Close(); err != nil {
+		log.Errorf("cannot close sink | error: %v, participant: %s", err, p.data.Identity)
+	}
+	if err := os.Remove(sink.Name()); err != nil {
+		log.Errorf("cannot remove raw file | error: %v, file: %s", err, sink.Name())
+	}
+}
+
+func (p *participant) createRecorder(track *webrtc.TrackRemote) (recorder.Recorder, error) {
+	sink, err := p.newSink(track)
+	if err != nil {
+		return nil, err
+	}
 
-	return recorder.New(track.Codec(), fileName, samplebuilder.WithPacketDroppedHandler(func() {
+	r, err := recorder.NewWith(track.Codec(), sink, samplebuilder.WithPacketDroppedHandler(func() {
 		p.pli(track.SSRC())
 	}))
+	if err != nil {
+		p.removeSink(sink)
+	}
+	return r, err
 }
 
 func (p *participant) GetData() ParticipantData {
-	return p.data
+	p.lock.Lock()
+	data := p.data
+	data.Segments = append([]Segment(nil), p.data.Segments...)
+	data.Uploads = append([]FileUpload(nil), p.data.Uploads...)
+	p.lock.Unlock()
+
+	data.Gaps = append([]Gap(nil), p.data.Gaps...)
+	data.Status = p.state.status()
+	if data.Error != "" {
+		data.Status = StatusFailed
+	}
+
+	// Stats are collected from both recorders
+	for _, r := range []recorder.Recorder{p.vr, p.ar} {
+		if r == nil {
+			continue
+		}
+		stats := r.Stats()
+		data.Stats.Packets += stats.Packets
+		data.Stats.Bytes += stats.Bytes
+	}
+	return data
 }
 
 func (p *participant) IsVideoRecordable() bool {
@@ -125,9 +278,13 @@ func (p *participant) Start() {
 	}
 	p.state = stateRecording
 	p.data.Start = time.Now()
+
+	p.lock.Lock()
+	p.segmentStart = p.data.Start
+	p.lock.Unlock()
 }
 
-func (p *participant) Stop() {
+func (p *participant) Stop(reason EndReason) {
 	if p.state == stateDone {
 		return
 	}
@@ -137,14 +294,89 @@ func (p *participant) Stop() {
 	if p.ar != nil {
 		p.ar.Stop()
 	}
+
+	// Segments still processing are listed before the last one
+	p.processing.Wait()
+
 	p.state = stateDone
 	p.data.End = time.Now()
+	p.data.EndReason = reason
+
+	// Close a gap the recording never recovered from
+	if gaps := len(p.data.Gaps); gaps > 0 && p.data.Gaps[gaps-1].End.IsZero() {
+		p.data.Gaps[gaps-1].End = p.data.End
+	}
 
 	// Do post processing
 	// While it is synchronous, the containerisation should be almost instantenous.
 	// Meanwhile, uploading is done in the background via goroutine
 	err := p.process()
 	if err != nil {
+		p.data.Error = err.Error()
 		log.Errorf("error in post processing | error: %v, participant: %s", err, p.data.Identity)
 	}
+
+	// The last segment of a rotated recording is whatever was recorded since the previous one
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.data.Segments) > 0 {
+		p.data.Segments = append(p.data.Segments, Segment{
+			Start:  p.segmentStart,
+			End:    p.data.End,
+			Output: p.data.Output,
+			Tracks: p.data.Tracks,
+			Error:  p.data.Error,
+		})
+	}
+}
+
+func (p *participant) Interrupt() {
+	if p.state != stateRecording {
+		return
+	}
+	gaps := len(p.data.Gaps)
+	if gaps > 0 && p.data.Gaps[gaps-1].End.IsZero() {
+		return
+	}
+	p.data.Gaps = append(p.data.Gaps, Gap{Start: time.Now()})
+}
+
+var ErrNotRecording = errors.New("participant is not recording")
+
+// Resume continues recording from a track replacing the one of the same kind
+func (p *participant) Resume(track *webrtc.TrackRemote) error {
+	if p.state != stateRecording {
+		return ErrNotRecording
+	}
+
+	switch {
+	case track.Kind() == webrtc.RTPCodecTypeVideo && p.vr != nil:
+		p.vt = track
+		p.vr.Resume(track)
+	case track.Kind() == webrtc.RTPCodecTypeAudio && p.ar != nil:
+		p.at = track
+		p.ar.Resume(track)
+	default:
+		return errors.New("no recorder for track")
+	}
+
+	// The gap ends as soon as the first track is back
+	gaps := len(p.data.Gaps)
+	if gaps > 0 && p.data.Gaps[gaps-1].End.IsZero() {
+		p.data.Gaps[gaps-1].End = time.Now()
+	}
+	return nil
+}
+
+// Discard removes the raw files of a participant which never started recording
+func (p *participant) Discard() {
+	if p.state != stateCreated {
+		return
+	}
+	for _, r := range []recorder.Recorder{p.vr, p.ar} {
+		if r != nil {
+			p.removeSink(r.Sink())
+		}
+	}
+	p.state = stateDone
 }
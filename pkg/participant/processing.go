@@ -1,74 +1,135 @@
 package participant
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recorder"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
 	"github.com/labstack/gommon/log"
 	"github.com/lithammer/shortuuid/v4"
 )
 
 func (p *participant) process() error {
+	// Containerising needs as much space again, which a full disk doesn't have
+	if p.data.EndReason == EndReasonDiskFull && p.streamer == nil {
+		p.data.Output, p.data.Tracks = p.keepRaw(p.vf, p.af)
+		return nil
+	}
+
+	output, tracks, err := p.processFiles(p.vf, p.af)
+	p.data.Output = output
+	p.data.Tracks = tracks
+	return err
+}
+
+// processFiles turns the raw files of a recording or segment into the output, and returns where it ends up.
+// Streamed tracks are already on their way to the bucket, so they are returned as they are.
+func (p *participant) processFiles(vf string, af string) (string, []string, error) {
+	if p.streamer != nil {
+		var tracks []string
+		for _, key := range []string{vf, af} {
+			if key != "" {
+				tracks = append(tracks, fmt.Sprintf("%s/%s", p.streamer.GetDirectory(), key))
+			}
+		}
+		return tracks[0], tracks, nil
+	}
+
 	// If there is no video, don't containerise
-	if p.vr == nil {
-		p.data.Output = p.af
+	if vf == "" {
+		output := af
 
 		// Check if we want to upload the audio file
 		if p.uploader != nil {
-			p.data.Output = strings.ReplaceAll(p.af, RecordingsDir+"/", "")
-			p.data.Output = fmt.Sprintf("%s/%s", p.uploader.GetDirectory(), p.data.Output)
-			go func() {
-				err := p.upload(p.af)
-				if err != nil {
-					log.Errorf("cannot upload audio | error: %v, output: %s, participant: %s", err, p.data.Output, p.data.Identity)
-				}
-				log.Infof("uploaded audio | output: %s, participant: %s", p.data.Output, p.data.Identity)
-			}()
+			output = upload.Location(p.uploader, p.object(af))
+			p.uploadLater(af, output, "audio")
 		}
-		return nil
+		return output, nil, nil
 	}
 
 	// Containerise file
-	filename, err := p.containerise()
+	filename, err := p.containerise(vf, af)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	p.data.Output = filename
-	log.Debugf("containerised file | output: %s, participant: %s, video: %s, audio: %s", p.data.Output, p.data.Identity, p.vf, p.af)
+	output := filename
+	log.Debugf("containerised file | output: %s, participant: %s, video: %s, audio: %s", output, p.data.Identity, vf, af)
 
 	// If there are no errors during containerisation, delete the raw media files
-	if p.vf != "" {
-		if err = os.Remove(p.vf); err != nil {
-			return err
-		}
-		log.Debugf("removed raw video | file: %s", p.vf)
+	if err = os.Remove(vf); err != nil {
+		return output, nil, err
 	}
-	if p.af != "" {
-		if err = os.Remove(p.af); err != nil {
-			return err
+	log.Debugf("removed raw video | file: %s", vf)
+	if af != "" {
+		if err = os.Remove(af); err != nil {
+			return output, nil, err
 		}
-		log.Debugf("removed raw audio | file: %s", p.af)
+		log.Debugf("removed raw audio | file: %s", af)
 	}
 
 	// Check if we want to upload the container file
 	if p.uploader != nil {
-		p.data.Output = strings.ReplaceAll(filename, RecordingsDir+"/", "")
-		p.data.Output = fmt.Sprintf("%s/%s", p.uploader.GetDirectory(), p.data.Output)
-		go func() {
-			err := p.upload(filename)
-			if err != nil {
-				log.Errorf("cannot upload container | error: %v, output: %s, participant: %s", err, p.data.Output, p.data.Identity)
-			}
-			log.Infof("uploaded container | output: %s, participant: %s", p.data.Output, p.data.Identity)
-		}()
+		output = upload.Location(p.uploader, p.object(filename))
+		p.uploadLater(filename, output, "container")
+	}
+	return output, nil, nil
+}
+
+// keepRaw leaves the raw files of a recording as they are, and uploads them if there is an uploader
+func (p *participant) keepRaw(vf string, af string) (string, []string) {
+	var tracks []string
+	for _, filename := range []string{vf, af} {
+		if filename == "" {
+			continue
+		}
+		output := filename
+		if p.uploader != nil {
+			output = upload.Location(p.uploader, p.object(filename))
+			p.uploadLater(filename, output, "raw track")
+		}
+		tracks = append(tracks, output)
+	}
+	if len(tracks) == 0 {
+		return "", nil
 	}
-	return nil
+	return tracks[0], tracks
 }
 
-func (p *participant) containerise() (string, error) {
+// uploadLater uploads a file in the background, through the queue if there is one
+func (p *participant) uploadLater(filename string, output string, kind string) {
+	if p.uploads != nil {
+		u, err := p.uploads.Enqueue(filename, p.object(filename), p.uploader)
+		if err != nil {
+			log.Errorf("cannot queue upload | error: %v, output: %s, participant: %s", err, output, p.data.Identity)
+			return
+		}
+		log.Debugf("queued %s upload | id: %s, output: %s, participant: %s", kind, u.ID, output, p.data.Identity)
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.data.Uploads = append(p.data.Uploads, FileUpload{ID: u.ID, Output: output, Status: u.Status})
+		return
+	}
+
+	go func() {
+		err := p.upload(filename)
+		if err != nil {
+			log.Errorf("cannot upload %s | error: %v, output: %s, participant: %s", kind, err, output, p.data.Identity)
+			return
+		}
+		log.Infof("uploaded %s | output: %s, participant: %s", kind, output, p.data.Identity)
+	}()
+}
+
+func (p *participant) containerise(vf string, af string) (string, error) {
 	// We have 4 cases:
 	// 1. Video = IVF, Audio = nil. Containerise as webm
 	// 2. Video = H264, Audio = nil. Containerise as mp4
@@ -78,81 +139,192 @@ func (p *participant) containerise() (string, error) {
 	var (
 		videoExt recorder.MediaExtension = ""
 		audioExt recorder.MediaExtension = ""
-		cmd      *exec.Cmd
-		filename string
+		format   string
 	)
 
 	if p.vt != nil {
 		videoExt = recorder.GetMediaExtension(p.vt.Codec().MimeType)
 	}
-	if p.at != nil {
+	if p.at != nil && af != "" {
 		audioExt = recorder.GetMediaExtension(p.at.Codec().MimeType)
 	}
 
+	switch videoExt {
+	case recorder.MediaIVF:
+		format = "webm"
+	case recorder.MediaH264:
+		format = "mp4"
+	default:
+		return "", recorder.ErrMediaNotSupported
+	}
+	inputs := []rawInput{{vf, videoExt}}
+	if audioExt == recorder.MediaOGG {
+		inputs = append(inputs, rawInput{af, audioExt})
+	}
+
 	// Generate file ID
 	fileID := fmt.Sprintf("%s/%s", RecordingsDir, shortuuid.New())
+	filename := fmt.Sprintf("%s.%s", fileID, format)
+	if p.key != nil {
+		filename += crypt.Extension
+	}
 
-	// Case 1
-	if videoExt == recorder.MediaIVF && audioExt == "" {
-		filename = fmt.Sprintf("%s.%s", fileID, "webm")
-		cmd = exec.Command("ffmpeg",
-			"-i", p.vf,
-			"-c:v", "copy",
-			"-loglevel", "error",
-			"-y", filename)
-	}
-
-	// Case 2
-	if videoExt == recorder.MediaH264 && audioExt == "" {
-		filename = fmt.Sprintf("%s.%s", fileID, "mp4")
-		cmd = exec.Command("ffmpeg",
-			"-i", p.vf,
-			"-c:v", "copy",
-			"-loglevel", "error",
-			"-y", filename)
-	}
-
-	// Case 3
-	if videoExt == recorder.MediaIVF && audioExt == recorder.MediaOGG {
-		filename = fmt.Sprintf("%s.%s", fileID, "webm")
-		cmd = exec.Command("ffmpeg",
-			"-i", p.vf,
-			"-i", p.af,
-			"-c:v", "copy",
-			"-c:a", "copy",
-			"-loglevel", "error",
-			"-y", "-shortest", filename)
-	}
-
-	// Case 4
-	if videoExt == recorder.MediaH264 && audioExt == recorder.MediaOGG {
-		filename = fmt.Sprintf("%s.%s", fileID, "mp4")
-		cmd = exec.Command("ffmpeg",
-			"-i", p.vf,
-			"-i", p.af,
-			"-c:v", "copy",
-			"-c:a", "copy",
-			"-loglevel", "error",
-			"-y", "-shortest", filename)
+	var args []string
+	for i, input := range inputs {
+		if p.key != nil {
+			// Decrypted into pipes, which are the file descriptors after stderr
+			args = append(args, "-f", string(input.ext), "-i", fmt.Sprintf("pipe:%d", 3+i))
+		} else {
+			args = append(args, "-i", input.file)
+		}
+	}
+	args = append(args, "-c:v", "copy")
+	if len(inputs) > 1 {
+		args = append(args, "-c:a", "copy")
+	}
+	args = append(args, "-loglevel", "error", "-y")
+	if len(inputs) > 1 {
+		args = append(args, "-shortest")
+	}
+
+	if p.key != nil {
+		return filename, p.containeriseEncrypted(args, inputs, format, filename)
 	}
 
 	// Execute command
+	cmd := exec.Command("ffmpeg", append(args, filename)...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	err := cmd.Run()
 	return filename, err
 }
 
+type rawInput struct {
+	file string
+	ext  recorder.MediaExtension
+}
+
+// containeriseEncrypted feeds ffmpeg the decrypted raw files through pipes, and encrypts what it outputs,
+// so the recording is never on disk in clear. Without seeking, mp4 has to be fragmented. A partial output is removed.
+func (p *participant) containeriseEncrypted(args []string, inputs []rawInput, format string, filename string) (err error) {
+	args = append(args, "-f", format)
+	if format == "mp4" {
+		args = append(args, "-movflags", "frag_keyframe+empty_moov")
+	}
+	args = append(args, "pipe:1")
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+	w, err := crypt.NewWriter(out, p.key)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = w
+	var feeds []*os.File
+	defer func() {
+		for _, f := range append(cmd.ExtraFiles, feeds...) {
+			f.Close()
+		}
+	}()
+	for range inputs {
+		r, fw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		feeds = append(feeds, fw)
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// Only ffmpeg reads the pipes, so feeding them fails instead of blocking once it exits
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	cmd.ExtraFiles = nil
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(inputs))
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input rawInput, feed *os.File) {
+			defer wg.Done()
+			errs[i] = decryptTo(feed, input.file, p.key)
+			feed.Close()
+		}(i, input, feeds[i])
+	}
+	err = cmd.Wait()
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	for _, err = range errs {
+		// ffmpeg stops reading the longer input when the shorter one ends
+		if err != nil && !errors.Is(err, syscall.EPIPE) {
+			return err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func decryptTo(w io.Writer, filename string, key *crypt.DataKey) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := crypt.NewReader(file, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// object describes a local file of the recording to upload, of unknown size
+func (p *participant) object(filename string) upload.Object {
+	key := strings.ReplaceAll(filename, RecordingsDir+"/", "")
+	return upload.Object{
+		Key:         key,
+		ContentType: upload.ContentType(key),
+		Size:        -1,
+		Metadata:    p.metadata(),
+		Time:        p.data.Start,
+	}
+}
+
 func (p *participant) upload(filename string) error {
 	// Open file
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
 	// Try uploading
-	key := strings.ReplaceAll(filename, RecordingsDir+"/", "")
-	err = p.uploader.Upload(key, file)
+	object := p.object(filename)
+	object.Size = info.Size()
+	err = p.uploader.Upload(p.ctx, object, file)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,17 @@
+package participant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessKeepsRawFilesWhenDiskIsFull(t *testing.T) {
+	p := &participant{vf: "recordings/a.ivf", af: "recordings/a.ogg"}
+	p.data.EndReason = EndReasonDiskFull
+
+	// Nothing is containerised, so the files don't even have to exist
+	require.NoError(t, p.process())
+	require.Equal(t, "recordings/a.ivf", p.data.Output)
+	require.Equal(t, []string{"recordings/a.ivf", "recordings/a.ogg"}, p.data.Tracks)
+}
@@ -0,0 +1,176 @@
+package participant
+
+import (
+	"os"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recorder"
+	"github.com/labstack/gommon/log"
+)
+
+// Rotation splits a long recording into segments, each processed as soon as it closes. Zero values mean no rotation.
+type Rotation struct {
+	Duration time.Duration `json:"duration,omitempty"`
+	// Bytes written to the raw media files of a segment
+	Size uint64 `json:"size,omitempty"`
+}
+
+// WithDefaults fills the values which are not set with the defaults
+func (r Rotation) WithDefaults(defaults Rotation) Rotation {
+	if r.Duration == 0 {
+		r.Duration = defaults.Duration
+	}
+	if r.Size == 0 {
+		r.Size = defaults.Size
+	}
+	return r
+}
+
+func (r Rotation) due(elapsed time.Duration, bytes uint64) bool {
+	return (r.Duration > 0 && elapsed >= r.Duration) || (r.Size > 0 && bytes >= r.Size)
+}
+
+func (p *participant) RotateIfDue(now time.Time) {
+	if p.state != stateRecording {
+		return
+	}
+
+	p.lock.Lock()
+	if p.rotating || !p.rotation.due(now.Sub(p.segmentStart), p.bytes()-p.segmentBytes) {
+		p.lock.Unlock()
+		return
+	}
+	p.rotating = true
+	p.lock.Unlock()
+
+	if err := p.rotate(); err != nil {
+		log.Errorf("cannot rotate recording | error: %v, participant: %s", err, p.data.Identity)
+		p.lock.Lock()
+		p.rotating = false
+		p.lock.Unlock()
+	}
+}
+
+// bytes returns the bytes written by both recorders
+func (p *participant) bytes() uint64 {
+	var bytes uint64
+	for _, r := range []recorder.Recorder{p.vr, p.ar} {
+		if r != nil {
+			bytes += r.Stats().Bytes
+		}
+	}
+	return bytes
+}
+
+// rotate starts a new segment. Video switches at the next keyframe, which is requested, then audio follows right away.
+func (p *participant) rotate() error {
+	if p.vr == nil {
+		next, err := p.newSink(p.at)
+		if err != nil {
+			return err
+		}
+		p.ar.Rotate(next, func(previous recorder.Sink) {
+			if previous == nil {
+				p.cancelRotation(next)
+				return
+			}
+			p.finishSegment(nil, nil, previous, next)
+		})
+		return nil
+	}
+
+	next, err := p.newSink(p.vt)
+	if err != nil {
+		return err
+	}
+	p.vr.Rotate(next, func(previous recorder.Sink) {
+		if previous == nil {
+			p.cancelRotation(next)
+			return
+		}
+		previousAudio, nextAudio := p.rotateAudio()
+		p.finishSegment(previous, next, previousAudio, nextAudio)
+	})
+	p.pli(p.vt.SSRC())
+	return nil
+}
+
+// rotateAudio follows a video rotation. If it fails, audio carries on in the same file until the end.
+func (p *participant) rotateAudio() (recorder.Sink, recorder.Sink) {
+	if p.ar == nil {
+		return nil, nil
+	}
+	next, err := p.newSink(p.at)
+	if err != nil {
+		log.Errorf("cannot rotate audio | error: %v, participant: %s", err, p.data.Identity)
+		return nil, nil
+	}
+	var previous recorder.Sink
+	p.ar.Rotate(next, func(s recorder.Sink) {
+		previous = s
+	})
+	if previous == nil {
+		p.forgetSink(next)
+		return nil, nil
+	}
+	return previous, next
+}
+
+func (p *participant) cancelRotation(next recorder.Sink) {
+	p.forgetSink(next)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rotating = false
+}
+
+// finishSegment switches to the files of the next segment and processes the previous ones in the background
+func (p *participant) finishSegment(previousVideo, nextVideo, previousAudio, nextAudio recorder.Sink) {
+	now := time.Now()
+
+	p.lock.Lock()
+	var vf, af string
+	if previousVideo != nil {
+		vf = previousVideo.Name()
+		p.vf = nextVideo.Name()
+	}
+	if previousAudio != nil {
+		af = previousAudio.Name()
+		p.af = nextAudio.Name()
+	}
+	index := len(p.data.Segments)
+	p.data.Segments = append(p.data.Segments, Segment{
+		Start: p.segmentStart,
+		End:   now,
+	})
+	p.segmentStart = now
+	p.segmentBytes = p.bytes()
+	p.rotating = false
+	p.processing.Add(1)
+	p.lock.Unlock()
+	log.Infof("rotated recording | participant: %s, segment: %d, video: %s, audio: %s", p.data.Identity, index, vf, af)
+
+	go func() {
+		defer p.processing.Done()
+		output, tracks, err := p.processFiles(vf, af)
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.data.Segments[index].Output = output
+		p.data.Segments[index].Tracks = tracks
+		if err != nil {
+			p.data.Segments[index].Error = err.Error()
+			log.Errorf("error in segment processing | error: %v, participant: %s, segment: %d", err, p.data.Identity, index)
+		}
+	}()
+}
+
+// forgetSink removes the file of a sink closed unused by a cancelled rotation. Empty streams clean up after themselves.
+func (p *participant) forgetSink(sink recorder.Sink) {
+	if p.streamer != nil {
+		return
+	}
+	if err := os.Remove(sink.Name()); err != nil {
+		log.Errorf("cannot remove raw file | error: %v, file: %s", err, sink.Name())
+	}
+}
@@ -0,0 +1,23 @@
+package participant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationWithDefaults(t *testing.T) {
+	defaults := Rotation{Duration: time.Hour, Size: 1000}
+	require.Equal(t, defaults, Rotation{}.WithDefaults(defaults))
+	require.Equal(t, Rotation{Duration: time.Minute, Size: 1000}, Rotation{Duration: time.Minute}.WithDefaults(defaults))
+}
+
+func TestRotationDue(t *testing.T) {
+	require.False(t, Rotation{}.due(time.Hour, 1000))
+
+	rotation := Rotation{Duration: time.Hour, Size: 1000}
+	require.False(t, rotation.due(time.Minute, 10))
+	require.True(t, rotation.due(time.Hour, 10))
+	require.True(t, rotation.due(time.Minute, 1000))
+}
@@ -7,3 +7,14 @@ const (
 	stateRecording state = "recording"
 	stateDone      state = "done"
 )
+
+func (s state) status() Status {
+	switch s {
+	case stateRecording:
+		return StatusRecording
+	case stateDone:
+		return StatusDone
+	default:
+		return StatusPending
+	}
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+)
+
+const jobsBucket = "jobs"
+
+// Bolt keeps jobs in the embedded store, for the workers of a single instance
+type Bolt struct {
+	// Claims read and write jobs in separate transactions
+	lock  sync.Mutex
+	store *store.Store
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewBolt(st *store.Store) *Bolt {
+	return &Bolt{store: st, now: time.Now}
+}
+
+func (b *Bolt) Enqueue(ctx context.Context, job Job) (Job, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var existing Job
+	err := b.store.Get(jobsBucket, job.ID, &existing)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return Job{}, false, err
+	}
+
+	now := b.now()
+	job.Status = StatusQueued
+	job.Created = now
+	job.Updated = now
+	if err = b.store.Put(jobsBucket, job.ID, job); err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func (b *Bolt) Claim(ctx context.Context, worker string, visibility time.Duration) (*Job, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	jobs, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+	now := b.now()
+	for _, job := range jobs {
+		if job.Status == StatusDone && now.Sub(job.Updated) > doneRetention {
+			if err = b.store.Delete(jobsBucket, job.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	job := oldestClaimable(jobs, now)
+	if job == nil {
+		return nil, nil
+	}
+	job.claim(worker, visibility, now)
+	if err = b.store.Put(jobsBucket, job.ID, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (b *Bolt) Complete(ctx context.Context, id string, worker string) error {
+	return b.update(id, worker, func(job *Job) {
+		job.complete(b.now())
+	})
+}
+
+func (b *Bolt) Fail(ctx context.Context, id string, worker string, cause error) error {
+	return b.update(id, worker, func(job *Job) {
+		job.fail(cause, b.now())
+	})
+}
+
+// update changes a job claimed by worker
+func (b *Bolt) update(id string, worker string, fn func(job *Job)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var job Job
+	if err := b.store.Get(jobsBucket, id, &job); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if job.Status != StatusClaimed || job.Worker != worker {
+		return ErrNotOwner
+	}
+	fn(&job)
+	return b.store.Put(jobsBucket, id, job)
+}
+
+func (b *Bolt) Get(ctx context.Context, id string) (Job, error) {
+	var job Job
+	err := b.store.Get(jobsBucket, id, &job)
+	if errors.Is(err, store.ErrNotFound) {
+		return job, ErrNotFound
+	}
+	return job, err
+}
+
+func (b *Bolt) List(ctx context.Context) ([]Job, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.list()
+}
+
+// list must hold the lock
+func (b *Bolt) list() ([]Job, error) {
+	jobs := []Job{}
+	err := b.store.ForEach(jobsBucket, func(key string, value []byte) error {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	sortJobs(jobs)
+	return jobs, err
+}
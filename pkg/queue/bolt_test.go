@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBolt(t *testing.T) (*Bolt, *time.Time) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		st.Close()
+	})
+	now := time.Now()
+	q := NewBolt(st)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func startJob(id string) Job {
+	job, _ := NewStartJob(recording.StartRecordingRequest{ID: id, Room: "room", Participant: id}, nil)
+	return job
+}
+
+func TestEnqueueDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestBolt(t)
+
+	job, added, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Equal(t, StatusQueued, job.Status)
+
+	_, added, err = q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	require.False(t, added)
+
+	jobs, err := q.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+}
+
+func TestStartJobGetsRecordingID(t *testing.T) {
+	job, err := NewStartJob(recording.StartRecordingRequest{Room: "room", Participant: "alice"}, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, job.ID)
+	require.Equal(t, job.ID, job.Start.ID)
+}
+
+func TestClaimOldestFirst(t *testing.T) {
+	ctx := context.Background()
+	q, now := newTestBolt(t)
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	*now = now.Add(time.Second)
+	_, _, err = q.Enqueue(ctx, startJob("b"))
+	require.NoError(t, err)
+
+	job, err := q.Claim(ctx, "w1", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "a", job.ID)
+	require.Equal(t, 1, job.Attempts)
+
+	job, err = q.Claim(ctx, "w2", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "b", job.ID)
+
+	job, err = q.Claim(ctx, "w3", time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, job)
+}
+
+func TestExpiredClaimIsRedelivered(t *testing.T) {
+	ctx := context.Background()
+	q, now := newTestBolt(t)
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	_, err = q.Claim(ctx, "w1", time.Minute)
+	require.NoError(t, err)
+
+	*now = now.Add(time.Minute)
+	job, err := q.Claim(ctx, "w2", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "a", job.ID)
+	require.Equal(t, 2, job.Attempts)
+
+	// The first worker lost the job
+	require.ErrorIs(t, q.Complete(ctx, "a", "w1"), ErrNotOwner)
+	require.NoError(t, q.Complete(ctx, "a", "w2"))
+
+	job2, err := q.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, StatusDone, job2.Status)
+}
+
+func TestFailRetriesThenFails(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestBolt(t)
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	for attempt := 1; attempt <= MaxAttempts; attempt++ {
+		job, err := q.Claim(ctx, "w", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		require.NoError(t, q.Fail(ctx, job.ID, "w", errors.New("unavailable")))
+	}
+
+	job, err := q.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, StatusFailed, job.Status)
+	require.Equal(t, "unavailable", job.Error)
+
+	next, err := q.Claim(ctx, "w", time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, next)
+}
+
+func TestGetMissingJob(t *testing.T) {
+	q, _ := newTestBolt(t)
+	_, err := q.Get(context.Background(), "a")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestStartJobSealsUploadTarget(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestBolt(t)
+	req := recording.StartRecordingRequest{
+		ID:          "a",
+		Room:        "room",
+		Participant: "alice",
+		Upload:      &upload.HTTPTarget{URL: "https://example.com/a.mp4?signature=secret"},
+	}
+
+	// Refused without a key
+	_, err := NewStartJob(req, nil)
+	require.ErrorIs(t, err, upload.ErrTargetKeyMissing)
+
+	key, err := crypt.ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	job, err := NewStartJob(req, key)
+	require.NoError(t, err)
+	_, _, err = q.Enqueue(ctx, job)
+	require.NoError(t, err)
+
+	// Neither stored nor listed in clear
+	err = q.store.ForEach(jobsBucket, func(id string, value []byte) error {
+		require.NotContains(t, string(value), "secret")
+		return nil
+	})
+	require.NoError(t, err)
+	listed, err := json.Marshal(job.Redacted())
+	require.NoError(t, err)
+	require.NotContains(t, string(listed), "secret")
+	require.NotContains(t, string(listed), "sealedUpload")
+
+	// The worker opens it again
+	stored, err := q.Get(ctx, "a")
+	require.NoError(t, err)
+	opened, err := stored.startRequest(key)
+	require.NoError(t, err)
+	require.Equal(t, req, opened)
+	_, err = stored.startRequest(nil)
+	require.ErrorIs(t, err, upload.ErrTargetKeyMissing)
+}
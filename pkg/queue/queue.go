@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/livekit/protocol/utils"
+)
+
+type Kind string
+
+const (
+	KindStart     Kind = "start"
+	KindStop      Kind = "stop"
+	KindStartRoom Kind = "start-room"
+	KindStopRoom  Kind = "stop-room"
+)
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusClaimed Status = "claimed"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is a start or stop request waiting for a worker. Start jobs share the ID of the recording they start.
+// Jobs of the same participant, or of the same room recording, are carried out one at a time in order.
+type Job struct {
+	ID        string                               `json:"id"`
+	Kind      Kind                                 `json:"kind"`
+	Start     *recording.StartRecordingRequest     `json:"start,omitempty"`
+	Stop      *recording.StopRecordingRequest      `json:"stop,omitempty"`
+	StartRoom *recording.StartRoomRecordingRequest `json:"startRoom,omitempty"`
+	StopRoom  *recording.StopRoomRecordingRequest  `json:"stopRoom,omitempty"`
+	Status    Status                               `json:"status"`
+	Attempts  int                                  `json:"attempts"`
+	Error     string                               `json:"error,omitempty"`
+
+	// Upload target of a start job, sealed with the master key since it carries credentials
+	SealedUpload []byte `json:"sealedUpload,omitempty"`
+
+	// Set while claimed, the job is queued again if the worker doesn't finish it in time
+	Worker       string    `json:"worker,omitempty"`
+	ClaimedUntil time.Time `json:"claimedUntil,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+var (
+	ErrNotFound = errors.New("job not found")
+	ErrNotOwner = errors.New("job is claimed by another worker")
+)
+
+const (
+	// MaxAttempts is how many times a job is tried before it fails for good
+	MaxAttempts = 5
+
+	// Done jobs are forgotten after a while, failed ones are kept until removed by hand
+	doneRetention = 24 * time.Hour
+)
+
+// Queue is durable and delivers each job at least once. Implementations must be safe for concurrent use.
+type Queue interface {
+	// Enqueue adds a job, unless one with the same ID exists. Returns the job in the queue, and whether it was added.
+	Enqueue(ctx context.Context, job Job) (Job, bool, error)
+
+	// Claim hands the oldest queued job to worker until its visibility timeout. Returns nil if there is none.
+	Claim(ctx context.Context, worker string, visibility time.Duration) (*Job, error)
+
+	// Complete marks a claimed job done. Fail queues it again, or fails it for good after MaxAttempts.
+	Complete(ctx context.Context, id string, worker string) error
+	Fail(ctx context.Context, id string, worker string, cause error) error
+
+	Get(ctx context.Context, id string) (Job, error)
+	List(ctx context.Context) ([]Job, error)
+}
+
+// NewStartJob queues a recording. A request without an ID gets one, so retries can be deduplicated.
+// Its upload target is sealed with key, and refused without one.
+func NewStartJob(req recording.StartRecordingRequest, key *crypt.MasterKey) (Job, error) {
+	if req.ID == "" {
+		req.ID = utils.NewGuid("RC_")
+	}
+	job := Job{ID: req.ID, Kind: KindStart, Start: &req}
+	if req.Upload != nil {
+		sealed, err := upload.SealTarget(key, *req.Upload)
+		if err != nil {
+			return Job{}, err
+		}
+		job.SealedUpload = sealed
+		req.Upload = nil
+	}
+	return job, nil
+}
+
+// Redacted returns the job as it is shown to clients, without its upload target even sealed
+func (j Job) Redacted() Job {
+	j.SealedUpload = nil
+	return j
+}
+
+// startRequest returns the request of a start job, with its upload target opened with key
+func (j *Job) startRequest(key *crypt.MasterKey) (recording.StartRecordingRequest, error) {
+	req := *j.Start
+	if j.SealedUpload != nil {
+		target, err := upload.OpenTarget(key, j.SealedUpload)
+		if err != nil {
+			return recording.StartRecordingRequest{}, err
+		}
+		req.Upload = target
+	}
+	return req, nil
+}
+
+// NewStopJob stops a recording. The ID of the request is prefixed, so it never matches the start job of a recording.
+func NewStopJob(id string, req recording.StopRecordingRequest) Job {
+	return Job{ID: jobID(KindStop, id), Kind: KindStop, Stop: &req}
+}
+
+func NewStartRoomJob(id string, req recording.StartRoomRecordingRequest) Job {
+	return Job{ID: jobID(KindStartRoom, id), Kind: KindStartRoom, StartRoom: &req}
+}
+
+func NewStopRoomJob(id string, req recording.StopRoomRecordingRequest) Job {
+	return Job{ID: jobID(KindStopRoom, id), Kind: KindStopRoom, StopRoom: &req}
+}
+
+func jobID(kind Kind, id string) string {
+	if id == "" {
+		return utils.NewGuid("JS_")
+	}
+	return string(kind) + ":" + id
+}
+
+// subject is what the job acts on. A job only runs once the older jobs of its subject are done or failed.
+func (j *Job) subject() string {
+	switch {
+	case j.Start != nil:
+		return j.Start.Room + "/" + j.Start.Participant
+	case j.Stop != nil:
+		return j.Stop.Room + "/" + j.Stop.Participant
+	case j.StartRoom != nil:
+		return "room:" + j.StartRoom.Room
+	case j.StopRoom != nil:
+		return "room:" + j.StopRoom.Room
+	default:
+		return j.ID
+	}
+}
+
+func (j *Job) finished() bool {
+	return j.Status == StatusDone || j.Status == StatusFailed
+}
+
+// claimable returns true if the job is queued, or claimed by a worker which ran out of time
+func (j *Job) claimable(now time.Time) bool {
+	return j.Status == StatusQueued || (j.Status == StatusClaimed && !now.Before(j.ClaimedUntil))
+}
+
+func (j *Job) claim(worker string, visibility time.Duration, now time.Time) {
+	j.Status = StatusClaimed
+	j.Worker = worker
+	j.ClaimedUntil = now.Add(visibility)
+	j.Attempts++
+	j.Updated = now
+}
+
+func (j *Job) complete(now time.Time) {
+	j.Status = StatusDone
+	j.Error = ""
+	j.ClaimedUntil = time.Time{}
+	j.Updated = now
+}
+
+func (j *Job) fail(cause error, now time.Time) {
+	j.Status = StatusQueued
+	if j.Attempts >= MaxAttempts {
+		j.Status = StatusFailed
+	}
+	j.Error = cause.Error()
+	j.Worker = ""
+	j.ClaimedUntil = time.Time{}
+	j.Updated = now
+}
+
+// oldestClaimable returns the next job to claim, oldest first. Jobs must be sorted by creation time.
+// Jobs waiting for an older job of their subject are skipped, e.g. a stop while its start is claimed.
+func oldestClaimable(jobs []Job, now time.Time) *Job {
+	blocked := make(map[string]bool)
+	for i := range jobs {
+		if jobs[i].finished() {
+			continue
+		}
+		subject := jobs[i].subject()
+		if blocked[subject] {
+			continue
+		}
+		blocked[subject] = true
+		if jobs[i].claimable(now) {
+			return &jobs[i]
+		}
+	}
+	return nil
+}
+
+func sortJobs(jobs []Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+}
@@ -0,0 +1,213 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Requeues jobs whose claim expired, then moves the oldest job which is first of its subject from the queue
+// to the claimed set. Each subject lists its unfinished jobs in order.
+var claimScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now)
+for _, id in ipairs(expired) do
+	redis.call("ZREM", KEYS[2], id)
+	redis.call("LPUSH", KEYS[1], id)
+end
+for _, id in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	local subject = redis.call("HGET", KEYS[3], id)
+	if not subject or redis.call("LINDEX", ARGV[3] .. subject, 0) == id then
+		redis.call("LREM", KEYS[1], 1, id)
+		redis.call("ZADD", KEYS[2], now + tonumber(ARGV[2]), id)
+		return id
+	end
+end
+return false`)
+
+// Redis shares jobs between the workers of every instance through any Redis-compatible server
+type Redis struct {
+	client *redis.Client
+	prefix string
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+// NewRedis namespaces every key with prefix, so several clusters can share a server
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client, prefix, time.Now}
+}
+
+func (r *Redis) jobKey(id string) string {
+	return r.prefix + "job:" + id
+}
+
+// Every job by creation time, ready jobs in order, and claimed jobs by deadline
+func (r *Redis) indexKey() string   { return r.prefix + "jobs" }
+func (r *Redis) queueKey() string   { return r.prefix + "queue" }
+func (r *Redis) claimedKey() string { return r.prefix + "claimed" }
+
+// The subject of each unfinished job, and the unfinished jobs of each subject in order
+func (r *Redis) subjectsKey() string              { return r.prefix + "subjects" }
+func (r *Redis) subjectPrefix() string            { return r.prefix + "subject:" }
+func (r *Redis) subjectKey(subject string) string { return r.subjectPrefix() + subject }
+
+func (r *Redis) Enqueue(ctx context.Context, job Job) (Job, bool, error) {
+	now := r.now()
+	job.Status = StatusQueued
+	job.Created = now
+	job.Updated = now
+	value, err := json.Marshal(job)
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	added, err := r.client.SetNX(ctx, r.jobKey(job.ID), value, 0).Result()
+	if err != nil {
+		return Job{}, false, err
+	}
+	if !added {
+		existing, err := r.Get(ctx, job.ID)
+		return existing, false, err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, r.indexKey(), &redis.Z{Score: float64(now.UnixMilli()), Member: job.ID})
+		pipe.HSet(ctx, r.subjectsKey(), job.ID, job.subject())
+		pipe.RPush(ctx, r.subjectKey(job.subject()), job.ID)
+		pipe.RPush(ctx, r.queueKey(), job.ID)
+		return nil
+	})
+	return job, true, err
+}
+
+func (r *Redis) Claim(ctx context.Context, worker string, visibility time.Duration) (*Job, error) {
+	now := r.now()
+	keys := []string{r.queueKey(), r.claimedKey(), r.subjectsKey()}
+	id, err := claimScript.Run(ctx, r.client, keys, now.UnixMilli(), visibility.Milliseconds(), r.subjectPrefix()).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := r.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	job.claim(worker, visibility, now)
+	return &job, r.save(ctx, job, 0)
+}
+
+func (r *Redis) Complete(ctx context.Context, id string, worker string) error {
+	job, err := r.claimed(ctx, id, worker)
+	if err != nil {
+		return err
+	}
+	job.complete(r.now())
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.claimedKey(), id)
+		r.forgetSubject(ctx, pipe, job)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.save(ctx, job, doneRetention)
+}
+
+func (r *Redis) Fail(ctx context.Context, id string, worker string, cause error) error {
+	job, err := r.claimed(ctx, id, worker)
+	if err != nil {
+		return err
+	}
+	job.fail(cause, r.now())
+	if err = r.save(ctx, job, 0); err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.claimedKey(), id)
+		if job.Status == StatusQueued {
+			pipe.RPush(ctx, r.queueKey(), id)
+		} else {
+			r.forgetSubject(ctx, pipe, job)
+		}
+		return nil
+	})
+	return err
+}
+
+// forgetSubject lets the next job of the subject run
+func (r *Redis) forgetSubject(ctx context.Context, pipe redis.Pipeliner, job Job) {
+	pipe.LRem(ctx, r.subjectKey(job.subject()), 1, job.ID)
+	pipe.HDel(ctx, r.subjectsKey(), job.ID)
+}
+
+// claimed returns a job claimed by worker
+func (r *Redis) claimed(ctx context.Context, id string, worker string) (Job, error) {
+	job, err := r.Get(ctx, id)
+	if err != nil {
+		return job, err
+	}
+	if job.Status != StatusClaimed || job.Worker != worker {
+		return job, ErrNotOwner
+	}
+	return job, nil
+}
+
+func (r *Redis) save(ctx context.Context, job Job, ttl time.Duration) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.jobKey(job.ID), value, ttl).Err()
+}
+
+func (r *Redis) Get(ctx context.Context, id string) (Job, error) {
+	var job Job
+	value, err := r.client.Get(ctx, r.jobKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return job, ErrNotFound
+	}
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(value, &job)
+	return job, err
+}
+
+func (r *Redis) List(ctx context.Context) ([]Job, error) {
+	ids, err := r.client.ZRange(ctx, r.indexKey(), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return []Job{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.jobKey(id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			// Done jobs expire on their own, drop them from the index as well
+			r.client.ZRem(ctx, r.indexKey(), ids[i])
+			continue
+		}
+		var job Job
+		if err = json.Unmarshal([]byte(s), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/labstack/gommon/log"
+)
+
+// Recorder carries out the jobs, either the local recording service or a cluster assigner
+type Recorder interface {
+	StartRecording(ctx context.Context, req recording.StartRecordingRequest) error
+	StopRecording(ctx context.Context, req recording.StopRecordingRequest) error
+}
+
+// RoomRecorder carries out room jobs. Room recordings aren't shared by a cluster, they are recorded where they start.
+type RoomRecorder interface {
+	StartRoomRecording(ctx context.Context, req recording.StartRoomRecordingRequest) error
+	StopRoomRecording(ctx context.Context, req recording.StopRoomRecordingRequest) (recording.RoomRecordingData, error)
+}
+
+const (
+	pollInterval = time.Second
+
+	// Starting or stopping a recording only waits for the bot to join the room
+	visibilityTimeout = time.Minute
+)
+
+var ErrUnknownKind = errors.New("unknown job kind")
+
+type Worker struct {
+	queue    Queue
+	recorder Recorder
+	rooms    RoomRecorder
+	name     string
+
+	// Opens the upload targets of start jobs
+	targetKey *crypt.MasterKey
+}
+
+func NewWorker(queue Queue, recorder Recorder, name string) *Worker {
+	return &Worker{queue: queue, recorder: recorder, name: name}
+}
+
+// SetRoomRecorder carries out room jobs, which fail without one
+func (w *Worker) SetRoomRecorder(rooms RoomRecorder) {
+	w.rooms = rooms
+}
+
+// SetTargetKey opens the upload targets of start jobs, which fail without it
+func (w *Worker) SetTargetKey(key *crypt.MasterKey) {
+	w.targetKey = key
+}
+
+// Run claims and carries out jobs until the context is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	for {
+		worked, err := w.work(ctx)
+		if err != nil {
+			log.Errorf("cannot work on jobs | error: %v, worker: %s", err, w.name)
+		}
+		if worked {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// work carries out the next job, and returns false if there was none
+func (w *Worker) work(ctx context.Context) (bool, error) {
+	job, err := w.queue.Claim(ctx, w.name, visibilityTimeout)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	log.Infof("working on job | id: %s, kind: %s, attempt: %d, worker: %s", job.ID, job.Kind, job.Attempts, w.name)
+	if err = w.execute(ctx, job); err != nil {
+		log.Warnf("job failed | error: %v, id: %s, attempt: %d", err, job.ID, job.Attempts)
+		return true, w.queue.Fail(ctx, job.ID, w.name, err)
+	}
+	return true, w.queue.Complete(ctx, job.ID, w.name)
+}
+
+func (w *Worker) execute(ctx context.Context, job *Job) error {
+	switch {
+	case job.Kind == KindStart && job.Start != nil:
+		req, err := job.startRequest(w.targetKey)
+		if err != nil {
+			return err
+		}
+		return w.recorder.StartRecording(ctx, req)
+	case job.Kind == KindStop && job.Stop != nil:
+		err := w.recorder.StopRecording(ctx, *job.Stop)
+		// Already stopped, e.g. on a previous attempt
+		if errors.Is(err, recording.ErrRoomNotRecorded) {
+			return nil
+		}
+		return err
+	case job.Kind == KindStartRoom && job.StartRoom != nil && w.rooms != nil:
+		err := w.rooms.StartRoomRecording(ctx, *job.StartRoom)
+		// Already started, e.g. on a previous attempt
+		if errors.Is(err, recording.ErrRoomAlreadyRecorded) {
+			return nil
+		}
+		return err
+	case job.Kind == KindStopRoom && job.StopRoom != nil && w.rooms != nil:
+		// Unlike participants, the room may be recorded by another instance sharing the queue, which can still claim the job
+		_, err := w.rooms.StopRoomRecording(ctx, *job.StopRoom)
+		return err
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownKind, job.Kind)
+	}
+}
@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/stretchr/testify/require"
+)
+
+// mockRecorder records the calls made by workers
+type mockRecorder struct {
+	started []string
+	stopped []string
+	err     error
+}
+
+func (m *mockRecorder) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.started = append(m.started, req.ID)
+	return nil
+}
+
+func (m *mockRecorder) StopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	m.stopped = append(m.stopped, req.Participant)
+	return recording.ErrRoomNotRecorded
+}
+
+func TestWorkerCarriesOutJobs(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestBolt(t)
+	recorder := &mockRecorder{}
+	w := NewWorker(q, recorder, "w")
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	_, _, err = q.Enqueue(ctx, NewStopJob("b", recording.StopRecordingRequest{Room: "room", Participant: "alice"}))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		worked, err := w.work(ctx)
+		require.NoError(t, err)
+		require.True(t, worked)
+	}
+	worked, err := w.work(ctx)
+	require.NoError(t, err)
+	require.False(t, worked)
+
+	require.Equal(t, []string{"a"}, recorder.started)
+	require.Equal(t, []string{"alice"}, recorder.stopped)
+
+	// Stopping a recording which is already gone is done
+	job, err := q.Get(ctx, "stop:b")
+	require.NoError(t, err)
+	require.Equal(t, StatusDone, job.Status)
+}
+
+func TestWorkerRequeuesFailedJobs(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestBolt(t)
+	recorder := &mockRecorder{err: recording.ErrAtCapacity}
+	w := NewWorker(q, recorder, "w")
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	_, err = w.work(ctx)
+	require.NoError(t, err)
+
+	job, err := q.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, StatusQueued, job.Status)
+	require.Equal(t, recording.ErrAtCapacity.Error(), job.Error)
+}
+
+func TestStopJobDoesNotMatchStartJob(t *testing.T) {
+	ctx := context.Background()
+	q, now := newTestBolt(t)
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	*now = now.Add(time.Second)
+	_, added, err := q.Enqueue(ctx, NewStopJob("a", recording.StopRecordingRequest{Room: "room", Participant: "a"}))
+	require.NoError(t, err)
+	require.True(t, added)
+}
+
+func TestJobsOfASubjectRunInOrder(t *testing.T) {
+	ctx := context.Background()
+	q, now := newTestBolt(t)
+
+	_, _, err := q.Enqueue(ctx, startJob("a"))
+	require.NoError(t, err)
+	*now = now.Add(time.Second)
+	_, _, err = q.Enqueue(ctx, NewStopJob("a", recording.StopRecordingRequest{Room: "room", Participant: "a"}))
+	require.NoError(t, err)
+	*now = now.Add(time.Second)
+	_, _, err = q.Enqueue(ctx, startJob("b"))
+	require.NoError(t, err)
+
+	// The stop waits for its start, other subjects don't
+	job, err := q.Claim(ctx, "w1", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "a", job.ID)
+	job, err = q.Claim(ctx, "w2", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "b", job.ID)
+	job, err = q.Claim(ctx, "w3", time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, job)
+
+	require.NoError(t, q.Complete(ctx, "a", "w1"))
+	job, err = q.Claim(ctx, "w3", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "stop:a", job.ID)
+}
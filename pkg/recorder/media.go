@@ -1,6 +1,7 @@
 package recorder
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 	"strings"
@@ -69,3 +70,38 @@ func createSampleBuilder(codec webrtc.RTPCodecParameters, opts ...samplebuilder.
 	}
 	return samplebuilder.New(maxLate, depacketizer, codec.ClockRate, opts...)
 }
+
+// isKeyframe returns true if the packet starts a frame which can be decoded on its own.
+// Audio packets can always be decoded on their own.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch GetMediaExtension(mimeType) {
+	case MediaIVF:
+		if strings.EqualFold(mimeType, webrtc.MimeTypeVP9) {
+			vp9 := codecs.VP9Packet{}
+			if _, err := vp9.Unmarshal(payload); err != nil {
+				return false
+			}
+			return vp9.B && !vp9.P
+		}
+		vp8 := codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case MediaH264:
+		// Same as the H264 writer, which waits for the SPS preceding a keyframe
+		const (
+			typeSTAPA       = 24
+			typeSPS         = 7
+			naluTypeBitmask = 0x1F
+		)
+		if len(payload) < 4 {
+			return false
+		}
+		word := binary.BigEndian.Uint32(payload)
+		naluType := (word >> 24) & naluTypeBitmask
+		return naluType == typeSPS || (naluType == typeSTAPA && word&naluTypeBitmask == typeSPS)
+	default:
+		return true
+	}
+}
@@ -162,3 +162,17 @@ func TestUnsupportedCodecSampleBuilder(t *testing.T) {
 	sb := createSampleBuilder(codec)
 	require.Nil(t, sb)
 }
+
+func TestIsKeyframe(t *testing.T) {
+	require.True(t, isKeyframe(webrtc.MimeTypeVP8, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}))
+	require.False(t, isKeyframe(webrtc.MimeTypeVP8, []byte{0x10, 0x03, 0x00, 0x9d, 0x01, 0x2a}))
+	// Continuation of a partition
+	require.False(t, isKeyframe(webrtc.MimeTypeVP8, []byte{0x00, 0x02, 0x00, 0x9d, 0x01, 0x2a}))
+
+	// SPS, alone or aggregated
+	require.True(t, isKeyframe(webrtc.MimeTypeH264, []byte{0x67, 0x42, 0x00, 0x1f}))
+	require.True(t, isKeyframe(webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x0f, 0x67}))
+	require.False(t, isKeyframe(webrtc.MimeTypeH264, []byte{0x41, 0x9a, 0x00, 0x00}))
+
+	require.True(t, isKeyframe(webrtc.MimeTypeOpus, []byte{0xfc}))
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/livekit/server-sdk-go/pkg/samplebuilder"
 	"github.com/pion/rtp"
@@ -13,17 +16,69 @@ import (
 
 type Recorder interface {
 	Start(context.Context, *webrtc.TrackRemote)
+	// Resume continues recording to the same sink from another track, e.g. after reconnecting.
+	// Time between the last packet and the resumed track is kept as a gap in the media.
+	Resume(*webrtc.TrackRemote)
+	// Rotate switches to the next sink at the next keyframe. Audio has no keyframes, so it switches
+	// right away and rotated is called before Rotate returns. The previous sink is closed and passed
+	// to rotated. A rotation still pending when the recorder stops is cancelled, in which case the
+	// next sink is closed unused and rotated receives nil.
+	Rotate(next Sink, rotated func(previous Sink))
 	Stop()
 	Sink() Sink
+	Stats() Stats
+}
+
+type Stats struct {
+	// Number of RTP packets read from the track
+	Packets uint64
+	// Number of bytes written to the sink
+	Bytes uint64
 }
 
 type recorder struct {
+	// Counters are accessed atomically, keep them 64-bit aligned
+	packets uint64
+	bytes   uint64
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	sink Sink
-	mw   media.Writer
-	sb   *samplebuilder.SampleBuilder
+	// Guards the fields below, which change when the recorder resumes
+	lock  sync.Mutex
+	track *webrtc.TrackRemote
+	done  chan struct{}
+
+	codec webrtc.RTPCodecParameters
+	opts  []samplebuilder.Option
+	mw    media.Writer
+	sb    *samplebuilder.SampleBuilder
+
+	// Guards the sink and media writer, which change when the recorder rotates
+	rotateLock sync.Mutex
+	sink       Sink
+	rotation   *rotation
+	stopped    bool
+
+	// Keeps timestamps and sequence numbers continuous across tracks
+	rewriter packetRewriter
+}
+
+type rotation struct {
+	next    Sink
+	rotated func(previous Sink)
+}
+
+// countingWriter keeps track of the bytes written by the media writer
+type countingWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
 }
 
 func New(codec webrtc.RTPCodecParameters, filename string, opts ...samplebuilder.Option) (Recorder, error) {
@@ -31,19 +86,25 @@ func New(codec webrtc.RTPCodecParameters, filename string, opts ...samplebuilder
 	if err != nil {
 		return nil, err
 	}
-	return NewWith(codec, sink)
+	return NewWith(codec, sink, opts...)
 }
 
 func NewWith(codec webrtc.RTPCodecParameters, sink Sink, opts ...samplebuilder.Option) (Recorder, error) {
-	mw, err := createMediaWriter(sink, codec)
+	r := &recorder{
+		codec: codec,
+		opts:  opts,
+		sink:  sink,
+		sb:    createSampleBuilder(codec, opts...),
+		rewriter: packetRewriter{
+			clockRate: codec.ClockRate,
+		},
+	}
+	mw, err := createMediaWriter(&countingWriter{sink, &r.bytes}, codec)
 	if err != nil {
 		return nil, err
 	}
-	return &recorder{
-		sink: sink,
-		mw:   mw,
-		sb:   createSampleBuilder(codec, opts...),
-	}, nil
+	r.mw = mw
+	return r, nil
 }
 
 func (r *recorder) Start(ctx context.Context, track *webrtc.TrackRemote) {
@@ -51,31 +112,162 @@ func (r *recorder) Start(ctx context.Context, track *webrtc.TrackRemote) {
 	r.ctx, r.cancel = context.WithCancel(ctx)
 
 	// Start recording in a goroutine
-	go r.startRecording(track)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.run(track)
+}
+
+func (r *recorder) Resume(track *webrtc.TrackRemote) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Stop reading the previous track, which is most likely dead already
+	r.interrupt()
+	<-r.done
+
+	// Buffered packets belong to the previous track
+	r.sb = createSampleBuilder(r.codec, r.opts...)
+	r.rewriter.resume()
+	r.run(track)
+}
+
+// run reads the track in a goroutine. Must hold the lock.
+func (r *recorder) run(track *webrtc.TrackRemote) {
+	// Clear deadlines left by a previous recorder of the same track
+	if err := track.SetReadDeadline(time.Time{}); err != nil {
+		log.Println("cannot reset track deadline: ", err)
+	}
+	r.track = track
+	r.done = make(chan struct{})
+	go r.startRecording(track, r.sb, r.done)
+}
+
+// interrupt unblocks the goroutine waiting for packets. Must hold the lock.
+func (r *recorder) interrupt() {
+	if r.track == nil {
+		return
+	}
+	if err := r.track.SetReadDeadline(time.Now()); err != nil {
+		log.Println("cannot interrupt track: ", err)
+	}
+}
+
+func (r *recorder) Rotate(next Sink, rotated func(previous Sink)) {
+	r.rotateLock.Lock()
+	if r.stopped || r.rotation != nil {
+		r.rotateLock.Unlock()
+		cancelRotation(&rotation{next, rotated})
+		return
+	}
+	r.rotation = &rotation{next, rotated}
+
+	// Every audio packet can start a file
+	if GetMediaExtension(r.codec.MimeType) != MediaOGG {
+		r.rotateLock.Unlock()
+		return
+	}
+	previous, err := r.swap()
+	r.rotateLock.Unlock()
+	r.finishRotation(previous, err)
+}
+
+func cancelRotation(rot *rotation) {
+	if err := rot.next.Close(); err != nil {
+		log.Println("sink error: ", err)
+	}
+	rot.rotated(nil)
+}
+
+// swap switches to the sink of the pending rotation. Must hold the rotate lock.
+func (r *recorder) swap() (*rotation, error) {
+	rot := r.rotation
+	r.rotation = nil
+	mw, err := createMediaWriter(&countingWriter{rot.next, &r.bytes}, r.codec)
+	if err != nil {
+		return rot, err
+	}
+	rot.next, r.sink = r.sink, rot.next
+	r.mw = mw
+	return rot, nil
+}
+
+// finishRotation closes the previous sink, now held by the rotation, and reports it
+func (r *recorder) finishRotation(rot *rotation, err error) {
+	if err != nil {
+		log.Println("cannot rotate: ", err)
+		cancelRotation(rot)
+		return
+	}
+	if err = rot.next.Close(); err != nil {
+		log.Println("sink error: ", err)
+	}
+	rot.rotated(rot.next)
+}
+
+// writePacket writes to the media writer, switching sinks first if a rotation is pending and the packet starts a keyframe
+func (r *recorder) writePacket(p *rtp.Packet) error {
+	r.rotateLock.Lock()
+	var rot *rotation
+	var rotateErr error
+	if r.rotation != nil && isKeyframe(r.codec.MimeType, p.Payload) {
+		rot, rotateErr = r.swap()
+	}
+	err := r.mw.WriteRTP(p)
+	r.rotateLock.Unlock()
+
+	if rot != nil {
+		r.finishRotation(rot, rotateErr)
+	}
+	return err
 }
 
 func (r *recorder) Stop() {
 	// Signal goroutine to stop
 	r.cancel()
+
+	// Wait for the goroutine so everything is written before closing the sink
+	r.lock.Lock()
+	r.interrupt()
+	done := r.done
+	r.lock.Unlock()
+	<-done
+
+	r.rotateLock.Lock()
+	r.stopped = true
+	rot := r.rotation
+	r.rotation = nil
+	sink := r.sink
+	r.rotateLock.Unlock()
+
+	if rot != nil {
+		cancelRotation(rot)
+	}
+	if err := sink.Close(); err != nil {
+		log.Println("sink error: ", err)
+	}
 }
 
 func (r *recorder) Sink() Sink {
+	r.rotateLock.Lock()
+	defer r.rotateLock.Unlock()
 	return r.sink
 }
 
-func (r *recorder) startRecording(track *webrtc.TrackRemote) {
+func (r *recorder) Stats() Stats {
+	return Stats{
+		Packets: atomic.LoadUint64(&r.packets),
+		Bytes:   atomic.LoadUint64(&r.bytes),
+	}
+}
+
+func (r *recorder) startRecording(track *webrtc.TrackRemote, sb *samplebuilder.SampleBuilder, done chan struct{}) {
 	var err error
 	defer func() {
-		// Log any errors
-		if err != nil && err != io.EOF {
+		// Log any errors. The sink stays open in case the recorder resumes
+		if err != nil && err != io.EOF && r.ctx.Err() == nil {
 			log.Println("recorder error: ", err)
 		}
-
-		// Close sink
-		err = r.sink.Close()
-		if err != nil {
-			log.Println("sink error: ", err)
-		}
+		close(done)
 	}()
 
 	// Process RTP packets forever until stopped
@@ -90,9 +282,11 @@ func (r *recorder) startRecording(track *webrtc.TrackRemote) {
 			if err != nil {
 				return
 			}
+			atomic.AddUint64(&r.packets, 1)
+			r.rewriter.rewrite(packet)
 
 			// Write packet to sink
-			err = r.writeToSink(packet)
+			err = r.writeToSinkWith(sb, packet)
 			if err != nil {
 				return
 			}
@@ -101,18 +295,22 @@ func (r *recorder) startRecording(track *webrtc.TrackRemote) {
 }
 
 func (r *recorder) writeToSink(p *rtp.Packet) (err error) {
+	return r.writeToSinkWith(r.sb, p)
+}
+
+func (r *recorder) writeToSinkWith(sb *samplebuilder.SampleBuilder, p *rtp.Packet) (err error) {
 	// If no sample buffer is used, write directly to sink
-	if r.sb == nil {
-		return r.mw.WriteRTP(p)
+	if sb == nil {
+		return r.writePacket(p)
 	}
 
 	// If sample buffer is used, write to buffer first
-	r.sb.Push(p)
+	sb.Push(p)
 
 	// And from the buffered packets, write to sink
-	if packets := r.sb.PopPackets(); packets != nil {
+	if packets := sb.PopPackets(); packets != nil {
 		for _, p := range packets {
-			err = r.mw.WriteRTP(p)
+			err = r.writePacket(p)
 			if err != nil {
 				return err
 			}
@@ -121,3 +319,39 @@ func (r *recorder) writeToSink(p *rtp.Packet) (err error) {
 
 	return nil
 }
+
+// packetRewriter offsets timestamps and sequence numbers of a resumed track,
+// so they carry on from the previous track with the elapsed time in between.
+type packetRewriter struct {
+	clockRate uint32
+
+	started   bool
+	resumed   bool
+	tsOffset  uint32
+	seqOffset uint16
+
+	lastTimestamp uint32
+	lastSequence  uint16
+	lastReceived  time.Time
+}
+
+func (w *packetRewriter) resume() {
+	w.resumed = w.started
+}
+
+func (w *packetRewriter) rewrite(p *rtp.Packet) {
+	now := time.Now()
+	if w.resumed {
+		elapsed := uint32(now.Sub(w.lastReceived).Seconds() * float64(w.clockRate))
+		w.tsOffset = w.lastTimestamp + elapsed - p.Timestamp
+		w.seqOffset = w.lastSequence + 1 - p.SequenceNumber
+		w.resumed = false
+	}
+	p.Timestamp += w.tsOffset
+	p.SequenceNumber += w.seqOffset
+
+	w.started = true
+	w.lastTimestamp = p.Timestamp
+	w.lastSequence = p.SequenceNumber
+	w.lastReceived = now
+}
@@ -124,6 +124,110 @@ func TestWritePacketsWithoutSampleBuffer(t *testing.T) {
 	}
 }
 
+func TestStatsCountBytesWritten(t *testing.T) {
+	codec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP8,
+			Channels: 1,
+		},
+	}
+	sink := NewBufferSink("test")
+	tr, _ := NewWith(codec, sink)
+	rec := promoteRecorder(tr)
+	rec.sb = nil
+
+	// IVF writer has already written the file header
+	header := tr.Stats().Bytes
+	require.NotZero(t, header)
+
+	// Single packet keyframe
+	packet := mockPacket(0, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a})
+	packet.Marker = true
+	err := rec.writeToSink(packet)
+	require.NoError(t, err)
+	require.Greater(t, tr.Stats().Bytes, header)
+}
+
+func TestRotateAtKeyframe(t *testing.T) {
+	codec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP8,
+		},
+	}
+	sink := NewBufferSink("first")
+	tr, _ := NewWith(codec, sink)
+	rec := promoteRecorder(tr)
+	rec.sb = nil
+
+	next := NewBufferSink("second")
+	var previous Sink
+	tr.Rotate(next, func(p Sink) {
+		previous = p
+	})
+
+	// Interframes are written to the current sink
+	interframe := mockPacket(0, []byte{0x10, 0x03, 0x00, 0x9d, 0x01, 0x2a})
+	interframe.Marker = true
+	require.NoError(t, rec.writeToSink(interframe))
+	require.Nil(t, previous)
+	require.Equal(t, sink, tr.Sink())
+
+	// The next keyframe goes to the next sink
+	keyframe := mockPacket(1, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a})
+	keyframe.Marker = true
+	require.NoError(t, rec.writeToSink(keyframe))
+	require.Equal(t, sink, previous)
+	require.Equal(t, next, tr.Sink())
+}
+
+func TestRotateAudioRightAway(t *testing.T) {
+	codec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeOpus,
+			Channels: 2,
+		},
+	}
+	sink := NewBufferSink("first")
+	tr, _ := NewWith(codec, sink)
+
+	next := NewBufferSink("second")
+	var previous Sink
+	tr.Rotate(next, func(p Sink) {
+		previous = p
+	})
+	require.Equal(t, sink, previous)
+	require.Equal(t, next, tr.Sink())
+}
+
+func TestStopCancelsRotation(t *testing.T) {
+	codec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP8,
+		},
+	}
+	sink := NewBufferSink("first")
+	tr, _ := NewWith(codec, sink)
+	rec := promoteRecorder(tr)
+	rec.cancel = func() {}
+	rec.done = make(chan struct{})
+	close(rec.done)
+
+	cancelled := false
+	tr.Rotate(NewBufferSink("second"), func(p Sink) {
+		cancelled = p == nil
+	})
+	tr.Stop()
+	require.True(t, cancelled)
+	require.Equal(t, sink, tr.Sink())
+
+	// Rotating a stopped recorder is cancelled right away
+	cancelled = false
+	tr.Rotate(NewBufferSink("third"), func(p Sink) {
+		cancelled = p == nil
+	})
+	require.True(t, cancelled)
+}
+
 func TestSinkEquality(t *testing.T) {
 	codec := webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -273,3 +377,38 @@ func TestRecorderUsageScenario(t *testing.T) {
 	// Remember to remove video file afterwards
 	os.Remove(participantID + "-video.ivf")
 }
+
+func TestRewriterKeepsFirstTrackUnchanged(t *testing.T) {
+	w := packetRewriter{clockRate: 90000}
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 1000}}
+	w.rewrite(p)
+	require.Equal(t, uint16(10), p.SequenceNumber)
+	require.Equal(t, uint32(1000), p.Timestamp)
+}
+
+func TestRewriterContinuesAfterResume(t *testing.T) {
+	w := packetRewriter{clockRate: 90000}
+	w.rewrite(&rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 1000}})
+
+	// Resumed track starts from arbitrary values
+	w.resume()
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 60000, Timestamp: 4000000000}}
+	w.rewrite(p)
+	require.Equal(t, uint16(11), p.SequenceNumber)
+	require.GreaterOrEqual(t, p.Timestamp, uint32(1000))
+
+	// Following packets keep the same offset
+	next := &rtp.Packet{Header: rtp.Header{SequenceNumber: 60001, Timestamp: 4000003000}}
+	w.rewrite(next)
+	require.Equal(t, uint16(12), next.SequenceNumber)
+	require.Equal(t, p.Timestamp+3000, next.Timestamp)
+}
+
+func TestRewriterResumeBeforeStartIsNoop(t *testing.T) {
+	w := packetRewriter{clockRate: 48000}
+	w.resume()
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 5, Timestamp: 500}}
+	w.rewrite(p)
+	require.Equal(t, uint16(5), p.SequenceNumber)
+	require.Equal(t, uint32(500), p.Timestamp)
+}
@@ -2,8 +2,10 @@ package recorder
 
 import (
 	"bufio"
+	"errors"
 	"os"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/labstack/gommon/log"
 	"github.com/pion/transport/packetio"
 )
@@ -75,3 +77,46 @@ func (s *bufferSink) Write(p []byte) (int, error) {
 func (s *bufferSink) Close() error {
 	return s.buffer.Close()
 }
+
+var ErrSinkNotReadable = errors.New("encrypted sink cannot be read")
+
+// EncryptedSink encrypts what is written before it reaches the sink it wraps
+type EncryptedSink struct {
+	sink Sink
+	w    *crypt.Writer
+}
+
+func NewEncryptedSink(sink Sink, key *crypt.DataKey) (*EncryptedSink, error) {
+	w, err := crypt.NewWriter(sink, key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedSink{sink, w}, nil
+}
+
+func (s *EncryptedSink) Name() string {
+	return s.sink.Name()
+}
+
+func (s *EncryptedSink) Read([]byte) (int, error) {
+	return 0, ErrSinkNotReadable
+}
+
+func (s *EncryptedSink) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+// Close writes the last chunk, then closes the wrapped sink either way. Without the last chunk the file can't be
+// decrypted, so its error comes first.
+func (s *EncryptedSink) Close() error {
+	err := s.w.Close()
+	if closeErr := s.sink.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Unwrap returns the sink written to
+func (s *EncryptedSink) Unwrap() Sink {
+	return s.sink
+}
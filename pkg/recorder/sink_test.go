@@ -1,9 +1,13 @@
 package recorder
 
 import (
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,3 +71,64 @@ func TestReadBufferSink(t *testing.T) {
 	require.Equal(t, 3, n)
 	require.Equal(t, "cgc", string(r))
 }
+
+func TestEncryptedSink(t *testing.T) {
+	master, err := crypt.ParseMasterKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	require.NoError(t, err)
+	key, err := crypt.NewDataKey(master)
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "testing.txt")
+	file, _ := NewFileSink(filename)
+	sink, err := NewEncryptedSink(file, key)
+	require.NoError(t, err)
+	require.Equal(t, filename, sink.Name())
+	require.Equal(t, file, sink.Unwrap())
+
+	_, err = sink.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	encrypted, err := os.Open(filename)
+	require.NoError(t, err)
+	defer encrypted.Close()
+	r, err := crypt.NewReader(encrypted, master)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(data))
+}
+
+// failingSink accepts the header of encrypted files, then fails
+type failingSink struct {
+	writes int
+	closed bool
+}
+
+func (s *failingSink) Name() string             { return "failing" }
+func (s *failingSink) Read([]byte) (int, error) { return 0, io.EOF }
+func (s *failingSink) Close() error             { s.closed = true; return nil }
+func (s *failingSink) Write(b []byte) (int, error) {
+	s.writes++
+	if s.writes > 1 {
+		return 0, errors.New("disk full")
+	}
+	return len(b), nil
+}
+
+func TestEncryptedSinkCloseError(t *testing.T) {
+	master, err := crypt.ParseMasterKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	require.NoError(t, err)
+	key, err := crypt.NewDataKey(master)
+	require.NoError(t, err)
+
+	file := &failingSink{}
+	sink, err := NewEncryptedSink(file, key)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("Hello"))
+	require.NoError(t, err)
+
+	// The last chunk can't be written, yet the sink is still closed
+	require.Error(t, sink.Close())
+	require.True(t, file.closed)
+}
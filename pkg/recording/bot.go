@@ -1,72 +1,431 @@
 package recording
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
 	"github.com/labstack/gommon/log"
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/utils"
 	lksdk "github.com/livekit/server-sdk-go"
 	"github.com/pion/webrtc/v3"
 )
 
 type bot struct {
 	// ID is mainly for internal use
-	id string
+	id  string
+	url string
 
 	// States
-	lock     sync.Mutex
-	room     *lksdk.Room
-	uploader upload.Uploader
+	lock         sync.Mutex
+	room         *lksdk.Room
+	ctx          context.Context
+	uploader     upload.Uploader
+	uploads      *upload.Queue
+	streamer     *upload.Streamer
+	encryption   crypt.Wrapper
+	policy       upload.HTTPPolicy
+	reconnecting bool
+	closed       bool
+	done         chan struct{}
 
-	// Key: identity
-	pending map[string]ParticipantRequest
+	// Set while the whole room is recorded
+	roomRecording *roomRecording
 
 	// Key: identity
-	participants map[string]participant.Participant
+	subjects map[string]*subject
 
 	callback botCallback
 }
 
+// subject keeps track of a participant requested to be recorded, for as long as the request lasts
+type subject struct {
+	request ParticipantRequest
+
+	// Tracks we asked to subscribe to. Key: track SID
+	subscriptions map[string]lksdk.TrackKind
+
+	// Tracks which have been subscribed. Key: track SID
+	tracks map[string]*webrtc.TrackRemote
+
+	// Tracks registered with the current recording. Key: track SID
+	recorded map[string]bool
+
+	// Current recording, nil if there is none
+	participant participant.Participant
+
+	// The upload URL of the request took its recording, so the request ends with it
+	uploaded bool
+
+	// Requested by the whole room recording, which reports and stops it. Cleared by a request of its own.
+	room bool
+}
+
 type botCallback struct {
-	SendRecordingData func(p participant.ParticipantData)
+	OnRecordingStarted      func(p participant.ParticipantData)
+	OnRecordingFinished     func(p participant.ParticipantData)
+	OnRoomRecordingFinished func(r RoomRecordingData)
+
+	// CreateToken mints a fresh token each time the bot joins the room
+	CreateToken func() (string, error)
+
+	// IsPresent asks the server whether the bot is still in the room
+	IsPresent func() (bool, error)
+
+	// OnClosed is called when the bot gives up reconnecting
+	OnClosed func(b *bot)
+
+	// AddRoomParticipants is called when participants may need to be added to the room recording, so the service
+	// checks its capacity before each of them. It takes the lock of the bot, so must be called without it.
+	AddRoomParticipants func(b *bot)
 }
 
-func createBot(id string, url string, token string, callback botCallback) (*bot, error) {
+const (
+	reconnectAttempts   = 10
+	reconnectMaxBackoff = 30 * time.Second
+	watchdogInterval    = 30 * time.Second
+	monitorInterval     = time.Second
+)
+
+func createBot(id string, url string, callback botCallback) (*bot, error) {
 	b := &bot{
-		id:           id,
-		lock:         sync.Mutex{},
-		pending:      make(map[string]ParticipantRequest),
-		participants: make(map[string]participant.Participant),
-		callback:     callback,
+		id:       id,
+		url:      url,
+		lock:     sync.Mutex{},
+		subjects: make(map[string]*subject),
+		callback: callback,
+		done:     make(chan struct{}),
 	}
 
-	room, err := lksdk.ConnectToRoomWithToken(url, token, lksdk.WithAutoSubscribe(false))
+	room, err := b.join()
 	if err != nil {
 		return nil, err
 	}
-
-	room.Callback.OnTrackSubscribed = b.OnTrackSubscribed
-	room.Callback.OnTrackUnsubscribed = b.OnTrackUnsubscribed
 	b.room = room
 
+	go b.watchdog()
+	go b.monitorRecordings()
 	return b, nil
 }
 
+// join connects to the room with a fresh token
+func (b *bot) join() (*lksdk.Room, error) {
+	token, err := b.callback.CreateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Set callbacks before joining so no event is missed. Events from previous connections are ignored
+	room := lksdk.CreateRoom()
+	current := func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return b.room == room && !b.reconnecting
+	}
+	room.Callback.OnDisconnected = func() {
+		if current() {
+			go b.reconnect()
+		}
+	}
+	room.Callback.OnParticipantConnected = func(rp *lksdk.RemoteParticipant) {
+		if current() {
+			b.OnParticipantConnected(rp)
+		}
+	}
+	room.Callback.OnParticipantDisconnected = func(rp *lksdk.RemoteParticipant) {
+		if current() {
+			b.OnParticipantDisconnected(rp)
+		}
+	}
+	room.Callback.OnTrackPublished = func(pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if current() {
+			b.OnTrackPublished(pub, rp)
+		}
+	}
+	room.Callback.OnTrackSubscribed = func(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if current() {
+			b.OnTrackSubscribed(track, pub, rp)
+		}
+	}
+	room.Callback.OnTrackUnsubscribed = func(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if current() {
+			b.OnTrackUnsubscribed(track, pub, rp)
+		}
+	}
+
+	if err = room.JoinWithToken(b.url, token, lksdk.WithAutoSubscribe(false)); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// watchdog detects connections lost without the room noticing, e.g. when only the signal connection drops
+func (b *bot) watchdog() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.lock.Lock()
+			reconnecting := b.reconnecting
+			b.lock.Unlock()
+			if reconnecting {
+				continue
+			}
+
+			present, err := b.callback.IsPresent()
+			if err != nil {
+				log.Warnf("cannot check bot presence | error: %v, bot: %s", err, b.id)
+				continue
+			}
+			if !present {
+				log.Warnf("bot is no longer in the room | bot: %s", b.id)
+				go b.reconnect()
+			}
+		}
+	}
+}
+
+// monitorRecordings periodically enforces the limits and rotation of each request
+func (b *bot) monitorRecordings() {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.checkRecordings(time.Now())
+		}
+	}
+}
+
+func (b *bot) checkRecordings(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Recordings are interrupted while reconnecting, wait until they resume
+	if b.reconnecting || b.closed {
+		return
+	}
+
+	for identity, s := range b.subjects {
+		if s.participant == nil {
+			continue
+		}
+		reason, exceeded := s.request.Limits.exceeded(s.participant.GetData(), now)
+		if !exceeded {
+			s.participant.RotateIfDue(now)
+			continue
+		}
+		log.Infof("recording limit reached | participant: %s, reason: %s, action: %s", identity, reason, s.request.Limits.OnLimit)
+
+		if s.request.Limits.OnLimit != LimitRollover {
+			b.removeSubject(identity, reason)
+			continue
+		}
+
+		// Roll over to a new recording of the same tracks, which needs a keyframe to start
+		b.finishRecording(identity, reason)
+		rp := b.findParticipant(identity)
+		if rp == nil {
+			continue
+		}
+		b.updateRecording(s, rp)
+		for _, track := range s.tracks {
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				rp.WritePLI(track.SSRC())
+			}
+		}
+	}
+}
+
+// reconnect joins the room again and resumes ongoing recordings. The time spent reconnecting is recorded as a gap.
+func (b *bot) reconnect() {
+	b.lock.Lock()
+	if b.closed || b.reconnecting {
+		b.lock.Unlock()
+		return
+	}
+	b.reconnecting = true
+	for _, s := range b.subjects {
+		if s.participant != nil {
+			s.participant.Interrupt()
+		}
+	}
+	previous := b.room
+	b.lock.Unlock()
+
+	log.Warnf("bot disconnected, reconnecting | bot: %s, room: %s", b.id, previous.Name)
+	previous.Disconnect()
+
+	backoff := time.Second
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		room, err := b.join()
+		if err == nil {
+			b.resume(room)
+			log.Infof("bot reconnected | bot: %s, room: %s, attempt: %d", b.id, room.Name, attempt)
+			return
+		}
+		log.Errorf("cannot reconnect bot | error: %v, bot: %s, attempt: %d", err, b.id, attempt)
+
+		// Stop trying if the bot was closed in the meantime
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+
+	log.Errorf("giving up reconnecting bot | bot: %s", b.id)
+	b.disconnect()
+	b.callback.OnClosed(b)
+}
+
+// resume switches to the new connection and subscribes again to the requested tracks
+func (b *bot) resume(room *lksdk.Room) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		room.Disconnect()
+		return
+	}
+	b.room = room
+	b.reconnecting = false
+
+	for identity, s := range b.subjects {
+		// Subscriptions belong to the previous connection. Tracks being recorded are resumed once subscribed again.
+		s.subscriptions = make(map[string]lksdk.TrackKind)
+		s.tracks = make(map[string]*webrtc.TrackRemote)
+
+		rp := b.findParticipant(identity)
+		if rp == nil {
+			// Participant left while we were away
+			b.finishRecording(identity, participant.EndReasonParticipantLeft)
+			delete(b.subjects, identity)
+			continue
+		}
+		b.subscribeToTracks(rp)
+	}
+
+	// Pick up participants who joined while we were away
+	if b.roomRecording != nil {
+		go b.callback.AddRoomParticipants(b)
+	}
+}
+
 type ParticipantRequest struct {
+	ID       string
 	Identity string
 	Profile  MediaProfile
+
+	// Only tracks from these sources are recorded, any source if empty
+	Sources []livekit.TrackSource
+
+	Limits   Limits
+	Rotation participant.Rotation
+	Priority int
+
+	// Optional, replaces the uploader of the bot for a single recording
+	Upload *upload.HTTPTarget
+}
+
+func (r ParticipantRequest) wants(pub *lksdk.RemoteTrackPublication) bool {
+	if !r.Profile.Wants(pub.Kind()) {
+		return false
+	}
+	if len(r.Sources) == 0 {
+		return true
+	}
+	for _, source := range r.Sources {
+		if pub.Source() == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bot) pushParticipantRequest(req ParticipantRequest) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.addRequest(req)
 }
 
-func (b *bot) pushParticipantRequest(identity string, profile MediaProfile) {
+// addRequest registers a participant to be recorded. Must hold the lock.
+func (b *bot) addRequest(req ParticipantRequest) {
+	if s, found := b.subjects[req.Identity]; found {
+		// Keep the ongoing recording, only update what is recorded next
+		s.request.Profile = req.Profile
+		s.request.Sources = mergeSources(s.request.Sources, req.Sources)
+		s.request.Limits = req.Limits
+		s.request.Rotation = req.Rotation
+		s.request.Priority = req.Priority
+		s.request.Upload = req.Upload
+		s.uploaded = false
+		s.room = false
+	} else {
+		b.subjects[req.Identity] = &subject{
+			request:       req,
+			subscriptions: make(map[string]lksdk.TrackKind),
+			tracks:        make(map[string]*webrtc.TrackRemote),
+			recorded:      make(map[string]bool),
+		}
+	}
+	log.Debugf("pushed participant request | id: %s, participant: %s, profile: %v, sources: %v", req.ID, req.Identity, req.Profile, req.Sources)
+
+	// Subscribe to tracks already published. Later ones are handled by OnTrackPublished
+	if rp := b.findParticipant(req.Identity); rp != nil {
+		b.subscribeToTracks(rp)
+	}
+}
+
+// keepsRecording returns true if the participant already has a request covering the sources, which is then left as
+// it is. A request of its own still takes a participant out of the room recording.
+func (b *bot) keepsRecording(identity string, sources []livekit.TrackSource) bool {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.pending[identity] = ParticipantRequest{
-		Identity: identity,
-		Profile:  profile,
+	s, found := b.subjects[identity]
+	if !found || s.room {
+		return false
+	}
+	return len(mergeSources(s.request.Sources, sources)) == len(s.request.Sources)
+}
+
+// mergeSources combines the sources of two requests, where no sources means any source
+func mergeSources(a []livekit.TrackSource, b []livekit.TrackSource) []livekit.TrackSource {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	merged := append([]livekit.TrackSource{}, a...)
+	for _, source := range b {
+		found := false
+		for _, existing := range merged {
+			found = found || existing == source
+		}
+		if !found {
+			merged = append(merged, source)
+		}
 	}
-	log.Debugf("pushed participant request | participant: %s, profile: %v", identity, profile)
+	return merged
+}
+
+func (b *bot) SetContext(ctx context.Context) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ctx = ctx
 }
 
 func (b *bot) SetUploader(uploader upload.Uploader) {
@@ -75,102 +434,382 @@ func (b *bot) SetUploader(uploader upload.Uploader) {
 	b.uploader = uploader
 }
 
+func (b *bot) SetUploadQueue(q *upload.Queue) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.uploads = q
+}
+
+func (b *bot) SetStreamer(streamer *upload.Streamer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.streamer = streamer
+}
+
+func (b *bot) SetEncryption(w crypt.Wrapper) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.encryption = w
+}
+
+func (b *bot) SetUploadPolicy(policy upload.HTTPPolicy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.policy = policy
+}
+
+func (b *bot) list() []participant.ParticipantData {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	recordings := []participant.ParticipantData{}
+	for _, s := range b.subjects {
+		if s.participant != nil {
+			recordings = append(recordings, s.participant.GetData())
+			continue
+		}
+		recordings = append(recordings, participant.ParticipantData{
+			ID:       s.request.ID,
+			Room:     b.room.Name,
+			Identity: s.request.Identity,
+			Status:   participant.StatusPending,
+		})
+	}
+	return recordings
+}
+
+// trackCount returns how many tracks the bot subscribes to for recordings, including those not subscribed yet
+// so that participants added at once are all counted
+func (b *bot) trackCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	count := 0
+	for _, s := range b.subjects {
+		count += len(s.subscriptions)
+	}
+	return count
+}
+
+func (b *bot) findParticipant(identity string) *lksdk.RemoteParticipant {
+	for _, rp := range b.room.GetParticipants() {
+		if rp.Identity() == identity {
+			return rp
+		}
+	}
+	return nil
+}
+
+// subscribeToTracks subscribes to the participant's tracks wanted by the request. Must hold the lock.
+func (b *bot) subscribeToTracks(rp *lksdk.RemoteParticipant) {
+	for _, pub := range rp.Tracks() {
+		if rpub, ok := pub.(*lksdk.RemoteTrackPublication); ok {
+			b.subscribeToTrack(rpub, rp)
+		}
+	}
+}
+
+// subscribeToTrack subscribes to a single track if the request wants it. Must hold the lock.
+func (b *bot) subscribeToTrack(pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+	s, found := b.subjects[rp.Identity()]
+	if !found || !s.request.wants(pub) {
+		return
+	}
+
+	// Only one track per kind can be recorded
+	for sid, kind := range s.subscriptions {
+		if kind == pub.Kind() || sid == pub.SID() {
+			return
+		}
+	}
+
+	if err := pub.SetSubscribed(true); err != nil {
+		log.Errorf("cannot subscribe to track | error: %v, participant: %s, track: %s", err, rp.Identity(), pub.SID())
+		return
+	}
+	s.subscriptions[pub.SID()] = pub.Kind()
+	log.Debugf("subscribed to track | participant: %s, track: %s, kind: %s", rp.Identity(), pub.SID(), pub.Kind())
+}
+
+func (b *bot) OnParticipantConnected(rp *lksdk.RemoteParticipant) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Everyone joining is recorded while the whole room is, if there is capacity
+	if b.roomRecording != nil && !IsBot(rp.Identity()) {
+		if _, found := b.subjects[rp.Identity()]; !found {
+			go b.callback.AddRoomParticipants(b)
+			return
+		}
+	}
+	b.subscribeToTracks(rp)
+}
+
+func (b *bot) OnParticipantDisconnected(rp *lksdk.RemoteParticipant) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// The request ends with the participant
+	b.finishRecording(rp.Identity(), participant.EndReasonParticipantLeft)
+	delete(b.subjects, rp.Identity())
+}
+
+func (b *bot) OnTrackPublished(publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribeToTrack(publication, rp)
+}
+
 func (b *bot) OnTrackSubscribed(track *webrtc.TrackRemote, publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
 	// Check if recorder needs to handle this participant
-	_, found := b.pending[rp.Identity()]
+	s, found := b.subjects[rp.Identity()]
 	if !found {
 		log.Warnf("request not found for participant | participant: %s, codec: %s", rp.Identity(), track.Codec().MimeType)
 		return
 	}
-	req := b.pending[rp.Identity()]
+	s.subscriptions[publication.SID()] = publication.Kind()
+	s.tracks[publication.SID()] = track
+	log.Debugf("track subscribed | participant: %s, track: %s, type: %s, codec: %s", rp.Identity(), publication.SID(), track.Kind().String(), track.Codec().MimeType)
+
+	// Continue the ongoing recording if the track was recorded before reconnecting
+	if s.recorded[publication.SID()] && s.participant != nil {
+		if err := s.participant.Resume(track); err != nil {
+			log.Errorf("cannot resume recording | error: %v, participant: %s, track: %s", err, rp.Identity(), publication.SID())
+		} else {
+			log.Infof("resumed recording | participant: %s, track: %s", rp.Identity(), publication.SID())
+		}
+		return
+	}
+
+	b.updateRecording(s, rp)
+}
+
+// updateRecording registers subscribed tracks and starts recording once the request is satisfied. Must hold the lock.
+func (b *bot) updateRecording(s *subject, rp *lksdk.RemoteParticipant) {
+	// A track of a new kind can't be added to an ongoing recording, start a new one with all tracks
+	if s.participant != nil && s.participant.GetData().Status == participant.StatusRecording {
+		for sid, track := range s.tracks {
+			if s.recorded[sid] {
+				continue
+			}
+			if (track.Kind() == webrtc.RTPCodecTypeVideo && !s.participant.IsVideoRecordable()) ||
+				(track.Kind() == webrtc.RTPCodecTypeAudio && !s.participant.IsAudioRecordable()) {
+				log.Infof("new track published, restarting recording | participant: %s, track: %s", rp.Identity(), sid)
+				b.finishRecording(rp.Identity(), participant.EndReasonTrackAdded)
+				break
+			}
+		}
+	}
+
+	// An upload URL takes a single recording, e.g. not the one after a new kind of track or a limit
+	if s.participant == nil && s.uploaded {
+		log.Infof("upload URL already used, ending request | participant: %s", rp.Identity())
+		b.removeSubject(rp.Identity(), participant.EndReasonStopped)
+		return
+	}
 
 	// Retrieve the participant. If they don't exist yet, create a new entry
-	_, found = b.participants[req.Identity]
-	if !found {
-		b.participants[req.Identity] = participant.NewParticipant(req.Identity, b.uploader, rp.WritePLI)
+	if s.participant == nil {
+		uploader, streamer := b.uploader, b.streamer
+		if s.request.Upload != nil {
+			var err error
+			if uploader, err = upload.NewHTTPUploader(*s.request.Upload, b.policy); err != nil {
+				log.Errorf("cannot upload to URL, ending request | error: %v, participant: %s", err, rp.Identity())
+				b.removeSubject(rp.Identity(), participant.EndReasonStopped)
+				return
+			}
+			streamer = nil
+			s.uploaded = true
+		}
+
+		// Each recording has its own data key. Nothing is recorded without one, rather than in clear.
+		var key *crypt.DataKey
+		if b.encryption != nil {
+			var err error
+			if key, err = crypt.NewDataKey(b.encryption); err != nil {
+				log.Errorf("cannot create data key | error: %v, participant: %s", err, rp.Identity())
+				return
+			}
+		}
+		s.participant = participant.NewParticipant(s.request.ID, b.room.Name, s.request.Identity, rp.WritePLI, participant.Options{
+			Context:    b.ctx,
+			Uploader:   uploader,
+			Uploads:    b.uploads,
+			Streamer:   streamer,
+			Rotation:   s.request.Rotation,
+			Encryption: key,
+			Priority:   s.request.Priority,
+		})
+	}
+	p := s.participant
+	if p.GetData().Status != participant.StatusPending {
+		return
 	}
-	p := b.participants[req.Identity]
 
 	// Register tracks
-	if track.Kind() == webrtc.RTPCodecTypeVideo {
-		if err := p.RegisterVideo(track); err != nil {
-			log.Errorf("cannot register video | error: %v, participant: %s, track: %s, type: %s, codec: %s", err, rp.Identity(), publication.SID(), track.Kind().String(), track.Codec().MimeType)
-			return
+	for sid, track := range s.tracks {
+		if s.recorded[sid] {
+			continue
 		}
-		log.Infof("registered video | participant: %s, track: %s, type: %s, codec: %s", rp.Identity(), publication.SID(), track.Kind().String(), track.Codec().MimeType)
-	}
-	if track.Kind() == webrtc.RTPCodecTypeAudio {
-		if err := p.RegisterAudio(track); err != nil {
-			log.Errorf("cannot register audio | error: %v, participant: %s, track: %s, type: %s, codec: %s", err, rp.Identity(), publication.SID(), track.Kind().String(), track.Codec().MimeType)
-			return
+		if track.Kind() == webrtc.RTPCodecTypeVideo && !p.IsVideoRecordable() {
+			if err := p.RegisterVideo(track); err != nil {
+				log.Errorf("cannot register video | error: %v, participant: %s, track: %s, type: %s, codec: %s", err, rp.Identity(), sid, track.Kind().String(), track.Codec().MimeType)
+				continue
+			}
+			s.recorded[sid] = true
+			log.Infof("registered video | participant: %s, track: %s, type: %s, codec: %s", rp.Identity(), sid, track.Kind().String(), track.Codec().MimeType)
+		}
+		if track.Kind() == webrtc.RTPCodecTypeAudio && !p.IsAudioRecordable() {
+			if err := p.RegisterAudio(track); err != nil {
+				log.Errorf("cannot register audio | error: %v, participant: %s, track: %s, type: %s, codec: %s", err, rp.Identity(), sid, track.Kind().String(), track.Codec().MimeType)
+				continue
+			}
+			s.recorded[sid] = true
+			log.Infof("registered audio | participant: %s, track: %s, type: %s, codec: %s", rp.Identity(), sid, track.Kind().String(), track.Codec().MimeType)
 		}
-		log.Infof("registered audio | participant: %s, track: %s, type: %s, codec: %s", rp.Identity(), publication.SID(), track.Kind().String(), track.Codec().MimeType)
 	}
 
 	// Decide if we need to start recording or wait.
 	var canStartRecording = false
-	switch req.Profile {
+	switch s.request.Profile {
 	case MediaAudioOnly:
-		if p.IsAudioRecordable() {
-			canStartRecording = true
-		}
+		canStartRecording = p.IsAudioRecordable()
 	case MediaVideoOnly:
-		if p.IsVideoRecordable() {
-			canStartRecording = true
-		}
+		canStartRecording = p.IsVideoRecordable()
 	case MediaMuxedAV:
-		if p.IsVideoRecordable() && p.IsAudioRecordable() {
-			canStartRecording = true
+		canStartRecording = p.IsVideoRecordable() && p.IsAudioRecordable()
+	case MediaAuto:
+		// Wait for every kind the participant currently publishes
+		canStartRecording = p.IsVideoRecordable() || p.IsAudioRecordable()
+		for _, pub := range rp.Tracks() {
+			if pub.Kind() == lksdk.TrackKindVideo && !p.IsVideoRecordable() {
+				canStartRecording = false
+			}
+			if pub.Kind() == lksdk.TrackKindAudio && !p.IsAudioRecordable() {
+				canStartRecording = false
+			}
 		}
 	}
 
 	// Start recording if allowed
 	if canStartRecording {
 		p.Start()
+		go b.callback.OnRecordingStarted(p.GetData())
 		log.Debugf("started recording | participant: %s", rp.Identity())
-
-		delete(b.pending, req.Identity)
-		log.Debugf("removed participant request | participant: %s", rp.Identity())
 	}
 }
 
 func (b *bot) OnTrackUnsubscribed(track *webrtc.TrackRemote, publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
-	// Stop recording: ignore recording as the only error is from updating subscription.
-	// In this method, it will always be true as participant has left
-	b.stopRecording(rp.Identity())
-	log.Debugf("stopped recording | participant: %s, type: %s, codec: %v", rp.Identity(), track.Kind().String(), track.Codec().MimeType)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s, found := b.subjects[rp.Identity()]
+	if !found {
+		return
+	}
+	delete(s.subscriptions, publication.SID())
+	delete(s.tracks, publication.SID())
+
+	// Stop recording if the track was being recorded, then wait for the participant to publish again
+	if s.recorded[publication.SID()] {
+		b.finishRecording(rp.Identity(), participant.EndReasonTrackUnpublished)
+		log.Debugf("stopped recording | participant: %s, type: %s, codec: %v", rp.Identity(), track.Kind().String(), track.Codec().MimeType)
+	}
+
+	// Remaining tracks may be enough for a new recording
+	if len(s.tracks) > 0 {
+		b.updateRecording(s, rp)
+	}
+}
+
+// finishRecording stops the current recording of a participant, if any. The request is kept. Must hold the lock.
+func (b *bot) finishRecording(identity string, reason participant.EndReason) {
+	// Check that the participant exists
+	s, found := b.subjects[identity]
+	if !found || s.participant == nil {
+		return
+	}
+
+	// Retrieve the participant and stop recording. Pending recordings have nothing to report
+	p := s.participant
+	if p.GetData().Status == participant.StatusPending {
+		p.Discard()
+		// Nothing was sent to the upload URL
+		s.uploaded = false
+	} else {
+		p.Stop(reason)
+
+		// Report the finished recording (in background)
+		data := p.GetData()
+		go b.callback.OnRecordingFinished(data)
+
+		if b.roomRecording != nil && s.room {
+			b.roomRecording.data.Participants = append(b.roomRecording.data.Participants, data)
+		}
+	}
+
+	// Next recording for the same request gets its own ID
+	s.participant = nil
+	s.recorded = make(map[string]bool)
+	s.request.ID = utils.NewGuid("RC_")
 }
 
-func (b *bot) stopRecording(identity string) {
+func (b *bot) stopRecording(identity string, reason participant.EndReason) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	b.removeSubject(identity, reason)
+}
 
+// removeSubject stops recording a participant and unsubscribes from their tracks. Must hold the lock.
+func (b *bot) removeSubject(identity string, reason participant.EndReason) {
 	// Check that the participant exists
-	_, found := b.participants[identity]
+	s, found := b.subjects[identity]
 	if !found {
 		return
 	}
 
-	// Retrieve the participant and stop recording
-	p := b.participants[identity]
-	p.Stop()
+	b.finishRecording(identity, reason)
 
-	// Send data via webhook (in background)
-	go b.callback.SendRecordingData(p.GetData())
+	// Unsubscribe from the participant's tracks
+	if rp := b.findParticipant(identity); rp != nil {
+		for _, pub := range rp.Tracks() {
+			rpub, ok := pub.(*lksdk.RemoteTrackPublication)
+			if !ok {
+				continue
+			}
+			if _, subscribed := s.subscriptions[rpub.SID()]; !subscribed {
+				continue
+			}
+			if err := rpub.SetSubscribed(false); err != nil {
+				log.Errorf("cannot unsubscribe from track | error: %v, participant: %s, track: %s", err, identity, rpub.SID())
+			}
+		}
+	}
 
 	// Remove participant before returning
-	delete(b.participants, identity)
+	delete(b.subjects, identity)
 }
 
 func (b *bot) disconnect() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	for _, p := range b.participants {
-		p.Stop()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+
+	for identity := range b.subjects {
+		b.finishRecording(identity, participant.EndReasonDisconnected)
+	}
+	b.subjects = make(map[string]*subject)
+	if b.roomRecording != nil {
+		go b.callback.OnRoomRecordingFinished(b.roomRecording.finish())
+		b.roomRecording = nil
 	}
 	b.room.Disconnect()
 }
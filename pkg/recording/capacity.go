@@ -0,0 +1,141 @@
+package recording
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/labstack/gommon/log"
+)
+
+// Capacity caps what a single instance records. Zero values are unlimited.
+type Capacity struct {
+	MaxRooms     int    `json:"maxRooms,omitempty"`
+	MaxTracks    int    `json:"maxTracks,omitempty"`
+	MaxBandwidth uint64 `json:"maxBandwidth,omitempty"` // bits per second
+}
+
+// Load is what the instance currently records, for load balancers to pick the least loaded instance
+type Load struct {
+	Rooms      int      `json:"rooms"`
+	Recordings int      `json:"recordings"`
+	Tracks     int      `json:"tracks"`
+	Bandwidth  uint64   `json:"bandwidth"` // bits per second
+	Capacity   Capacity `json:"capacity"`
+
+	// Highest share of any limit in use, from 0 to 1. Always 0 without limits.
+	Score float64 `json:"score"`
+
+	// False while the disk guard refuses new recordings, which also makes the instance unavailable
+	DiskAdmitting bool `json:"diskAdmitting"`
+	Available     bool `json:"available"`
+}
+
+// ErrAtCapacity is temporary, the request can be retried later or on another instance
+var ErrAtCapacity = errors.New("recorder is at capacity")
+
+func ratio(used uint64, max uint64) float64 {
+	if max == 0 {
+		return 0
+	}
+	return float64(used) / float64(max)
+}
+
+func (c Capacity) load(rooms int, recordings int, tracks int, bandwidth uint64) Load {
+	load := Load{
+		Rooms:      rooms,
+		Recordings: recordings,
+		Tracks:     tracks,
+		Bandwidth:  bandwidth,
+		Capacity:   c,
+	}
+	for _, r := range []float64{
+		ratio(uint64(rooms), uint64(c.MaxRooms)),
+		ratio(uint64(tracks), uint64(c.MaxTracks)),
+		ratio(bandwidth, c.MaxBandwidth),
+	} {
+		if r > load.Score {
+			load.Score = r
+		}
+	}
+	load.DiskAdmitting = true
+	load.Available = load.Score < 1
+	return load
+}
+
+// admits returns true if a recording can be added, in a new room if newRoom is set
+func (l Load) admits(newRoom bool) bool {
+	c := l.Capacity
+	if newRoom && c.MaxRooms > 0 && l.Rooms >= c.MaxRooms {
+		return false
+	}
+	if c.MaxTracks > 0 && l.Tracks >= c.MaxTracks {
+		return false
+	}
+	if c.MaxBandwidth > 0 && l.Bandwidth >= c.MaxBandwidth {
+		return false
+	}
+	return true
+}
+
+// bandwidth estimates the bitrate of a recording from its bytes so far
+func bandwidth(data participant.ParticipantData, now time.Time) uint64 {
+	elapsed := now.Sub(data.Start).Seconds()
+	if data.Status != participant.StatusRecording || elapsed < 1 {
+		return 0
+	}
+	return uint64(float64(data.Stats.Bytes*8) / elapsed)
+}
+
+func (s *service) SetCapacity(capacity Capacity) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.capacity = capacity
+}
+
+func (s *service) Load() Load {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	load := s.load(time.Now())
+	if s.guard != nil && s.guard.MinFree > 0 {
+		status, err := s.diskStatus()
+		if err != nil {
+			log.Errorf("cannot check disk | error: %v", err)
+		} else if !status.Admitting {
+			load.DiskAdmitting = false
+			load.Available = false
+		}
+	}
+	return load
+}
+
+// load must hold the lock
+func (s *service) load(now time.Time) Load {
+	var recordings, tracks int
+	var bits uint64
+	for _, b := range s.bots {
+		tracks += b.trackCount()
+		for _, r := range b.list() {
+			if r.Status == participant.StatusRecording {
+				recordings++
+			}
+			bits += bandwidth(r, now)
+		}
+	}
+	return s.capacity.load(len(s.bots), recordings, tracks, bits)
+}
+
+// reserve refuses recordings beyond the capacity of the instance. Must hold the lock.
+func (s *service) reserve(room string) error {
+	if s.capacity == (Capacity{}) {
+		return nil
+	}
+	_, found := s.bots[room]
+	load := s.load(time.Now())
+	if !load.admits(!found) {
+		log.Warnf("refusing recording, at capacity | room: %s, rooms: %d, tracks: %d, bandwidth: %d", room, load.Rooms, load.Tracks, load.Bandwidth)
+		return ErrAtCapacity
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package recording
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacityLoad(t *testing.T) {
+	capacity := Capacity{MaxRooms: 4, MaxTracks: 10, MaxBandwidth: 1000}
+
+	load := capacity.load(1, 2, 5, 250)
+	require.Equal(t, 0.5, load.Score)
+	require.True(t, load.Available)
+	require.True(t, load.admits(true))
+
+	load = capacity.load(4, 4, 8, 250)
+	require.Equal(t, 1.0, load.Score)
+	require.False(t, load.Available)
+	require.False(t, load.admits(true))
+
+	// Rooms already recorded can take more participants
+	require.True(t, load.admits(false))
+
+	require.False(t, capacity.load(1, 1, 10, 0).admits(false))
+	require.False(t, capacity.load(1, 1, 1, 1000).admits(false))
+}
+
+func TestCapacityUnlimited(t *testing.T) {
+	load := Capacity{}.load(100, 100, 1000, 1<<40)
+	require.Equal(t, 0.0, load.Score)
+	require.True(t, load.Available)
+	require.True(t, load.admits(true))
+}
+
+func TestBandwidth(t *testing.T) {
+	now := time.Now()
+	data := participant.ParticipantData{
+		Status: participant.StatusRecording,
+		Start:  now.Add(-10 * time.Second),
+		Stats:  participant.Stats{Bytes: 1000},
+	}
+	require.Equal(t, uint64(800), bandwidth(data, now))
+
+	data.Status = participant.StatusPending
+	require.Equal(t, uint64(0), bandwidth(data, now))
+}
+
+func TestServiceRefusesAtCapacity(t *testing.T) {
+	s := &service{bots: make(map[string]*bot)}
+	require.NoError(t, s.reserve("room"))
+
+	s.capacity = Capacity{MaxRooms: 1}
+	require.NoError(t, s.reserve("room"))
+
+	s.bots["other"] = &bot{subjects: make(map[string]*subject)}
+	require.ErrorIs(t, s.reserve("room"), ErrAtCapacity)
+	require.NoError(t, s.reserve("other"))
+	require.False(t, s.Load().Available)
+}
@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"encoding/json"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+)
+
+const recordingsBucket = "recordings"
+
+const errInterrupted = "recording interrupted by restart"
+
+// catalogue persists recordings so they can be listed after a restart
+type catalogue struct {
+	store *store.Store
+}
+
+func newCatalogue(st *store.Store) *catalogue {
+	return &catalogue{st}
+}
+
+func (c *catalogue) save(data participant.ParticipantData) error {
+	// Events are saved in the background, don't let a late start overwrite a finished recording
+	return c.store.Update(recordingsBucket, data.ID, func(current []byte) (interface{}, error) {
+		if current != nil && !isFinished(data) {
+			var existing participant.ParticipantData
+			if err := json.Unmarshal(current, &existing); err == nil && isFinished(existing) {
+				return nil, nil
+			}
+		}
+		return data, nil
+	})
+}
+
+func (c *catalogue) get(id string) (participant.ParticipantData, error) {
+	var data participant.ParticipantData
+	err := c.store.Get(recordingsBucket, id, &data)
+	return data, err
+}
+
+func isFinished(data participant.ParticipantData) bool {
+	return data.Status == participant.StatusDone || data.Status == participant.StatusFailed
+}
+
+func (c *catalogue) list() ([]participant.ParticipantData, error) {
+	recordings := []participant.ParticipantData{}
+	err := c.store.ForEach(recordingsBucket, func(key string, value []byte) error {
+		var data participant.ParticipantData
+		if err := json.Unmarshal(value, &data); err != nil {
+			return err
+		}
+		recordings = append(recordings, data)
+		return nil
+	})
+	return recordings, err
+}
+
+// recover marks recordings which were still running on the previous instance as failed
+func (c *catalogue) recover() error {
+	recordings, err := c.list()
+	if err != nil {
+		return err
+	}
+	for _, data := range recordings {
+		if isFinished(data) {
+			continue
+		}
+		data.Status = participant.StatusFailed
+		data.Error = errInterrupted
+		if err = c.save(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
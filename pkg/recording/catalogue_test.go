@@ -0,0 +1,65 @@
+package recording
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func openCatalogue(t *testing.T) *catalogue {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		st.Close()
+	})
+	return newCatalogue(st)
+}
+
+func TestCatalogueSaveAndList(t *testing.T) {
+	c := openCatalogue(t)
+	now := time.Now()
+
+	err := c.save(mockRecording("1", "room", "alice", participant.StatusRecording, now, time.Time{}))
+	require.NoError(t, err)
+	err = c.save(mockRecording("1", "room", "alice", participant.StatusDone, now, now))
+	require.NoError(t, err)
+
+	recordings, err := c.list()
+	require.NoError(t, err)
+	require.Len(t, recordings, 1)
+	require.Equal(t, participant.StatusDone, recordings[0].Status)
+}
+
+func TestCatalogueKeepsFinishedRecording(t *testing.T) {
+	c := openCatalogue(t)
+	now := time.Now()
+
+	c.save(mockRecording("1", "room", "alice", participant.StatusDone, now, now))
+	c.save(mockRecording("1", "room", "alice", participant.StatusRecording, now, time.Time{}))
+
+	recordings, _ := c.list()
+	require.Len(t, recordings, 1)
+	require.Equal(t, participant.StatusDone, recordings[0].Status)
+}
+
+func TestCatalogueRecoverMarksInterrupted(t *testing.T) {
+	c := openCatalogue(t)
+	now := time.Now()
+
+	c.save(mockRecording("1", "room", "alice", participant.StatusRecording, now, time.Time{}))
+	c.save(mockRecording("2", "room", "bob", participant.StatusDone, now, now))
+
+	err := c.recover()
+	require.NoError(t, err)
+
+	recordings, _ := c.list()
+	require.Len(t, recordings, 2)
+	require.Equal(t, participant.StatusFailed, recordings[0].Status)
+	require.Equal(t, errInterrupted, recordings[0].Error)
+	require.Equal(t, participant.StatusDone, recordings[1].Status)
+	require.Empty(t, recordings[1].Error)
+}
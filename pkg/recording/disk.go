@@ -0,0 +1,188 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/disk"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/labstack/gommon/log"
+)
+
+// DiskGuard protects the disk holding the recordings. Zero thresholds disable the checks.
+type DiskGuard struct {
+	Dir string
+
+	// New recordings are refused below this much free space, once ongoing recordings are accounted for
+	MinFree uint64
+
+	// Ongoing recordings are stopped below this much free space, lowest priority and oldest first
+	EmergencyFree uint64
+}
+
+type DiskStatus struct {
+	disk.Usage
+
+	// Raw bytes of ongoing recordings, which need as much space again to be containerised
+	InFlight      uint64 `json:"inFlight"`
+	MinFree       uint64 `json:"minFree"`
+	EmergencyFree uint64 `json:"emergencyFree"`
+	Admitting     bool   `json:"admitting"`
+}
+
+var ErrInsufficientStorage = errors.New("not enough free disk space to record")
+
+// How often the disk is checked for an emergency
+const diskInterval = 10 * time.Second
+
+func (g DiskGuard) status(usage disk.Usage, inFlight uint64) DiskStatus {
+	return DiskStatus{
+		Usage:         usage,
+		InFlight:      inFlight,
+		MinFree:       g.MinFree,
+		EmergencyFree: g.EmergencyFree,
+		Admitting:     g.MinFree == 0 || (usage.Free > inFlight && usage.Free-inFlight >= g.MinFree),
+	}
+}
+
+func (g DiskGuard) emergency(usage disk.Usage) bool {
+	return g.EmergencyFree > 0 && usage.Free < g.EmergencyFree
+}
+
+// inFlight sums the raw bytes of ongoing recordings
+func inFlight(recordings []participant.ParticipantData) uint64 {
+	var bytes uint64
+	for _, r := range recordings {
+		if r.Status == participant.StatusRecording {
+			bytes += r.Stats.Bytes
+		}
+	}
+	return bytes
+}
+
+// selectEvicted returns the ongoing recording to stop first in an emergency, the oldest of the lowest priority
+func selectEvicted(recordings []participant.ParticipantData) (participant.ParticipantData, bool) {
+	var evicted participant.ParticipantData
+	found := false
+	for _, r := range recordings {
+		if r.Status != participant.StatusRecording {
+			continue
+		}
+		if !found || r.Priority < evicted.Priority || (r.Priority == evicted.Priority && r.Start.Before(evicted.Start)) {
+			evicted = r
+			found = true
+		}
+	}
+	return evicted, found
+}
+
+// SetDiskGuard checks the disk before starting recordings, and watches it for an emergency until the service
+// context is cancelled
+func (s *service) SetDiskGuard(guard DiskGuard) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := s.guard == nil
+	s.guard = &guard
+	if start && guard.EmergencyFree > 0 {
+		go s.watchDisk(s.ctx)
+	}
+}
+
+func (s *service) DiskStatus() (DiskStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.diskStatus()
+}
+
+// diskStatus must hold the lock
+func (s *service) diskStatus() (DiskStatus, error) {
+	guard := DiskGuard{Dir: "."}
+	if s.guard != nil {
+		guard = *s.guard
+	}
+	usage, err := disk.Stat(guard.Dir)
+	if err != nil {
+		return DiskStatus{}, err
+	}
+	return guard.status(usage, inFlight(s.ongoingRecordings())), nil
+}
+
+// admit refuses new recordings when the disk is running out. Must hold the lock.
+func (s *service) admit() error {
+	if s.guard == nil || s.guard.MinFree == 0 {
+		return nil
+	}
+	status, err := s.diskStatus()
+	if err != nil {
+		log.Errorf("cannot check disk | error: %v", err)
+		return nil
+	}
+	if !status.Admitting {
+		log.Warnf("refusing recording, disk is running out | free: %d, inFlight: %d, minFree: %d", status.Free, status.InFlight, status.MinFree)
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// ongoingRecordings must hold the lock
+func (s *service) ongoingRecordings() []participant.ParticipantData {
+	recordings := []participant.ParticipantData{}
+	for _, b := range s.bots {
+		recordings = append(recordings, b.list()...)
+	}
+	return recordings
+}
+
+// watchDisk stops one recording at a time while the disk is below the emergency threshold,
+// so the space is measured again in between. Runs until the context is cancelled.
+func (s *service) watchDisk(ctx context.Context) {
+	ticker := time.NewTicker(diskInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b, identity, found := s.selectDiskVictim()
+		if !found {
+			continue
+		}
+
+		// Stopping waits for the recording to finish, which mustn't block the service.
+		// The raw files are kept as they are, since there is no room to containerise them.
+		b.stopRecording(identity, participant.EndReasonDiskFull)
+	}
+}
+
+// selectDiskVictim returns the bot and participant of the recording to stop, if the disk is in an emergency
+func (s *service) selectDiskVictim() (*bot, string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	guard := *s.guard
+	usage, err := disk.Stat(guard.Dir)
+	if err != nil {
+		log.Errorf("cannot check disk | error: %v", err)
+		return nil, "", false
+	}
+	if !guard.emergency(usage) {
+		return nil, "", false
+	}
+
+	evicted, found := selectEvicted(s.ongoingRecordings())
+	if !found {
+		return nil, "", false
+	}
+	b, ok := s.bots[evicted.Room]
+	if !ok {
+		return nil, "", false
+	}
+	log.Errorf("disk is almost full, stopping recording | free: %d, emergencyFree: %d, room: %s, participant: %s, priority: %d",
+		usage.Free, guard.EmergencyFree, evicted.Room, evicted.Identity, evicted.Priority)
+	return b, evicted.Identity, true
+}
@@ -0,0 +1,96 @@
+package recording
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/disk"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskGuardAdmission(t *testing.T) {
+	guard := DiskGuard{MinFree: 100}
+	usage := disk.Usage{Total: 1000, Free: 300}
+
+	require.True(t, guard.status(usage, 200).Admitting)
+	require.False(t, guard.status(usage, 201).Admitting)
+	require.False(t, guard.status(usage, 400).Admitting)
+
+	// Disabled without a threshold
+	require.True(t, DiskGuard{}.status(disk.Usage{}, 400).Admitting)
+}
+
+func TestDiskGuardEmergency(t *testing.T) {
+	guard := DiskGuard{EmergencyFree: 100}
+	require.True(t, guard.emergency(disk.Usage{Free: 99}))
+	require.False(t, guard.emergency(disk.Usage{Free: 100}))
+	require.False(t, DiskGuard{}.emergency(disk.Usage{}))
+}
+
+func TestServiceRefusesWhenDiskIsFull(t *testing.T) {
+	s := &service{bots: make(map[string]*bot)}
+	require.NoError(t, s.admit())
+	require.True(t, s.Load().Available)
+
+	s.guard = &DiskGuard{Dir: t.TempDir(), MinFree: 1 << 62}
+	require.ErrorIs(t, s.admit(), ErrInsufficientStorage)
+
+	status, err := s.DiskStatus()
+	require.NoError(t, err)
+	require.False(t, status.Admitting)
+
+	// Reported through the load, for readiness probes
+	load := s.Load()
+	require.False(t, load.DiskAdmitting)
+	require.False(t, load.Available)
+}
+
+func TestSelectEvicted(t *testing.T) {
+	now := time.Now()
+	recordings := []participant.ParticipantData{
+		{ID: "high", Status: participant.StatusRecording, Priority: 10, Start: now.Add(-time.Hour)},
+		{ID: "new", Status: participant.StatusRecording, Start: now},
+		{ID: "old", Status: participant.StatusRecording, Start: now.Add(-time.Minute)},
+		{ID: "pending", Status: participant.StatusPending, Priority: -1},
+	}
+
+	evicted, found := selectEvicted(recordings)
+	require.True(t, found)
+	require.Equal(t, "old", evicted.ID)
+	require.Equal(t, uint64(0), inFlight(recordings[3:]))
+
+	_, found = selectEvicted(recordings[3:])
+	require.False(t, found)
+}
+
+func TestSelectDiskVictim(t *testing.T) {
+	s := &service{bots: make(map[string]*bot), guard: &DiskGuard{Dir: t.TempDir(), EmergencyFree: 1}}
+	_, _, found := s.selectDiskVictim()
+	require.False(t, found)
+
+	// Nothing to stop in an emergency, and the lock is released either way
+	s.guard.EmergencyFree = 1 << 62
+	_, _, found = s.selectDiskVictim()
+	require.False(t, found)
+	_, err := s.DiskStatus()
+	require.NoError(t, err)
+}
+
+func TestWatchDiskStopsWithContext(t *testing.T) {
+	s := &service{bots: make(map[string]*bot), guard: &DiskGuard{Dir: t.TempDir(), EmergencyFree: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.watchDisk(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchDisk kept running after its context was cancelled")
+	}
+}
@@ -0,0 +1,62 @@
+package recording
+
+import (
+	"sync"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+)
+
+// Number of finished recordings kept in memory for listing
+const historySize = 100
+
+type history struct {
+	lock    sync.Mutex
+	size    int
+	entries []participant.ParticipantData
+}
+
+func newHistory(size int) *history {
+	return &history{
+		lock:    sync.Mutex{},
+		size:    size,
+		entries: []participant.ParticipantData{},
+	}
+}
+
+func (h *history) push(data participant.ParticipantData) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Drop the oldest entry once the history is full
+	if len(h.entries) >= h.size {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, data)
+}
+
+// update changes the entry with the ID, and returns it if fn did
+func (h *history) update(id string, fn func(data *participant.ParticipantData) bool) (participant.ParticipantData, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := range h.entries {
+		if h.entries[i].ID == id {
+			// Listed entries share the uploads, change a copy
+			h.entries[i].Uploads = append([]participant.FileUpload(nil), h.entries[i].Uploads...)
+			if fn(&h.entries[i]) {
+				return h.entries[i], true
+			}
+			break
+		}
+	}
+	return participant.ParticipantData{}, false
+}
+
+func (h *history) list() []participant.ParticipantData {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entries := make([]participant.ParticipantData, len(h.entries))
+	copy(entries, h.entries)
+	return entries
+}
@@ -0,0 +1,69 @@
+package recording
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+)
+
+// LimitAction decides what happens to a recording once it hits a limit
+type LimitAction string
+
+const (
+	LimitStop     LimitAction = "stop"
+	LimitRollover LimitAction = "rollover"
+
+	// LimitDefault uses the action of the service defaults, which is to stop if there is none
+	LimitDefault LimitAction = ""
+)
+
+var ErrUnknownLimitAction = errors.New("unknown limit action")
+
+func ParseLimitAction(a string) (LimitAction, error) {
+	switch a {
+	case string(LimitStop):
+		return LimitStop, nil
+	case string(LimitRollover):
+		return LimitRollover, nil
+	default:
+		return LimitDefault, ErrUnknownLimitAction
+	}
+}
+
+// Limits end a recording which runs for too long or grows too large. Zero values mean no limit.
+type Limits struct {
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+	// Bytes written to the raw media files
+	MaxSize uint64 `json:"maxSize,omitempty"`
+	// Rollover starts a new recording of the participant right away, stop ends the request
+	OnLimit LimitAction `json:"onLimit,omitempty"`
+}
+
+// withDefaults fills the limits which are not set with the defaults
+func (l Limits) withDefaults(defaults Limits) Limits {
+	if l.MaxDuration == 0 {
+		l.MaxDuration = defaults.MaxDuration
+	}
+	if l.MaxSize == 0 {
+		l.MaxSize = defaults.MaxSize
+	}
+	if l.OnLimit == LimitDefault {
+		l.OnLimit = defaults.OnLimit
+	}
+	return l
+}
+
+// exceeded returns the reason to end the recording if it is over a limit
+func (l Limits) exceeded(data participant.ParticipantData, now time.Time) (participant.EndReason, bool) {
+	if data.Status != participant.StatusRecording {
+		return "", false
+	}
+	if l.MaxDuration > 0 && now.Sub(data.Start) >= l.MaxDuration {
+		return participant.EndReasonMaxDuration, true
+	}
+	if l.MaxSize > 0 && data.Stats.Bytes >= l.MaxSize {
+		return participant.EndReasonMaxSize, true
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package recording
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimitAction(t *testing.T) {
+	action, err := ParseLimitAction("rollover")
+	require.NoError(t, err)
+	require.Equal(t, LimitRollover, action)
+
+	_, err = ParseLimitAction("pause")
+	require.ErrorIs(t, err, ErrUnknownLimitAction)
+}
+
+func TestLimitsWithDefaults(t *testing.T) {
+	defaults := Limits{MaxDuration: time.Hour, MaxSize: 1000, OnLimit: LimitRollover}
+
+	require.Equal(t, defaults, Limits{}.withDefaults(defaults))
+
+	limits := Limits{MaxDuration: time.Minute, OnLimit: LimitStop}.withDefaults(defaults)
+	require.Equal(t, Limits{MaxDuration: time.Minute, MaxSize: 1000, OnLimit: LimitStop}, limits)
+}
+
+func TestLimitsExceeded(t *testing.T) {
+	now := time.Now()
+	data := mockRecording("1", "room", "alice", participant.StatusRecording, now.Add(-time.Hour), time.Time{})
+	data.Stats.Bytes = 500
+
+	_, exceeded := Limits{}.exceeded(data, now)
+	require.False(t, exceeded)
+
+	reason, exceeded := Limits{MaxDuration: time.Hour}.exceeded(data, now)
+	require.True(t, exceeded)
+	require.Equal(t, participant.EndReasonMaxDuration, reason)
+
+	_, exceeded = Limits{MaxDuration: 2 * time.Hour, MaxSize: 501}.exceeded(data, now)
+	require.False(t, exceeded)
+
+	reason, exceeded = Limits{MaxSize: 500}.exceeded(data, now)
+	require.True(t, exceeded)
+	require.Equal(t, participant.EndReasonMaxSize, reason)
+
+	// Only ongoing recordings are limited
+	data.Status = participant.StatusPending
+	_, exceeded = Limits{MaxSize: 500}.exceeded(data, now)
+	require.False(t, exceeded)
+}
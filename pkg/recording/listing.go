@@ -0,0 +1,61 @@
+package recording
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+)
+
+// RecordingFilter narrows down recordings returned by ListRecordings. Empty fields match everything.
+type RecordingFilter struct {
+	Room        string
+	Participant string
+	Status      participant.Status
+
+	// Only recordings overlapping the time range [From, To] are matched
+	From time.Time
+	To   time.Time
+}
+
+func (f RecordingFilter) matches(data participant.ParticipantData) bool {
+	if f.Room != "" && f.Room != data.Room {
+		return false
+	}
+	if f.Participant != "" && f.Participant != data.Identity {
+		return false
+	}
+	if f.Status != "" && f.Status != data.Status {
+		return false
+	}
+
+	// Recordings which ended before the range starts are excluded. Ongoing ones have no end yet
+	if !f.From.IsZero() && !data.End.IsZero() && data.End.Before(f.From) {
+		return false
+	}
+
+	// Recordings which haven't started, or started after the range ends, are excluded
+	if !f.To.IsZero() && (data.Start.IsZero() || data.Start.After(f.To)) {
+		return false
+	}
+
+	return true
+}
+
+func filterRecordings(recordings []participant.ParticipantData, filter RecordingFilter) []participant.ParticipantData {
+	matched := []participant.ParticipantData{}
+	for _, r := range recordings {
+		if filter.matches(r) {
+			matched = append(matched, r)
+		}
+	}
+
+	// Most recent recordings first, pending ones on top
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].Start.IsZero() != matched[j].Start.IsZero() {
+			return matched[i].Start.IsZero()
+		}
+		return matched[i].Start.After(matched[j].Start)
+	})
+	return matched
+}
@@ -0,0 +1,92 @@
+package recording
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/stretchr/testify/require"
+)
+
+func mockRecording(id string, room string, identity string, status participant.Status, start time.Time, end time.Time) participant.ParticipantData {
+	return participant.ParticipantData{
+		ID:       id,
+		Room:     room,
+		Identity: identity,
+		Status:   status,
+		Start:    start,
+		End:      end,
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	h := newHistory(2)
+	h.push(mockRecording("1", "room", "a", participant.StatusDone, time.Time{}, time.Time{}))
+	h.push(mockRecording("2", "room", "b", participant.StatusDone, time.Time{}, time.Time{}))
+	h.push(mockRecording("3", "room", "c", participant.StatusDone, time.Time{}, time.Time{}))
+
+	entries := h.list()
+	require.Len(t, entries, 2)
+	require.Equal(t, "2", entries[0].ID)
+	require.Equal(t, "3", entries[1].ID)
+}
+
+func TestFilterByRoomAndParticipant(t *testing.T) {
+	recordings := []participant.ParticipantData{
+		mockRecording("1", "room-a", "alice", participant.StatusDone, time.Time{}, time.Time{}),
+		mockRecording("2", "room-a", "bob", participant.StatusDone, time.Time{}, time.Time{}),
+		mockRecording("3", "room-b", "alice", participant.StatusDone, time.Time{}, time.Time{}),
+	}
+
+	matched := filterRecordings(recordings, RecordingFilter{Room: "room-a"})
+	require.Len(t, matched, 2)
+
+	matched = filterRecordings(recordings, RecordingFilter{Room: "room-a", Participant: "alice"})
+	require.Len(t, matched, 1)
+	require.Equal(t, "1", matched[0].ID)
+}
+
+func TestFilterByStatus(t *testing.T) {
+	now := time.Now()
+	recordings := []participant.ParticipantData{
+		mockRecording("1", "room", "alice", participant.StatusPending, time.Time{}, time.Time{}),
+		mockRecording("2", "room", "bob", participant.StatusRecording, now, time.Time{}),
+		mockRecording("3", "room", "carol", participant.StatusDone, now, now),
+	}
+
+	matched := filterRecordings(recordings, RecordingFilter{Status: participant.StatusRecording})
+	require.Len(t, matched, 1)
+	require.Equal(t, "2", matched[0].ID)
+}
+
+func TestFilterByTimeRange(t *testing.T) {
+	now := time.Now()
+	recordings := []participant.ParticipantData{
+		// Finished before the range
+		mockRecording("1", "room", "alice", participant.StatusDone, now.Add(-3*time.Hour), now.Add(-2*time.Hour)),
+		// Overlaps the range
+		mockRecording("2", "room", "bob", participant.StatusDone, now.Add(-2*time.Hour), now.Add(-30*time.Minute)),
+		// Still recording
+		mockRecording("3", "room", "carol", participant.StatusRecording, now.Add(-10*time.Minute), time.Time{}),
+		// Not started yet
+		mockRecording("4", "room", "dave", participant.StatusPending, time.Time{}, time.Time{}),
+	}
+
+	matched := filterRecordings(recordings, RecordingFilter{From: now.Add(-time.Hour), To: now})
+	require.Len(t, matched, 2)
+	require.Equal(t, "3", matched[0].ID)
+	require.Equal(t, "2", matched[1].ID)
+
+	matched = filterRecordings(recordings, RecordingFilter{From: now.Add(-time.Hour)})
+	require.Len(t, matched, 3)
+	require.Equal(t, "4", matched[0].ID)
+}
+
+func TestParseStatus(t *testing.T) {
+	status, ok := participant.ParseStatus("recording")
+	require.True(t, ok)
+	require.Equal(t, participant.StatusRecording, status)
+
+	_, ok = participant.ParseStatus("unknown")
+	require.False(t, ok)
+}
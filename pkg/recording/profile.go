@@ -1,6 +1,10 @@
 package recording
 
-import "errors"
+import (
+	"errors"
+
+	lksdk "github.com/livekit/server-sdk-go"
+)
 
 type MediaProfile string
 
@@ -8,6 +12,9 @@ const (
 	MediaVideoOnly MediaProfile = "video"
 	MediaAudioOnly MediaProfile = "audio"
 	MediaMuxedAV   MediaProfile = "av"
+
+	// MediaAuto records whichever media the participant publishes
+	MediaAuto MediaProfile = ""
 )
 
 var ErrUnknownMediaProfile = errors.New("unknown media profile")
@@ -29,3 +36,15 @@ func ParseMediaProfile(p string) (MediaProfile, error) {
 
 	return profile, err
 }
+
+// Wants returns true if tracks of the given kind are recorded with this profile
+func (p MediaProfile) Wants(kind lksdk.TrackKind) bool {
+	switch kind {
+	case lksdk.TrackKindVideo:
+		return p == MediaAuto || p == MediaVideoOnly || p == MediaMuxedAV
+	case lksdk.TrackKindAudio:
+		return p == MediaAuto || p == MediaAudioOnly || p == MediaMuxedAV
+	default:
+		return false
+	}
+}
@@ -0,0 +1,28 @@
+package recording
+
+import (
+	"testing"
+
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMediaProfile(t *testing.T) {
+	profile, err := ParseMediaProfile("av")
+	require.NoError(t, err)
+	require.Equal(t, MediaMuxedAV, profile)
+
+	_, err = ParseMediaProfile("screen")
+	require.ErrorIs(t, err, ErrUnknownMediaProfile)
+}
+
+func TestProfileWantsTrackKind(t *testing.T) {
+	require.True(t, MediaAuto.Wants(lksdk.TrackKindVideo))
+	require.True(t, MediaAuto.Wants(lksdk.TrackKindAudio))
+	require.True(t, MediaMuxedAV.Wants(lksdk.TrackKindVideo))
+	require.True(t, MediaMuxedAV.Wants(lksdk.TrackKindAudio))
+	require.True(t, MediaVideoOnly.Wants(lksdk.TrackKindVideo))
+	require.False(t, MediaVideoOnly.Wants(lksdk.TrackKindAudio))
+	require.False(t, MediaAudioOnly.Wants(lksdk.TrackKindVideo))
+	require.True(t, MediaAudioOnly.Wants(lksdk.TrackKindAudio))
+}
@@ -0,0 +1,145 @@
+package recording
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/livekit/protocol/utils"
+)
+
+const botPrefix = "RB_"
+
+// IsBot returns true if the identity belongs to one of the recorder's bots
+func IsBot(identity string) bool {
+	return strings.HasPrefix(identity, botPrefix)
+}
+
+type StartRoomRecordingRequest struct {
+	Room string `json:"room"`
+
+	// Optional, records whichever media each participant publishes if empty
+	Profile MediaProfile `json:"profile,omitempty"`
+
+	// Optional, apply to the recording of each participant
+	Limits   Limits               `json:"limits"`
+	Rotation participant.Rotation `json:"rotation"`
+	Priority int                  `json:"priority,omitempty"`
+}
+
+type StopRoomRecordingRequest struct {
+	Room string `json:"room"`
+}
+
+// RoomRecordingData summarises a whole room recording, with the recordings of every participant
+type RoomRecordingData struct {
+	Room         string                        `json:"room"`
+	Start        time.Time                     `json:"start"`
+	End          time.Time                     `json:"end"`
+	Participants []participant.ParticipantData `json:"participants"`
+}
+
+var (
+	ErrRoomNotRecorded     = errors.New("room is not recorded")
+	ErrRoomAlreadyRecorded = errors.New("room is already recorded")
+)
+
+type roomRecording struct {
+	profile  MediaProfile
+	limits   Limits
+	rotation participant.Rotation
+	priority int
+	data     RoomRecordingData
+}
+
+func (r *roomRecording) finish() RoomRecordingData {
+	r.data.End = time.Now()
+	return r.data
+}
+
+func (b *bot) startRoomRecording(profile MediaProfile, limits Limits, rotation participant.Rotation, priority int) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.roomRecording != nil {
+		return ErrRoomAlreadyRecorded
+	}
+	b.roomRecording = &roomRecording{
+		profile:  profile,
+		limits:   limits,
+		rotation: rotation,
+		priority: priority,
+		data: RoomRecordingData{
+			Room:         b.room.Name,
+			Start:        time.Now(),
+			Participants: []participant.ParticipantData{},
+		},
+	}
+	return nil
+}
+
+// unrecordedParticipants lists who the room recording should record but doesn't yet. Each is added with
+// addRoomParticipant once the service checked its capacity.
+func (b *bot) unrecordedParticipants() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	identities := []string{}
+	if b.roomRecording == nil {
+		return identities
+	}
+	for _, rp := range b.room.GetParticipants() {
+		if IsBot(rp.Identity()) {
+			continue
+		}
+		if _, found := b.subjects[rp.Identity()]; found {
+			continue
+		}
+		identities = append(identities, rp.Identity())
+	}
+	return identities
+}
+
+// addRoomParticipant records a participant as part of the room recording, unless it ended or the participant is
+// already recorded meanwhile
+func (b *bot) addRoomParticipant(identity string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.roomRecording == nil {
+		return
+	}
+	if _, found := b.subjects[identity]; found {
+		return
+	}
+	b.addRequest(ParticipantRequest{
+		ID:       utils.NewGuid("RC_"),
+		Identity: identity,
+		Profile:  b.roomRecording.profile,
+		Limits:   b.roomRecording.limits,
+		Rotation: b.roomRecording.rotation,
+		Priority: b.roomRecording.priority,
+	})
+	b.subjects[identity].room = true
+}
+
+func (b *bot) stopRoomRecording() (RoomRecordingData, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.roomRecording == nil {
+		return RoomRecordingData{}, ErrRoomNotRecorded
+	}
+
+	// Recordings add themselves to the summary as they finish. Participants requested on their own keep recording.
+	for identity, s := range b.subjects {
+		if s.room {
+			b.removeSubject(identity, participant.EndReasonStopped)
+		}
+	}
+
+	data := b.roomRecording.finish()
+	b.roomRecording = nil
+	return data, nil
+}
@@ -12,29 +12,75 @@ import (
 
 	"github.com/labstack/gommon/log"
 
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
 	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
 	"github.com/livekit/protocol/livekit"
 	"github.com/livekit/protocol/utils"
 	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/twitchtv/twirp"
 )
 
 type StartRecordingRequest struct {
-	Room        string
-	Participant string
+	// Optional, generated if empty
+	ID string `json:"id,omitempty"`
+
+	Room        string `json:"room"`
+	Participant string `json:"participant"`
+
+	// Optional, records whichever media the participant publishes if empty
+	Profile MediaProfile `json:"profile,omitempty"`
+
+	// Optional, records tracks from any source if empty
+	Sources []livekit.TrackSource `json:"sources,omitempty"`
+
+	// Optional, unset values fall back to the service defaults
+	Limits   Limits               `json:"limits"`
+	Rotation participant.Rotation `json:"rotation"`
+
+	// Optional, lower priority recordings are stopped first when the disk runs out
+	Priority int `json:"priority,omitempty"`
+
+	// Optional, where the recording is sent instead of the configured uploader.
+	// It takes a single file, so the recording isn't rotated or rolled over, and the request ends with it.
+	Upload *upload.HTTPTarget `json:"upload,omitempty"`
 }
 
+var (
+	ErrRotationWithUpload = errors.New("recordings sent to an upload URL can't be rotated")
+	ErrRolloverWithUpload = errors.New("recordings sent to an upload URL can't roll over")
+)
+
 type StopRecordingRequest struct {
-	Room        string
-	Participant string
+	Room        string `json:"room"`
+	Participant string `json:"participant"`
 }
 
 type Service interface {
 	StartRecording(ctx context.Context, req StartRecordingRequest) error
 	StopRecording(ctx context.Context, req StopRecordingRequest) error
+	ListRecordings(filter RecordingFilter) []participant.ParticipantData
+	ActiveRecording(room string, identity string) (participant.ParticipantData, bool)
+	SetContext(ctx context.Context)
 	SetUploader(uploader upload.Uploader)
+	SetStreamer(streamer *upload.Streamer)
+	SetEncryption(w crypt.Wrapper)
+	SetUploadPolicy(policy upload.HTTPPolicy)
+	SetUploadQueue(q *upload.Queue)
+	SetStore(st *store.Store) error
+	SetDefaultLimits(limits Limits)
+	SetDefaultRotation(rotation participant.Rotation)
+	SetDiskGuard(guard DiskGuard)
+	DiskStatus() (DiskStatus, error)
+	SetCapacity(capacity Capacity)
+	Load() Load
 	LKRoomService() *lksdk.RoomServiceClient
 	DisconnectFrom(room string)
+
+	// Whole room recording, for every current and future participant
+	StartRoomRecording(ctx context.Context, req StartRoomRecordingRequest) error
+	StopRoomRecording(ctx context.Context, req StopRoomRecordingRequest) (RoomRecordingData, error)
 }
 
 type service struct {
@@ -42,14 +88,36 @@ type service struct {
 	url string
 
 	// State
-	lock sync.Mutex
-	bots map[string]*bot
+	ctx       context.Context
+	lock      sync.Mutex
+	bots      map[string]*bot
+	history   *history
+	catalogue *catalogue
 
 	// Services
 	auth     *authProvider
 	lksvc    *lksdk.RoomServiceClient
 	uploader upload.Uploader
+	streamer *upload.Streamer
+	uploads  *upload.Queue
+	// Wraps the data key of each recording, nil if recordings aren't encrypted
+	encryption crypt.Wrapper
+	// Where upload URLs may send recordings
+	policy   upload.HTTPPolicy
 	webhooks []string
+
+	// Orders updates of uploads with the recordings finishing, so none is missed
+	uploadLock sync.Mutex
+
+	// Applied to every request which doesn't set its own
+	limits   Limits
+	rotation participant.Rotation
+
+	// Checks the disk before recording, nil if disabled
+	guard *DiskGuard
+
+	// Unlimited if empty
+	capacity Capacity
 }
 
 func httpUrlFromWS(url string) string {
@@ -70,20 +138,86 @@ func NewService(url string, apiKey string, apiSecret string, webhooks []string)
 	lksvc := lksdk.NewRoomServiceClient(httpUrl, apiKey, apiSecret)
 	return &service{
 		url:      url,
+		ctx:      context.Background(),
 		lock:     sync.Mutex{},
 		bots:     make(map[string]*bot),
+		history:  newHistory(historySize),
 		auth:     auth,
 		lksvc:    lksvc,
 		webhooks: webhooks,
 	}, nil
 }
 
+// SetContext bounds recordings and their uploads, which are cancelled with it
+func (s *service) SetContext(ctx context.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ctx = ctx
+}
+
 func (s *service) SetUploader(uploader upload.Uploader) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.uploader = uploader
 }
 
+// SetUploadQueue uploads recordings through the queue, which retries them. Recordings are sent to the webhooks
+// again once their uploads are done or dead.
+func (s *service) SetUploadQueue(q *upload.Queue) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploads = q
+	q.SetCallback(s.uploadFinished)
+}
+
+// SetStreamer streams recordings to the bucket while they are recorded, instead of uploading them at the end
+func (s *service) SetStreamer(streamer *upload.Streamer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streamer = streamer
+}
+
+// SetUploadPolicy restricts the upload URLs of start requests, which can't reach private addresses by default
+func (s *service) SetUploadPolicy(policy upload.HTTPPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policy = policy
+}
+
+// SetEncryption encrypts recordings on disk and in the bucket, each with its own data key wrapped with w
+func (s *service) SetEncryption(w crypt.Wrapper) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.encryption = w
+}
+
+// SetStore persists recordings in st. Recordings left running by a previous instance are marked as failed.
+func (s *service) SetStore(st *store.Store) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := newCatalogue(st)
+	if err := c.recover(); err != nil {
+		return err
+	}
+	s.catalogue = c
+	return nil
+}
+
+// SetDefaultLimits applies to recordings started afterwards
+func (s *service) SetDefaultLimits(limits Limits) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.limits = limits
+}
+
+// SetDefaultRotation applies to recordings started afterwards
+func (s *service) SetDefaultRotation(rotation participant.Rotation) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rotation = rotation
+}
+
 func (s *service) LKRoomService() *lksdk.RoomServiceClient {
 	return s.lksvc
 }
@@ -102,101 +236,214 @@ func (s *service) DisconnectFrom(room string) {
 	delete(s.bots, room)
 }
 
+func (s *service) ListRecordings(filter RecordingFilter) []participant.ParticipantData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Finished recordings come from the catalogue if there is one
+	var recordings []participant.ParticipantData
+	if s.catalogue != nil {
+		var err error
+		recordings, err = s.catalogue.list()
+		if err != nil {
+			log.Errorf("cannot list catalogue | error: %v", err)
+		}
+	} else {
+		recordings = s.history.list()
+	}
+
+	// Ongoing recordings from every bot take precedence over stored entries
+	byID := make(map[string]participant.ParticipantData)
+	for _, r := range recordings {
+		byID[r.ID] = r
+	}
+	for _, b := range s.bots {
+		for _, r := range b.list() {
+			byID[r.ID] = r
+		}
+	}
+	recordings = []participant.ParticipantData{}
+	for _, r := range byID {
+		recordings = append(recordings, r)
+	}
+	return filterRecordings(recordings, filter)
+}
+
+// ActiveRecording returns the pending or ongoing recording of a participant on this instance, if any
+func (s *service) ActiveRecording(room string, identity string) (participant.ParticipantData, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, found := s.bots[room]
+	if !found {
+		return participant.ParticipantData{}, false
+	}
+	for _, r := range b.list() {
+		if r.Identity == identity && (r.Status == participant.StatusPending || r.Status == participant.StatusRecording) {
+			return r, true
+		}
+	}
+	return participant.ParticipantData{}, false
+}
+
 func (s *service) StartRecording(ctx context.Context, req StartRecordingRequest) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	// If profile is valid, check if there is already a bot in the room. If not, create one
-	_, found := s.bots[req.Room]
+	rotation := req.Rotation.WithDefaults(s.rotation)
+	limits := req.Limits.withDefaults(s.limits)
+	if req.Upload != nil {
+		if err := s.policy.Check(*req.Upload); err != nil {
+			return err
+		}
+		if req.Rotation != (participant.Rotation{}) {
+			return ErrRotationWithUpload
+		}
+		if req.Limits.OnLimit == LimitRollover {
+			return ErrRolloverWithUpload
+		}
+		// The defaults don't apply either
+		rotation = participant.Rotation{}
+		if limits.OnLimit == LimitRollover {
+			limits.OnLimit = LimitStop
+		}
+	}
+
+	// A participant already being recorded keeps their recording, whether the request came from the API, a webhook,
+	// the queue or another instance, so requests sent again don't change it
+	if b, found := s.bots[req.Room]; found && b.keepsRecording(req.Participant, req.Sources) {
+		log.Debugf("participant already recorded | room: %s, participant: %s", req.Room, req.Participant)
+		return nil
+	}
+
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.reserve(req.Room); err != nil {
+		return err
+	}
+	b, err := s.getOrCreateBot(req.Room)
+	if err != nil {
+		return err
+	}
+
+	// Request participant to be recorded. The bot subscribes to their tracks as they are published,
+	// so the participant doesn't need to be in the room yet.
+	id := req.ID
+	if id == "" {
+		id = utils.NewGuid("RC_")
+	}
+	b.pushParticipantRequest(ParticipantRequest{
+		ID:       id,
+		Identity: req.Participant,
+		Profile:  req.Profile,
+		Sources:  req.Sources,
+		Limits:   limits,
+		Rotation: rotation,
+		Priority: req.Priority,
+		Upload:   req.Upload,
+	})
+
+	return nil
+}
+
+// getOrCreateBot retrieves the bot in the room, or creates one if there is none. Must hold the lock.
+func (s *service) getOrCreateBot(room string) (*bot, error) {
+	// Check if there is already a bot in the room. If not, create one
+	_, found := s.bots[room]
 	if !found {
 		// Create bot
-		log.Debugf("no bot found in room, creating one | room: %s", req.Room)
-		b, err := s.createBot(req.Room, botCallback{
-			SendRecordingData: s.SendRecordingData,
+		log.Debugf("no bot found in room, creating one | room: %s", room)
+		b, err := s.createBot(room, botCallback{
+			OnRecordingStarted:      s.recordingStarted,
+			OnRecordingFinished:     s.recordingFinished,
+			OnRoomRecordingFinished: s.roomRecordingFinished,
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Set dependencies
+		b.SetContext(s.ctx)
 		b.SetUploader(s.uploader)
+		b.SetUploadQueue(s.uploads)
+		b.SetStreamer(s.streamer)
+		b.SetEncryption(s.encryption)
+		b.SetUploadPolicy(s.policy)
 
 		// Attach the bot
-		s.bots[req.Room] = b
+		s.bots[room] = b
 	}
 
 	// Retrieve the bot
-	b := s.bots[req.Room]
+	return s.bots[room], nil
+}
 
-	// Ensure that the bot can see all the tracks
-	go func() {
-		ctx := context.TODO()
-		deadline := time.After(time.Minute * 5)
-		ticker := time.NewTicker(time.Second * 2)
+func (s *service) StartRoomRecording(ctx context.Context, req StartRoomRecordingRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		var err error
-		defer func() {
-			// Stop ticker
-			ticker.Stop()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.reserve(req.Room); err != nil {
+		return err
+	}
+	b, err := s.getOrCreateBot(req.Room)
+	if err != nil {
+		return err
+	}
+	if err = b.startRoomRecording(req.Profile, req.Limits.withDefaults(s.limits), req.Rotation.WithDefaults(s.rotation), req.Priority); err != nil {
+		return err
+	}
+	s.admitRoomParticipants(req.Room, b)
+	return nil
+}
 
-			// Handle errors
-			if err != nil {
-				log.Errorf("cannot start recording | error: %v, participant: %s", err, req.Participant)
-			}
-		}()
+// addRoomParticipants records the participants a room recording doesn't record yet, while there is capacity
+func (s *service) addRoomParticipants(room string, b *bot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		var pi *livekit.ParticipantInfo
-		for {
-			select {
-			case <-deadline:
-				err = errors.New("too long")
-				return
-			case <-ticker.C:
-				// Get participant info
-				pi, err = s.lksvc.GetParticipant(ctx, &livekit.RoomParticipantIdentity{
-					Room:     req.Room,
-					Identity: req.Participant,
-				})
-				if err != nil {
-					return
-				}
-				log.Debugf("participant exists | participant: %s, num tracks: %d", pi.Identity, len(pi.Tracks))
-
-				// Determine media profile
-				tracksMap := make(map[livekit.TrackType]bool)
-				tracksSid := []string{}
-				for _, t := range pi.Tracks {
-					tracksMap[t.Type] = true
-					tracksSid = append(tracksSid, t.Sid)
-				}
-				var profile MediaProfile
-				if tracksMap[livekit.TrackType_VIDEO] && tracksMap[livekit.TrackType_AUDIO] {
-					profile = MediaMuxedAV
-				} else if tracksMap[livekit.TrackType_VIDEO] {
-					profile = MediaVideoOnly
-				} else if tracksMap[livekit.TrackType_AUDIO] {
-					profile = MediaAudioOnly
-				} else {
-					log.Debugf("not seeing any tracks yet | participant: %s", req.Participant)
-					continue
-				}
-
-				// Request participant to be recorded
-				b.pushParticipantRequest(req.Participant, profile)
-
-				// Update subscription
-				err = s.updateTrackSubscriptions(ctx, UpdateTrackSubscriptionsRequest{
-					Room:     req.Room,
-					Identity: b.id,
-					SIDs:     tracksSid,
-					Subcribe: true,
-				})
-				return
-			}
+	// The bot may have been replaced
+	if s.bots[room] != b {
+		return
+	}
+	s.admitRoomParticipants(room, b)
+}
+
+// admitRoomParticipants checks the disk and capacity before adding each participant, the others are left out until
+// more join or the bot reconnects. Must hold the lock.
+func (s *service) admitRoomParticipants(room string, b *bot) {
+	for _, identity := range b.unrecordedParticipants() {
+		err := s.admit()
+		if err == nil {
+			err = s.reserve(room)
+		}
+		if err != nil {
+			log.Warnf("not recording participant of room recording | error: %v, room: %s, participant: %s", err, room, identity)
+			return
 		}
-	}()
+		b.addRoomParticipant(identity)
+	}
+}
 
-	return nil
+func (s *service) StopRoomRecording(ctx context.Context, req StopRoomRecordingRequest) (RoomRecordingData, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Check bot exists
+	b, found := s.bots[req.Room]
+	if !found {
+		return RoomRecordingData{}, ErrRoomNotRecorded
+	}
+
+	data, err := b.stopRoomRecording()
+	if err != nil {
+		return data, err
+	}
+	go s.roomRecordingFinished(data)
+	return data, nil
 }
 
 func (s *service) StopRecording(ctx context.Context, req StopRecordingRequest) error {
@@ -206,51 +453,101 @@ func (s *service) StopRecording(ctx context.Context, req StopRecordingRequest) e
 	// Check bot exists
 	_, found := s.bots[req.Room]
 	if !found {
-		return errors.New("room is not recorded")
+		return ErrRoomNotRecorded
 	}
 
 	// Retrieve bot
 	b := s.bots[req.Room]
 
-	// Stop recorder
-	b.stopRecording(req.Participant)
+	// Stop recorder and remove subscription
+	b.stopRecording(req.Participant, participant.EndReasonStopped)
+	return nil
+}
 
-	// Get track SIDs for the participant
-	pi, err := s.lksvc.GetParticipant(ctx, &livekit.RoomParticipantIdentity{
-		Room:     req.Room,
-		Identity: req.Participant,
-	})
-	if err != nil {
-		return err
+func (s *service) createBot(room string, callback botCallback) (*bot, error) {
+	id := utils.NewGuid("RB_")
+
+	// Create token to join. A new one is created on each reconnection, so the bot never uses an expired token
+	callback.CreateToken = func() (string, error) {
+		return s.auth.buildEmptyToken(room, id)
 	}
-	var trackSids []string
-	for _, t := range pi.Tracks {
-		trackSids = append(trackSids, t.Sid)
+	callback.IsPresent = func() (bool, error) {
+		return s.isParticipantPresent(room, id)
+	}
+	callback.OnClosed = s.botClosed
+	callback.AddRoomParticipants = func(b *bot) {
+		s.addRoomParticipants(room, b)
 	}
 
-	// Remove subscription
-	return s.updateTrackSubscriptions(ctx, UpdateTrackSubscriptionsRequest{
-		Room:     req.Room,
-		Identity: b.id,
-		SIDs:     trackSids,
-		Subcribe: false,
+	// Create bot
+	return createBot(id, s.url, callback)
+}
+
+func (s *service) isParticipantPresent(room string, identity string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.lksvc.GetParticipant(ctx, &livekit.RoomParticipantIdentity{
+		Room:     room,
+		Identity: identity,
 	})
+	if err == nil {
+		return true, nil
+	}
+	if terr, ok := err.(twirp.Error); ok && terr.Code() == twirp.NotFound {
+		return false, nil
+	}
+	return false, err
 }
 
-func (s *service) createBot(room string, callback botCallback) (*bot, error) {
-	id := utils.NewGuid("RB_")
+// botClosed forgets a bot which couldn't reconnect, so the next request creates a new one
+func (s *service) botClosed(b *bot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	// Create token to join
-	token, err := s.auth.buildEmptyToken(room, id)
-	if err != nil {
-		return nil, err
+	for room, existing := range s.bots {
+		if existing == b {
+			delete(s.bots, room)
+		}
 	}
+}
 
-	// Create bot
-	return createBot(id, s.url, token, callback)
+func (s *service) saveRecording(data participant.ParticipantData) {
+	s.lock.Lock()
+	c := s.catalogue
+	s.lock.Unlock()
+
+	if c == nil {
+		return
+	}
+	if err := c.save(data); err != nil {
+		log.Errorf("cannot save recording | error: %v, id: %s", err, data.ID)
+	}
+}
+
+func (s *service) recordingStarted(data participant.ParticipantData) {
+	s.saveRecording(data)
+}
+
+func (s *service) recordingFinished(data participant.ParticipantData) {
+	s.uploadLock.Lock()
+	s.refreshUploads(&data)
+	s.history.push(data)
+	s.saveRecording(data)
+	s.uploadLock.Unlock()
+
+	s.SendRecordingData(data)
+}
+
+func (s *service) roomRecordingFinished(data RoomRecordingData) {
+	s.sendWebhook(data)
 }
 
 func (s *service) SendRecordingData(data participant.ParticipantData) {
+	s.sendWebhook(data)
+}
+
+func (s *service) sendWebhook(data interface{}) {
 	// Marshal to JSON
 	var err error
 	var body []byte
@@ -259,7 +556,6 @@ func (s *service) SendRecordingData(data participant.ParticipantData) {
 		log.Errorf("error marshalling payload | error: %v, data %v", err, data)
 		return
 	}
-	buffer := bytes.NewBuffer(body)
 
 	// Send data
 	client := http.Client{
@@ -267,10 +563,13 @@ func (s *service) SendRecordingData(data participant.ParticipantData) {
 	}
 	for _, hook := range s.webhooks {
 		go func(url string) {
-			_, err = client.Post(url, "application/json", buffer)
+			// Each request needs its own reader of the body
+			res, err := client.Post(url, "application/json", bytes.NewReader(body))
 			if err != nil {
 				log.Errorf("error reaching webhook | error: %v, url: %s", err, url)
+				return
 			}
+			res.Body.Close()
 			log.Infof("sent webhook data | url: %s, data: %v", url, data)
 		}(hook)
 	}
@@ -0,0 +1,98 @@
+package recording
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartRecordingValidatesUploadURL(t *testing.T) {
+	s := &service{bots: make(map[string]*bot)}
+
+	err := s.StartRecording(context.Background(), StartRecordingRequest{
+		Room:        "room",
+		Participant: "alice",
+		Upload:      &upload.HTTPTarget{URL: "not a url"},
+	})
+	require.ErrorIs(t, err, upload.ErrInvalidUploadURL)
+
+	err = s.StartRecording(context.Background(), StartRecordingRequest{
+		Room:        "room",
+		Participant: "alice",
+		Rotation:    participant.Rotation{Duration: time.Minute},
+		Upload:      &upload.HTTPTarget{URL: "https://example.com/a.mp4"},
+	})
+	require.ErrorIs(t, err, ErrRotationWithUpload)
+
+	err = s.StartRecording(context.Background(), StartRecordingRequest{
+		Room:        "room",
+		Participant: "alice",
+		Limits:      Limits{MaxDuration: time.Minute, OnLimit: LimitRollover},
+		Upload:      &upload.HTTPTarget{URL: "https://example.com/a.mp4"},
+	})
+	require.ErrorIs(t, err, ErrRolloverWithUpload)
+
+	err = s.StartRecording(context.Background(), StartRecordingRequest{
+		Room:        "room",
+		Participant: "alice",
+		Upload:      &upload.HTTPTarget{URL: "http://169.254.169.254/latest/meta-data"},
+	})
+	require.ErrorIs(t, err, upload.ErrUploadHostNotAllowed)
+}
+
+func TestUploadFinishedUpdatesRecording(t *testing.T) {
+	s := &service{bots: make(map[string]*bot), history: newHistory(historySize)}
+	s.recordingFinished(participant.ParticipantData{
+		ID:      "RC_1",
+		Status:  participant.StatusDone,
+		Uploads: []participant.FileUpload{{ID: "UP_1", Output: "bucket/a.mp4", Status: upload.UploadPending}},
+	})
+
+	s.uploadFinished(upload.Upload{
+		ID:     "UP_1",
+		Object: upload.Object{Metadata: map[string]string{upload.MetadataRecordingID: "RC_1"}},
+		Status: upload.UploadDead,
+		Error:  "denied",
+	})
+	recordings := s.history.list()
+	require.Len(t, recordings, 1)
+	require.Equal(t, upload.UploadDead, recordings[0].Uploads[0].Status)
+	require.Equal(t, "denied", recordings[0].Uploads[0].Error)
+
+	sums := &upload.Checksums{SHA256: "sha256", MD5: "md5", CRC32C: "crc32c"}
+	s.uploadFinished(upload.Upload{
+		ID:        "UP_1",
+		Object:    upload.Object{Metadata: map[string]string{upload.MetadataRecordingID: "RC_1"}},
+		Status:    upload.UploadDone,
+		Checksums: sums,
+	})
+	recordings = s.history.list()
+	require.Equal(t, upload.UploadDone, recordings[0].Uploads[0].Status)
+	require.Equal(t, sums, recordings[0].Uploads[0].Checksums)
+}
+
+func TestStartRecordingKeepsExistingRecording(t *testing.T) {
+	camera := []livekit.TrackSource{livekit.TrackSource_CAMERA}
+	b := &bot{subjects: map[string]*subject{
+		"alice": {request: ParticipantRequest{ID: "RC_1", Identity: "alice", Sources: camera, Priority: 1}},
+		"bob":   {request: ParticipantRequest{ID: "RC_2", Identity: "bob"}, room: true},
+	}}
+	s := &service{bots: map[string]*bot{"room": b}}
+
+	// Sent again through any path, the request changes nothing
+	err := s.StartRecording(context.Background(), StartRecordingRequest{ID: "RC_3", Room: "room", Participant: "alice", Sources: camera})
+	require.NoError(t, err)
+	require.Equal(t, "RC_1", b.subjects["alice"].request.ID)
+	require.Equal(t, 1, b.subjects["alice"].request.Priority)
+
+	// Unless it wants more sources, or the participant is only recorded with the room
+	require.False(t, b.keepsRecording("alice", []livekit.TrackSource{livekit.TrackSource_SCREEN_SHARE}))
+	require.False(t, b.keepsRecording("alice", nil))
+	require.False(t, b.keepsRecording("bob", nil))
+	require.False(t, b.keepsRecording("carol", nil))
+}
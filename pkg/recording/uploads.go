@@ -0,0 +1,73 @@
+package recording
+
+import (
+	"errors"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/upload"
+	"github.com/labstack/gommon/log"
+)
+
+// refreshUploads catches up with uploads which finished while the recording was still going. Must hold the upload lock.
+func (s *service) refreshUploads(data *participant.ParticipantData) {
+	s.lock.Lock()
+	q := s.uploads
+	s.lock.Unlock()
+
+	if q == nil {
+		return
+	}
+	for i, f := range data.Uploads {
+		if u, err := q.Get(f.ID); err == nil {
+			data.Uploads[i].Status = u.Status
+			data.Uploads[i].Error = u.Error
+			data.Uploads[i].Checksums = u.Checksums
+		}
+	}
+}
+
+// uploadFinished updates the recording of the upload, and sends it to the webhooks again.
+// Recordings still going are updated once they finish.
+func (s *service) uploadFinished(u upload.Upload) {
+	id := u.Object.Metadata[upload.MetadataRecordingID]
+
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	data, found := s.history.update(id, func(data *participant.ParticipantData) bool {
+		return setUpload(data, u)
+	})
+
+	s.lock.Lock()
+	c := s.catalogue
+	s.lock.Unlock()
+	if c != nil {
+		saved, err := c.get(id)
+		if err == nil && setUpload(&saved, u) {
+			if err = c.save(saved); err != nil {
+				log.Errorf("cannot save recording | error: %v, id: %s", err, id)
+			}
+			data, found = saved, true
+		} else if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Errorf("cannot get recording | error: %v, id: %s", err, id)
+		}
+	}
+
+	if found {
+		s.SendRecordingData(data)
+	}
+}
+
+// setUpload updates the upload in the recording, and returns false if it isn't one of its uploads
+func setUpload(data *participant.ParticipantData, u upload.Upload) bool {
+	for i := range data.Uploads {
+		if data.Uploads[i].ID == u.ID {
+			data.Uploads[i].Status = u.Status
+			data.Uploads[i].Error = u.Error
+			data.Uploads[i].Checksums = u.Checksums
+			return true
+		}
+	}
+	return false
+}
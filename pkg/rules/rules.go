@@ -0,0 +1,324 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/livekit/protocol/livekit"
+)
+
+// Rule decides whether to record a participant. Every condition which is set must match.
+type Rule struct {
+	Name string `json:"name"`
+
+	// Glob patterns (see path.Match) or regular expressions for the room name and participant identity
+	Room          string `json:"room"`
+	RoomRegex     string `json:"roomRegex"`
+	Identity      string `json:"identity"`
+	IdentityRegex string `json:"identityRegex"`
+
+	// Keys expected in the participant's metadata, parsed as a JSON object.
+	// An empty value only requires the key to be present.
+	Metadata map[string]string `json:"metadata"`
+
+	// One of camera, microphone, screen_share, screen_share_audio.
+	// Rules with sources only match track_published events. With any of them, every track is decided on its own.
+	Sources []string `json:"sources"`
+
+	// Only match within the time window
+	Window *Window `json:"window"`
+
+	// Outcome of the rule. Record defaults to true.
+	Record  *bool  `json:"record"`
+	Profile string `json:"profile"`
+}
+
+type Window struct {
+	// Three letter days, e.g. mon, tue. Every day if empty
+	Days []string `json:"days"`
+
+	// Time of day as HH:MM. A window ending before it starts spans midnight
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// IANA time zone, UTC if empty
+	Timezone string `json:"timezone"`
+}
+
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Subject is what the rules are evaluated against
+type Subject struct {
+	Room     string
+	Identity string
+	Metadata string
+
+	// Source of the published track, nil for participant_joined events
+	Source *livekit.TrackSource
+
+	Time time.Time
+}
+
+type Decision struct {
+	Record  bool
+	Profile recording.MediaProfile
+	Sources []livekit.TrackSource
+
+	// Name of the matching rule, empty if none matched
+	Rule string
+}
+
+type Engine struct {
+	rules []compiledRule
+
+	// Set if any rule has sources
+	bySource bool
+}
+
+type compiledRule struct {
+	Rule
+	roomRegex     *regexp.Regexp
+	identityRegex *regexp.Regexp
+	sources       []livekit.TrackSource
+	profile       recording.MediaProfile
+	window        *compiledWindow
+}
+
+type compiledWindow struct {
+	days     map[time.Weekday]bool
+	from     time.Duration
+	to       time.Duration
+	location *time.Location
+}
+
+var (
+	ErrInvalidPattern = errors.New("invalid pattern")
+	ErrInvalidSource  = errors.New("invalid track source")
+	ErrInvalidWindow  = errors.New("invalid time window")
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Load reads rules from a JSON file
+func Load(filename string) (*Engine, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return New(config.Rules)
+}
+
+func New(rules []Rule) (*Engine, error) {
+	e := &Engine{}
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		e.rules = append(e.rules, c)
+		e.bySource = e.bySource || len(c.sources) > 0
+	}
+	return e, nil
+}
+
+func compile(r Rule) (compiledRule, error) {
+	c := compiledRule{Rule: r}
+	var err error
+
+	// Check glob patterns early, path.Match only reports them when matching
+	for _, pattern := range []string{r.Room, r.Identity} {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return c, fmt.Errorf("%w: %s", ErrInvalidPattern, pattern)
+		}
+	}
+	if r.RoomRegex != "" {
+		if c.roomRegex, err = regexp.Compile(r.RoomRegex); err != nil {
+			return c, fmt.Errorf("%w: %v", ErrInvalidPattern, err)
+		}
+	}
+	if r.IdentityRegex != "" {
+		if c.identityRegex, err = regexp.Compile(r.IdentityRegex); err != nil {
+			return c, fmt.Errorf("%w: %v", ErrInvalidPattern, err)
+		}
+	}
+
+	for _, s := range r.Sources {
+		source, ok := livekit.TrackSource_value[strings.ToUpper(s)]
+		if !ok {
+			return c, fmt.Errorf("%w: %s", ErrInvalidSource, s)
+		}
+		c.sources = append(c.sources, livekit.TrackSource(source))
+	}
+
+	if r.Profile != "" {
+		if c.profile, err = recording.ParseMediaProfile(r.Profile); err != nil {
+			return c, err
+		}
+	}
+
+	if r.Window != nil {
+		if c.window, err = compileWindow(*r.Window); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func compileWindow(w Window) (*compiledWindow, error) {
+	c := &compiledWindow{
+		days:     make(map[time.Weekday]bool),
+		location: time.UTC,
+	}
+	for _, d := range w.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown day %s", ErrInvalidWindow, d)
+		}
+		c.days[day] = true
+	}
+
+	var err error
+	if w.Timezone != "" {
+		if c.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWindow, err)
+		}
+	}
+	if c.from, err = parseTimeOfDay(w.From); err != nil {
+		return nil, err
+	}
+	if c.to, err = parseTimeOfDay(w.To); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be HH:MM", ErrInvalidWindow, s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *compiledWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if len(w.days) > 0 && !w.days[t.Weekday()] {
+		return false
+	}
+
+	// No time of day, or the whole day
+	if w.from == w.to {
+		return true
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from < w.to {
+		return now >= w.from && now < w.to
+	}
+	return now >= w.from || now < w.to
+}
+
+// Evaluate returns the decision of the first matching rule. Nothing is recorded if no rule matches.
+// When any rule has sources, joining records nothing and each track only records its own source, so a rule
+// excluding a source isn't bypassed by a later rule matching the participant as they join.
+func (e *Engine) Evaluate(s Subject) Decision {
+	if e.bySource && s.Source == nil {
+		return Decision{}
+	}
+	for _, r := range e.rules {
+		if !r.matches(s) {
+			continue
+		}
+		sources := r.sources
+		if e.bySource && len(sources) == 0 {
+			sources = []livekit.TrackSource{*s.Source}
+		}
+		return Decision{
+			Record:  r.Record == nil || *r.Record,
+			Profile: r.profile,
+			Sources: sources,
+			Rule:    r.Name,
+		}
+	}
+	return Decision{}
+}
+
+func (r *compiledRule) matches(s Subject) bool {
+	if r.Room != "" {
+		if ok, _ := path.Match(r.Room, s.Room); !ok {
+			return false
+		}
+	}
+	if r.roomRegex != nil && !r.roomRegex.MatchString(s.Room) {
+		return false
+	}
+	if r.Identity != "" {
+		if ok, _ := path.Match(r.Identity, s.Identity); !ok {
+			return false
+		}
+	}
+	if r.identityRegex != nil && !r.identityRegex.MatchString(s.Identity) {
+		return false
+	}
+	if len(r.Metadata) > 0 && !matchMetadata(r.Metadata, s.Metadata) {
+		return false
+	}
+	if len(r.sources) > 0 {
+		if s.Source == nil || !containsSource(r.sources, *s.Source) {
+			return false
+		}
+	}
+	if r.window != nil && !r.window.contains(s.Time) {
+		return false
+	}
+	return true
+}
+
+func matchMetadata(expected map[string]string, metadata string) bool {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &values); err != nil {
+		return false
+	}
+	for key, value := range expected {
+		actual, found := values[key]
+		if !found {
+			return false
+		}
+		if value != "" && fmt.Sprint(actual) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsSource(sources []livekit.TrackSource, source livekit.TrackSource) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/require"
+)
+
+func newEngine(t *testing.T, rules ...Rule) *Engine {
+	e, err := New(rules)
+	require.NoError(t, err)
+	return e
+}
+
+func source(s livekit.TrackSource) *livekit.TrackSource {
+	return &s
+}
+
+func TestNoMatchingRuleDoesNotRecord(t *testing.T) {
+	e := newEngine(t, Rule{Name: "ops", Room: "ops-*"})
+	d := e.Evaluate(Subject{Room: "sales-1", Identity: "alice"})
+	require.False(t, d.Record)
+	require.Empty(t, d.Rule)
+}
+
+func TestFirstMatchingRuleWins(t *testing.T) {
+	no := false
+	e := newEngine(t,
+		Rule{Name: "skip-guests", Identity: "guest-*", Record: &no},
+		Rule{Name: "ops", Room: "ops-*", Profile: "av"},
+	)
+
+	d := e.Evaluate(Subject{Room: "ops-1", Identity: "guest-42"})
+	require.False(t, d.Record)
+	require.Equal(t, "skip-guests", d.Rule)
+
+	d = e.Evaluate(Subject{Room: "ops-1", Identity: "alice"})
+	require.True(t, d.Record)
+	require.Equal(t, "ops", d.Rule)
+	require.Equal(t, recording.MediaMuxedAV, d.Profile)
+}
+
+func TestRegexPatterns(t *testing.T) {
+	e := newEngine(t, Rule{RoomRegex: "^drone-[0-9]+$", IdentityRegex: "^pilot"})
+	require.True(t, e.Evaluate(Subject{Room: "drone-12", Identity: "pilot-a"}).Record)
+	require.False(t, e.Evaluate(Subject{Room: "drone-x", Identity: "pilot-a"}).Record)
+	require.False(t, e.Evaluate(Subject{Room: "drone-12", Identity: "observer"}).Record)
+}
+
+func TestMetadataKeys(t *testing.T) {
+	e := newEngine(t, Rule{Metadata: map[string]string{"record": "true", "team": ""}})
+	require.True(t, e.Evaluate(Subject{Metadata: `{"record": true, "team": "ops"}`}).Record)
+	require.False(t, e.Evaluate(Subject{Metadata: `{"record": false, "team": "ops"}`}).Record)
+	require.False(t, e.Evaluate(Subject{Metadata: `{"record": true}`}).Record)
+	require.False(t, e.Evaluate(Subject{Metadata: "not json"}).Record)
+}
+
+func TestSourcesOnlyMatchTracks(t *testing.T) {
+	e := newEngine(t, Rule{Sources: []string{"screen_share"}})
+
+	require.False(t, e.Evaluate(Subject{}).Record)
+	require.False(t, e.Evaluate(Subject{Source: source(livekit.TrackSource_CAMERA)}).Record)
+
+	d := e.Evaluate(Subject{Source: source(livekit.TrackSource_SCREEN_SHARE)})
+	require.True(t, d.Record)
+	require.Equal(t, []livekit.TrackSource{livekit.TrackSource_SCREEN_SHARE}, d.Sources)
+}
+
+func TestSourcesCanBeExcluded(t *testing.T) {
+	no := false
+	e := newEngine(t,
+		Rule{Name: "no-screens", Sources: []string{"screen_share"}, Record: &no},
+		Rule{Name: "everyone"},
+	)
+
+	// Joining doesn't record every source before the tracks are decided
+	require.False(t, e.Evaluate(Subject{Identity: "alice"}).Record)
+
+	d := e.Evaluate(Subject{Identity: "alice", Source: source(livekit.TrackSource_CAMERA)})
+	require.True(t, d.Record)
+	require.Equal(t, "everyone", d.Rule)
+	require.Equal(t, []livekit.TrackSource{livekit.TrackSource_CAMERA}, d.Sources)
+
+	d = e.Evaluate(Subject{Identity: "alice", Source: source(livekit.TrackSource_SCREEN_SHARE)})
+	require.False(t, d.Record)
+	require.Equal(t, "no-screens", d.Rule)
+}
+
+func TestTimeWindow(t *testing.T) {
+	e := newEngine(t, Rule{Window: &Window{Days: []string{"mon"}, From: "09:00", To: "17:00"}})
+
+	// 2022-03-07 is a Monday
+	require.True(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 7, 10, 0, 0, 0, time.UTC)}).Record)
+	require.False(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 7, 18, 0, 0, 0, time.UTC)}).Record)
+	require.False(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 8, 10, 0, 0, 0, time.UTC)}).Record)
+}
+
+func TestTimeWindowSpanningMidnight(t *testing.T) {
+	e := newEngine(t, Rule{Window: &Window{From: "22:00", To: "06:00"}})
+	require.True(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 7, 23, 0, 0, 0, time.UTC)}).Record)
+	require.True(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 7, 5, 0, 0, 0, time.UTC)}).Record)
+	require.False(t, e.Evaluate(Subject{Time: time.Date(2022, 3, 7, 12, 0, 0, 0, time.UTC)}).Record)
+}
+
+func TestInvalidRules(t *testing.T) {
+	_, err := New([]Rule{{Room: "["}})
+	require.ErrorIs(t, err, ErrInvalidPattern)
+
+	_, err = New([]Rule{{IdentityRegex: "("}})
+	require.ErrorIs(t, err, ErrInvalidPattern)
+
+	_, err = New([]Rule{{Sources: []string{"webcam"}}})
+	require.ErrorIs(t, err, ErrInvalidSource)
+
+	_, err = New([]Rule{{Window: &Window{From: "9am"}}})
+	require.ErrorIs(t, err, ErrInvalidWindow)
+
+	_, err = New([]Rule{{Profile: "screen"}})
+	require.ErrorIs(t, err, recording.ErrUnknownMediaProfile)
+}
+
+func TestLoadFromFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(filename, []byte(`{"rules": [{"name": "all", "room": "*", "profile": "audio"}]}`), 0600)
+	require.NoError(t, err)
+
+	e, err := Load(filename)
+	require.NoError(t, err)
+	d := e.Evaluate(Subject{Room: "any"})
+	require.True(t, d.Record)
+	require.Equal(t, recording.MediaAudioOnly, d.Profile)
+}
@@ -0,0 +1,342 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/labstack/gommon/log"
+	"github.com/livekit/protocol/utils"
+)
+
+type Status string
+
+const (
+	StatusScheduled Status = "scheduled"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusCancelled Status = "cancelled"
+
+	// The window ended before the recording could start, e.g. while the service was down
+	StatusMissed Status = "missed"
+)
+
+// Schedule is a recording booked for a future time window
+type Schedule struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+
+	// Optional, the whole room is recorded if empty
+	Participant string                 `json:"participant,omitempty"`
+	Profile     recording.MediaProfile `json:"profile,omitempty"`
+
+	// Optional, apply to the recording as they do to a start request
+	Limits   recording.Limits     `json:"limits"`
+	Rotation participant.Rotation `json:"rotation"`
+	Priority int                  `json:"priority,omitempty"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// The scheduler started the recording, rather than finding it already running, so it stops it at the end
+	Owned bool `json:"owned,omitempty"`
+}
+
+const schedulesBucket = "schedules"
+
+// How often schedules are checked
+const tickInterval = 5 * time.Second
+
+var (
+	ErrEmptyRoom     = errors.New("room is empty")
+	ErrInvalidWindow = errors.New("end must be after start and in the future")
+	ErrNotFound      = errors.New("schedule not found")
+	ErrAlreadyEnded  = errors.New("schedule has already ended")
+)
+
+// Recorder records participants, either the local service or a cluster assigner
+type Recorder interface {
+	StartRecording(ctx context.Context, req recording.StartRecordingRequest) error
+	StopRecording(ctx context.Context, req recording.StopRecordingRequest) error
+
+	// Recorded returns true if the participant is already recorded, by anyone
+	Recorded(ctx context.Context, room string, participant string) (bool, error)
+}
+
+// localRecorder records participants with the service of this instance
+type localRecorder struct {
+	recording.Service
+}
+
+func (l localRecorder) Recorded(ctx context.Context, room string, participant string) (bool, error) {
+	_, found := l.ActiveRecording(room, participant)
+	return found, nil
+}
+
+type Scheduler struct {
+	lock      sync.Mutex
+	service   recording.Service
+	recorder  Recorder
+	store     *store.Store
+	schedules map[string]*Schedule
+}
+
+// NewScheduler creates a scheduler for the service. Schedules are persisted in st if it isn't nil.
+func NewScheduler(service recording.Service, st *store.Store) (*Scheduler, error) {
+	s := &Scheduler{
+		lock:      sync.Mutex{},
+		service:   service,
+		recorder:  localRecorder{service},
+		store:     st,
+		schedules: make(map[string]*Schedule),
+	}
+	if st == nil {
+		return s, nil
+	}
+
+	// Restore schedules from the previous run. Running ones are started again as the recordings were lost.
+	err := st.ForEach(schedulesBucket, func(key string, value []byte) error {
+		var sch Schedule
+		if err := json.Unmarshal(value, &sch); err != nil {
+			return err
+		}
+		if sch.Status == StatusRunning {
+			sch.Status = StatusScheduled
+			sch.Owned = false
+		}
+		s.schedules[sch.ID] = &sch
+		return nil
+	})
+	return s, err
+}
+
+// SetRecorder records scheduled participants through recorder, e.g. the assigner of a cluster so another instance
+// doesn't record them too. Room recordings stay on this instance.
+func (s *Scheduler) SetRecorder(recorder Recorder) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.recorder = recorder
+}
+
+func (s *Scheduler) Add(sch Schedule) (Schedule, error) {
+	if sch.Room == "" {
+		return sch, ErrEmptyRoom
+	}
+	if !sch.End.After(sch.Start) || !sch.End.After(time.Now()) {
+		return sch, ErrInvalidWindow
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sch.ID = utils.NewGuid("SC_")
+	sch.Status = StatusScheduled
+	sch.Error = ""
+	s.schedules[sch.ID] = &sch
+	if err := s.save(&sch); err != nil {
+		delete(s.schedules, sch.ID)
+		return sch, err
+	}
+	log.Infof("added schedule | id: %s, room: %s, participant: %s, start: %v, end: %v", sch.ID, sch.Room, sch.Participant, sch.Start, sch.End)
+	return sch, nil
+}
+
+// Cancel removes a schedule from the plan, and stops its recording if it is running
+func (s *Scheduler) Cancel(ctx context.Context, id string) (Schedule, error) {
+	s.lock.Lock()
+	sch, found := s.schedules[id]
+	if !found {
+		s.lock.Unlock()
+		return Schedule{}, ErrNotFound
+	}
+	if sch.Status != StatusRunning && sch.Status != StatusScheduled {
+		s.lock.Unlock()
+		return *sch, ErrAlreadyEnded
+	}
+	running := sch.Status == StatusRunning
+	sch.Status = StatusCancelled
+	cancelled := *sch
+	err := s.save(sch)
+	s.lock.Unlock()
+
+	if running && cancelled.Owned {
+		s.stop(ctx, cancelled)
+	}
+	return cancelled, err
+}
+
+func (s *Scheduler) List() []Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	schedules := []Schedule{}
+	for _, sch := range s.schedules {
+		schedules = append(schedules, *sch)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Start.Before(schedules[j].Start)
+	})
+	return schedules
+}
+
+// Run starts and stops recordings as their windows open and close, until the context is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		s.tick(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick starts and stops the recordings which are due. The service is called without the lock, which is only
+// held to pick the schedules and to update them afterwards.
+func (s *Scheduler) tick(ctx context.Context, now time.Time) {
+	starts, stops := s.due(now)
+	for _, sch := range starts {
+		owned, err := s.start(ctx, sch)
+		s.started(ctx, sch, owned, err)
+	}
+	for _, sch := range stops {
+		if sch.Owned {
+			s.stop(ctx, sch)
+		}
+	}
+}
+
+// due returns the schedules to start and to stop. Those to stop are done already, so they aren't cancelled meanwhile.
+func (s *Scheduler) due(now time.Time) ([]Schedule, []Schedule) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var starts, stops []Schedule
+	for _, sch := range s.schedules {
+		switch {
+		case sch.Status == StatusScheduled && !now.Before(sch.End):
+			sch.Status = StatusMissed
+		case sch.Status == StatusScheduled && !now.Before(sch.Start):
+			starts = append(starts, *sch)
+			continue
+		case sch.Status == StatusRunning && !now.Before(sch.End):
+			stops = append(stops, *sch)
+			sch.Status = StatusDone
+		default:
+			continue
+		}
+		if err := s.save(sch); err != nil {
+			log.Errorf("cannot save schedule | error: %v, id: %s", err, sch.ID)
+		}
+	}
+	return starts, stops
+}
+
+// started records the outcome of starting a schedule, unless it was cancelled meanwhile
+func (s *Scheduler) started(ctx context.Context, started Schedule, owned bool, err error) {
+	s.lock.Lock()
+	sch, found := s.schedules[started.ID]
+	if !found || sch.Status != StatusScheduled {
+		s.lock.Unlock()
+		if err == nil && owned {
+			started.Owned = true
+			s.stop(ctx, started)
+		}
+		return
+	}
+	defer s.lock.Unlock()
+
+	// Failures are retried on the next tick while the window is open
+	if err != nil {
+		sch.Error = err.Error()
+		log.Errorf("cannot start scheduled recording | error: %v, id: %s", err, sch.ID)
+		return
+	}
+	sch.Status = StatusRunning
+	sch.Owned = owned
+	sch.Error = ""
+	if err = s.save(sch); err != nil {
+		log.Errorf("cannot save schedule | error: %v, id: %s", err, sch.ID)
+	}
+}
+
+// start returns whether the scheduler started the recording. One already running is left to whoever started it.
+func (s *Scheduler) start(ctx context.Context, sch Schedule) (bool, error) {
+	log.Infof("starting scheduled recording | id: %s, room: %s, participant: %s", sch.ID, sch.Room, sch.Participant)
+	if sch.Participant == "" {
+		err := s.service.StartRoomRecording(ctx, recording.StartRoomRecordingRequest{
+			Room:     sch.Room,
+			Profile:  sch.Profile,
+			Limits:   sch.Limits,
+			Rotation: sch.Rotation,
+			Priority: sch.Priority,
+		})
+		if errors.Is(err, recording.ErrRoomAlreadyRecorded) {
+			log.Infof("room already recorded, not stopping it at the end | id: %s, room: %s", sch.ID, sch.Room)
+			return false, nil
+		}
+		return err == nil, err
+	}
+	recorder := s.getRecorder()
+	recorded, err := recorder.Recorded(ctx, sch.Room, sch.Participant)
+	if err != nil {
+		return false, err
+	}
+	if recorded {
+		log.Infof("participant already recorded, not stopping them at the end | id: %s, room: %s, participant: %s", sch.ID, sch.Room, sch.Participant)
+		return false, nil
+	}
+	err = recorder.StartRecording(ctx, recording.StartRecordingRequest{
+		Room:        sch.Room,
+		Participant: sch.Participant,
+		Profile:     sch.Profile,
+		Limits:      sch.Limits,
+		Rotation:    sch.Rotation,
+		Priority:    sch.Priority,
+	})
+	return err == nil, err
+}
+
+func (s *Scheduler) getRecorder() Recorder {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recorder
+}
+
+// stop ends the recording of a schedule. Errors are only logged, the recording may have ended with the room.
+func (s *Scheduler) stop(ctx context.Context, sch Schedule) {
+	log.Infof("stopping scheduled recording | id: %s, room: %s, participant: %s", sch.ID, sch.Room, sch.Participant)
+	var err error
+	if sch.Participant == "" {
+		_, err = s.service.StopRoomRecording(ctx, recording.StopRoomRecordingRequest{
+			Room: sch.Room,
+		})
+	} else {
+		err = s.getRecorder().StopRecording(ctx, recording.StopRecordingRequest{
+			Room:        sch.Room,
+			Participant: sch.Participant,
+		})
+	}
+	if err != nil {
+		log.Warnf("cannot stop scheduled recording | error: %v, id: %s", err, sch.ID)
+	}
+}
+
+func (s *Scheduler) save(sch *Schedule) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Put(schedulesBucket, sch.ID, sch)
+}
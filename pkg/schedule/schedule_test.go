@@ -0,0 +1,260 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/participant"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/recording"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+// mockService records the calls made by the scheduler
+type mockService struct {
+	recording.Service
+	started []string
+	stopped []string
+	err     error
+
+	// Recorded by someone else
+	active       map[string]bool
+	roomRecorded bool
+}
+
+func (m *mockService) ActiveRecording(room string, identity string) (participant.ParticipantData, bool) {
+	return participant.ParticipantData{}, m.active[room+"/"+identity]
+}
+
+func (m *mockService) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.started = append(m.started, req.Room+"/"+req.Participant)
+	return nil
+}
+
+func (m *mockService) StopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	m.stopped = append(m.stopped, req.Room+"/"+req.Participant)
+	return nil
+}
+
+func (m *mockService) StartRoomRecording(ctx context.Context, req recording.StartRoomRecordingRequest) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.roomRecorded {
+		return recording.ErrRoomAlreadyRecorded
+	}
+	m.started = append(m.started, req.Room)
+	return nil
+}
+
+func (m *mockService) StopRoomRecording(ctx context.Context, req recording.StopRoomRecordingRequest) (recording.RoomRecordingData, error) {
+	m.stopped = append(m.stopped, req.Room)
+	return recording.RoomRecordingData{}, nil
+}
+
+func openStore(t *testing.T) *store.Store {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		st.Close()
+	})
+	return st
+}
+
+func TestSchedulerStartsAndStops(t *testing.T) {
+	svc := &mockService{}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	room, err := s.Add(Schedule{Room: "room", Start: now.Add(time.Minute), End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.Add(Schedule{Room: "room", Participant: "alice", Start: now.Add(2 * time.Minute), End: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	s.tick(context.Background(), now)
+	require.Empty(t, svc.started)
+
+	s.tick(context.Background(), now.Add(time.Minute))
+	require.Equal(t, []string{"room"}, svc.started)
+	require.Equal(t, StatusRunning, s.List()[0].Status)
+	require.Equal(t, room.ID, s.List()[0].ID)
+
+	s.tick(context.Background(), now.Add(2*time.Minute))
+	require.Equal(t, []string{"room", "room/alice"}, svc.started)
+
+	s.tick(context.Background(), now.Add(time.Hour))
+	require.ElementsMatch(t, []string{"room", "room/alice"}, svc.stopped)
+	for _, sch := range s.List() {
+		require.Equal(t, StatusDone, sch.Status)
+	}
+}
+
+func TestSchedulerRetriesFailedStart(t *testing.T) {
+	svc := &mockService{err: errors.New("unavailable")}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = s.Add(Schedule{Room: "room", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	s.tick(context.Background(), now)
+	require.Equal(t, StatusScheduled, s.List()[0].Status)
+	require.Equal(t, "unavailable", s.List()[0].Error)
+
+	svc.err = nil
+	s.tick(context.Background(), now.Add(time.Minute))
+	require.Equal(t, StatusRunning, s.List()[0].Status)
+	require.Empty(t, s.List()[0].Error)
+}
+
+func TestSchedulerMissedWindow(t *testing.T) {
+	svc := &mockService{}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = s.Add(Schedule{Room: "room", Start: now, End: now.Add(time.Minute)})
+	require.NoError(t, err)
+
+	s.tick(context.Background(), now.Add(time.Hour))
+	require.Equal(t, StatusMissed, s.List()[0].Status)
+	require.Empty(t, svc.started)
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	svc := &mockService{}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	sch, err := s.Add(Schedule{Room: "room", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	s.tick(context.Background(), now)
+
+	sch, err = s.Cancel(context.Background(), sch.ID)
+	require.NoError(t, err)
+	require.Equal(t, StatusCancelled, sch.Status)
+	require.Equal(t, []string{"room"}, svc.stopped)
+
+	_, err = s.Cancel(context.Background(), sch.ID)
+	require.ErrorIs(t, err, ErrAlreadyEnded)
+	_, err = s.Cancel(context.Background(), "unknown")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSchedulerLeavesOthersRecordings(t *testing.T) {
+	svc := &mockService{roomRecorded: true, active: map[string]bool{"room/alice": true}}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = s.Add(Schedule{Room: "room", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.Add(Schedule{Room: "room", Participant: "alice", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	bob, err := s.Add(Schedule{Room: "room", Participant: "bob", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	s.tick(context.Background(), now)
+	for _, sch := range s.List() {
+		require.Equal(t, StatusRunning, sch.Status)
+		require.Equal(t, sch.ID == bob.ID, sch.Owned)
+	}
+
+	// Only what the scheduler started is stopped
+	s.tick(context.Background(), now.Add(time.Hour))
+	require.Equal(t, []string{"room/bob"}, svc.stopped)
+}
+
+func TestSchedulerInvalidWindow(t *testing.T) {
+	s, err := NewScheduler(&mockService{}, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = s.Add(Schedule{Room: "room", Start: now, End: now})
+	require.ErrorIs(t, err, ErrInvalidWindow)
+	_, err = s.Add(Schedule{Room: "room", Start: now.Add(-time.Hour), End: now.Add(-time.Minute)})
+	require.ErrorIs(t, err, ErrInvalidWindow)
+	_, err = s.Add(Schedule{Start: now, End: now.Add(time.Hour)})
+	require.ErrorIs(t, err, ErrEmptyRoom)
+}
+
+func TestSchedulerRestoresSchedules(t *testing.T) {
+	st := openStore(t)
+	svc := &mockService{}
+	s, err := NewScheduler(svc, st)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = s.Add(Schedule{Room: "room", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	s.tick(context.Background(), now)
+
+	// Recordings are lost on restart, so running schedules start again
+	svc = &mockService{}
+	s, err = NewScheduler(svc, st)
+	require.NoError(t, err)
+	require.Len(t, s.List(), 1)
+	require.Equal(t, StatusScheduled, s.List()[0].Status)
+
+	s.tick(context.Background(), now.Add(time.Minute))
+	require.Equal(t, []string{"room"}, svc.started)
+}
+
+// mockRecorder stands for a cluster, where someone else may record the participant
+type mockRecorder struct {
+	requests []recording.StartRecordingRequest
+	stopped  []string
+	recorded map[string]bool
+}
+
+func (m *mockRecorder) StartRecording(ctx context.Context, req recording.StartRecordingRequest) error {
+	m.requests = append(m.requests, req)
+	return nil
+}
+
+func (m *mockRecorder) StopRecording(ctx context.Context, req recording.StopRecordingRequest) error {
+	m.stopped = append(m.stopped, req.Room+"/"+req.Participant)
+	return nil
+}
+
+func (m *mockRecorder) Recorded(ctx context.Context, room string, participant string) (bool, error) {
+	return m.recorded[room+"/"+participant], nil
+}
+
+func TestSchedulerStartsThroughRecorder(t *testing.T) {
+	svc := &mockService{}
+	recorder := &mockRecorder{recorded: map[string]bool{"room/bob": true}}
+	s, err := NewScheduler(svc, nil)
+	require.NoError(t, err)
+	s.SetRecorder(recorder)
+
+	now := time.Now()
+	limits := recording.Limits{MaxDuration: time.Hour, OnLimit: recording.LimitStop}
+	rotation := participant.Rotation{Duration: 10 * time.Minute}
+	_, err = s.Add(Schedule{Room: "room", Participant: "alice", Limits: limits, Rotation: rotation, Priority: 2, Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.Add(Schedule{Room: "room", Participant: "bob", Start: now, End: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	// Recorded elsewhere in the cluster, bob is left alone
+	s.tick(context.Background(), now)
+	require.Empty(t, svc.started)
+	require.Len(t, recorder.requests, 1)
+	require.Equal(t, "alice", recorder.requests[0].Participant)
+	require.Equal(t, limits, recorder.requests[0].Limits)
+	require.Equal(t, rotation, recorder.requests[0].Rotation)
+	require.Equal(t, 2, recorder.requests[0].Priority)
+
+	s.tick(context.Background(), now.Add(time.Hour))
+	require.Equal(t, []string{"room/alice"}, recorder.stopped)
+	require.Empty(t, svc.stopped)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func openStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+func TestPutAndGet(t *testing.T) {
+	s := openStore(t)
+
+	err := s.Put("bucket", "key", mockValue{"cgc", 1})
+	require.NoError(t, err)
+
+	var v mockValue
+	err = s.Get("bucket", "key", &v)
+	require.NoError(t, err)
+	require.Equal(t, mockValue{"cgc", 1}, v)
+}
+
+func TestGetMissingKey(t *testing.T) {
+	s := openStore(t)
+
+	var v mockValue
+	err := s.Get("bucket", "key", &v)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	s.Put("bucket", "other", mockValue{})
+	err = s.Get("bucket", "key", &v)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDelete(t *testing.T) {
+	s := openStore(t)
+	s.Put("bucket", "key", mockValue{"cgc", 1})
+
+	err := s.Delete("bucket", "key")
+	require.NoError(t, err)
+
+	var v mockValue
+	err = s.Get("bucket", "key", &v)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestForEach(t *testing.T) {
+	s := openStore(t)
+	s.Put("bucket", "a", mockValue{"a", 1})
+	s.Put("bucket", "b", mockValue{"b", 2})
+
+	var values []mockValue
+	err := s.ForEach("bucket", func(key string, value []byte) error {
+		var v mockValue
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+		values = append(values, v)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []mockValue{{"a", 1}, {"b", 2}}, values)
+}
+
+func TestPersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(path)
+	require.NoError(t, err)
+	s.Put("bucket", "key", mockValue{"cgc", 1})
+	require.NoError(t, s.Close())
+
+	s, err = Open(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var v mockValue
+	err = s.Get("bucket", "key", &v)
+	require.NoError(t, err)
+	require.Equal(t, "cgc", v.Name)
+}
+
+func TestUpdate(t *testing.T) {
+	s := openStore(t)
+
+	increment := func(current []byte) (interface{}, error) {
+		v := mockValue{Name: "cgc"}
+		if current != nil {
+			if err := json.Unmarshal(current, &v); err != nil {
+				return nil, err
+			}
+		}
+		v.Count++
+		return v, nil
+	}
+	require.NoError(t, s.Update("bucket", "key", increment))
+	require.NoError(t, s.Update("bucket", "key", increment))
+
+	// Returning nil keeps the value
+	require.NoError(t, s.Update("bucket", "key", func(current []byte) (interface{}, error) {
+		return nil, nil
+	}))
+
+	var v mockValue
+	require.NoError(t, s.Get("bucket", "key", &v))
+	require.Equal(t, mockValue{"cgc", 2}, v)
+}
@@ -0,0 +1,287 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type AzureConfig struct {
+	Account   string
+	Container string
+	Directory string
+
+	// Either the base64 account key, to sign requests with, or a SAS token
+	AccountKey string
+	SASToken   string
+
+	// Optional, https://{account}.blob.core.windows.net by default.
+	// For Azurite, use http://127.0.0.1:10000/devstoreaccount1
+	Endpoint string
+
+	// Optional, size of the blocks of large uploads
+	BlockSize int64
+}
+
+const (
+	azureVersion = "2020-10-02"
+
+	DefaultAzureBlockSize int64 = 8 << 20
+)
+
+var (
+	ErrEmptyAzureAccount   = errors.New("empty Azure storage account name")
+	ErrEmptyAzureContainer = errors.New("empty Azure container name")
+	ErrMissingAzureAuth    = errors.New("either an Azure account key or SAS token is required")
+)
+
+type azureUploader struct {
+	account   string
+	container string
+	directory string
+	key       []byte
+	sas       url.Values
+	endpoint  string
+	blockSize int64
+	client    *http.Client
+}
+
+// NewAzureUploader uploads to Azure Blob Storage as block blobs. Objects that fit in a block are
+// put at once, while larger ones are put block by block, then committed.
+func NewAzureUploader(config AzureConfig) (Uploader, error) {
+	if config.Account == "" {
+		return nil, ErrEmptyAzureAccount
+	}
+	if config.Container == "" {
+		return nil, ErrEmptyAzureContainer
+	}
+	u := &azureUploader{
+		account:   config.Account,
+		container: config.Container,
+		directory: config.Directory,
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		blockSize: config.BlockSize,
+		client:    http.DefaultClient,
+	}
+	switch {
+	case config.AccountKey != "":
+		key, err := base64.StdEncoding.DecodeString(config.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure account key: %w", err)
+		}
+		u.key = key
+	case config.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure SAS token: %w", err)
+		}
+		u.sas = sas
+	default:
+		return nil, ErrMissingAzureAuth
+	}
+	if u.endpoint == "" {
+		u.endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", config.Account)
+	}
+	if u.blockSize <= 0 {
+		u.blockSize = DefaultAzureBlockSize
+	}
+	return u, nil
+}
+
+func (a *azureUploader) GetDirectory() string {
+	return a.directory
+}
+
+func (a *azureUploader) objectKey(key string) string {
+	if a.directory != "" {
+		return fmt.Sprintf("%s/%s", a.directory, key)
+	}
+	return key
+}
+
+func (a *azureUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	sums := newChecksummer(body)
+	body = sums
+	block := make([]byte, a.blockSize)
+	var ids []string
+	for {
+		n, err := io.ReadFull(body, block)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		// Small enough to be put at once
+		if last && len(ids) == 0 {
+			return a.putBlob(ctx, object, block[:n])
+		}
+		if n > 0 {
+			// Block IDs must all have the same length
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(ids))))
+			if err = a.putBlock(ctx, object, id, block[:n]); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if last {
+			return a.putBlockList(ctx, object, ids, sums.Checksums())
+		}
+	}
+}
+
+func (a *azureUploader) putBlob(ctx context.Context, object Object, data []byte) error {
+	req, err := a.request(ctx, object, nil, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	if object.ContentType != "" {
+		req.Header.Set("Content-Type", object.ContentType)
+	}
+	setAzureMetadata(req, object)
+	return a.do(req, "put Azure blob")
+}
+
+func (a *azureUploader) putBlock(ctx context.Context, object Object, id string, data []byte) error {
+	req, err := a.request(ctx, object, url.Values{"comp": {"block"}, "blockid": {id}}, data)
+	if err != nil {
+		return err
+	}
+	return a.do(req, "put Azure block")
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+func (a *azureUploader) putBlockList(ctx context.Context, object Object, ids []string, sums Checksums) error {
+	data, err := xml.Marshal(blockList{Latest: ids})
+	if err != nil {
+		return err
+	}
+	req, err := a.request(ctx, object, url.Values{"comp": {"blocklist"}}, append([]byte(xml.Header), data...))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("x-ms-blob-content-md5", base64Digest(sums.MD5))
+	if object.ContentType != "" {
+		req.Header.Set("x-ms-blob-content-type", object.ContentType)
+	}
+	setAzureMetadata(req, object)
+	return a.do(req, "commit Azure blocks")
+}
+
+func setAzureMetadata(req *http.Request, object Object) {
+	for key, value := range object.Metadata {
+		req.Header.Set("x-ms-meta-"+key, value)
+	}
+}
+
+func (a *azureUploader) request(ctx context.Context, object Object, query url.Values, data []byte) (*http.Request, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	for key, values := range a.sas {
+		query[key] = values
+	}
+	blob := (&url.URL{Path: a.objectKey(object.Key)}).EscapedPath()
+	endpoint := fmt.Sprintf("%s/%s/%s", a.endpoint, url.PathEscape(a.container), blob)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	// Azure checks the content against it, and rejects the request if they differ
+	digest := md5.Sum(data)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	return req, nil
+}
+
+func (a *azureUploader) do(req *http.Request, action string) error {
+	if a.key != nil {
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.account, signAzure(req, a.account, a.key)))
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return responseError(action, res)
+	}
+	if reported := res.Header.Get("Content-MD5"); reported != "" && req.URL.Query().Get("comp") != "blocklist" {
+		return verify("Azure MD5", req.Header.Get("Content-MD5"), reported)
+	}
+	return nil
+}
+
+// signAzure signs a request with the account key, as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func signAzure(req *http.Request, account string, key []byte) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = fmt.Sprint(req.ContentLength)
+	}
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var headers []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		lines = append(lines, fmt.Sprintf("%s:%s", name, strings.TrimSpace(req.Header.Get(name))))
+	}
+
+	resource := fmt.Sprintf("/%s%s", account, req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += fmt.Sprintf("\n%s:%s", strings.ToLower(name), strings.Join(values, ","))
+	}
+	lines = append(lines, resource)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,172 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Well-known Azurite development account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeAzure accepts block blob uploads like Azurite does, checking their signatures
+type fakeAzure struct {
+	t        *testing.T
+	requests []*http.Request
+	blocks   map[string][]byte
+	blobs    map[string][]byte
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Signatures are checked against a known one in TestSignAzure
+	require.True(f.t, strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azuriteAccount+":"))
+	f.requests = append(f.requests, r)
+
+	body, _ := io.ReadAll(r.Body)
+	digest := md5.Sum(body)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(digest[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	switch query.Get("comp") {
+	case "block":
+		f.blocks[query.Get("blockid")] = body
+	case "blocklist":
+		var list blockList
+		require.NoError(f.t, xml.Unmarshal(body, &list))
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, f.blocks[id]...)
+		}
+		f.blobs[r.URL.Path] = blob
+	default:
+		f.blobs[r.URL.Path] = body
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	fake := &fakeAzure{t: t, blocks: map[string][]byte{}, blobs: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func TestAzureUploaderPutBlob(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	uploader, err := NewAzureUploader(AzureConfig{
+		Account:    azuriteAccount,
+		AccountKey: azuriteKey,
+		Container:  "recordings",
+		Directory:  "livekit",
+		Endpoint:   server.URL + "/" + azuriteAccount,
+	})
+	require.NoError(t, err)
+
+	err = uploader.Upload(context.Background(), Object{
+		Key:         "a.mp4",
+		ContentType: "video/mp4",
+		Size:        4,
+		Metadata:    map[string]string{MetadataRoom: "room"},
+	}, strings.NewReader("data"))
+	require.NoError(t, err)
+
+	require.Len(t, fake.requests, 1)
+	req := fake.requests[0]
+	require.Equal(t, "BlockBlob", req.Header.Get("x-ms-blob-type"))
+	require.Equal(t, "video/mp4", req.Header.Get("Content-Type"))
+	require.Equal(t, "room", req.Header.Get("x-ms-meta-room"))
+	require.Equal(t, []byte("data"), fake.blobs["/devstoreaccount1/recordings/livekit/a.mp4"])
+}
+
+func TestAzureUploaderBlocks(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	uploader, err := NewAzureUploader(AzureConfig{
+		Account:    azuriteAccount,
+		AccountKey: azuriteKey,
+		Container:  "recordings",
+		Endpoint:   server.URL + "/" + azuriteAccount,
+		BlockSize:  4,
+	})
+	require.NoError(t, err)
+
+	data := []byte("0123456789")
+	err = uploader.Upload(context.Background(), Object{
+		Key:         "a b.webm",
+		ContentType: "video/webm",
+		Size:        -1,
+		Metadata:    map[string]string{MetadataIdentity: "alice"},
+	}, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// Three blocks, then the list
+	require.Len(t, fake.requests, 4)
+	commit := fake.requests[3]
+	require.Equal(t, "video/webm", commit.Header.Get("x-ms-blob-content-type"))
+	require.Equal(t, "alice", commit.Header.Get("x-ms-meta-identity"))
+	digest := md5.Sum(data)
+	require.Equal(t, base64.StdEncoding.EncodeToString(digest[:]), commit.Header.Get("x-ms-blob-content-md5"))
+	require.Equal(t, data, fake.blobs["/devstoreaccount1/recordings/a b.webm"])
+}
+
+func TestAzureUploaderSASToken(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		require.Empty(t, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	uploader, err := NewAzureUploader(AzureConfig{
+		Account:   "account",
+		Container: "recordings",
+		SASToken:  "?sv=2020-10-02&sig=signature",
+		Endpoint:  server.URL,
+	})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.ogg", Size: -1}, strings.NewReader("data")))
+	require.Contains(t, query, "sig=signature")
+}
+
+// The string to sign, following the Shared Key documentation, and its signature were made by hand:
+//
+//	PUT\n\n\n4\njXd/OF09/siBXSD3SWAm3A==\nvideo/mp4\n\n\n\n\n\n\n
+//	x-ms-date:Sun, 18 Oct 2026 12:00:00 GMT\nx-ms-version:2020-10-02\n
+//	/myaccount/recordings/livekit/a.mp4\nblockid:QUFBQQ==\ncomp:block
+func TestSignAzure(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "https://myaccount.blob.core.windows.net/recordings/livekit/a.mp4?comp=block&blockid=QUFBQQ%3D%3D", strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Header.Set("Content-MD5", "jXd/OF09/siBXSD3SWAm3A==")
+	req.Header.Set("Content-Type", "video/mp4")
+	req.Header.Set("x-ms-date", "Sun, 18 Oct 2026 12:00:00 GMT")
+	req.Header.Set("x-ms-version", "2020-10-02")
+
+	key, err := base64.StdEncoding.DecodeString(azuriteKey)
+	require.NoError(t, err)
+	require.Equal(t, "+2M4uacw7DZ+hf5tcN7oNm6fwfFaxSXP4fubcJww1Sk=", signAzure(req, "myaccount", key))
+}
+
+func TestAzureConfigValidation(t *testing.T) {
+	_, err := NewAzureUploader(AzureConfig{Container: "recordings"})
+	require.ErrorIs(t, err, ErrEmptyAzureAccount)
+
+	_, err = NewAzureUploader(AzureConfig{Account: "account"})
+	require.ErrorIs(t, err, ErrEmptyAzureContainer)
+
+	_, err = NewAzureUploader(AzureConfig{Account: "account", Container: "recordings"})
+	require.ErrorIs(t, err, ErrMissingAzureAuth)
+}
@@ -0,0 +1,173 @@
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Checksums of a file, hex encoded
+type Checksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+	CRC32C string `json:"crc32c"`
+}
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// checksummer hashes whatever is read through it
+type checksummer struct {
+	r      io.Reader
+	sha256 hash.Hash
+	md5    hash.Hash
+	crc32c hash.Hash32
+}
+
+func newChecksummer(r io.Reader) *checksummer {
+	return &checksummer{r: r, sha256: sha256.New(), md5: md5.New(), crc32c: crc32.New(crc32c)}
+}
+
+func (c *checksummer) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.sha256.Write(p[:n])
+		c.md5.Write(p[:n])
+		c.crc32c.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *checksummer) Checksums() Checksums {
+	return Checksums{
+		SHA256: hex.EncodeToString(c.sha256.Sum(nil)),
+		MD5:    hex.EncodeToString(c.md5.Sum(nil)),
+		CRC32C: hex.EncodeToString(c.crc32c.Sum(nil)),
+	}
+}
+
+// FileChecksums reads the file through
+func FileChecksums(filename string) (Checksums, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer file.Close()
+	c := newChecksummer(file)
+	if _, err = io.Copy(io.Discard, c); err != nil {
+		return Checksums{}, err
+	}
+	return c.Checksums(), nil
+}
+
+// verify compares what the store reports with what was sent
+func verify(name string, sent string, reported string) error {
+	if !strings.EqualFold(sent, reported) {
+		return fmt.Errorf("%w: %s reported %s, sent %s", ErrChecksumMismatch, name, reported, sent)
+	}
+	return nil
+}
+
+// base64Digest converts a hex digest to the base64 most stores use
+func base64Digest(digest string) string {
+	data, err := hex.DecodeString(digest)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func base64CRC32C(data []byte) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc32.Checksum(data, crc32c))
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// An MD5 ETag, of a whole object or of a multipart upload with its number of parts
+var md5ETag = regexp.MustCompile(`^"?([0-9a-fA-F]{32})(-[0-9]+)?"?$`)
+
+// partHasher keeps the MD5 and CRC32C of each part, as S3 reports those of a multipart upload
+type partHasher struct {
+	r        io.Reader
+	partSize int64
+	md5      hash.Hash
+	crc32c   hash.Hash32
+	written  int64
+	parts    []partSums
+}
+
+type partSums struct {
+	md5    []byte
+	crc32c []byte
+}
+
+func newPartHasher(r io.Reader, partSize int64) *partHasher {
+	return &partHasher{r: r, partSize: partSize, md5: md5.New(), crc32c: crc32.New(crc32c)}
+}
+
+func (h *partHasher) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		take := h.partSize - h.written
+		if int64(len(data)) < take {
+			take = int64(len(data))
+		}
+		h.md5.Write(data[:take])
+		h.crc32c.Write(data[:take])
+		h.written += take
+		data = data[take:]
+		if h.written == h.partSize {
+			h.parts = append(h.parts, partSums{md5: h.md5.Sum(nil), crc32c: h.crc32c.Sum(nil)})
+			h.md5 = md5.New()
+			h.crc32c = crc32.New(crc32c)
+			h.written = 0
+		}
+	}
+	return n, err
+}
+
+func (h *partHasher) sums() []partSums {
+	parts := h.parts
+	if h.written > 0 || len(parts) == 0 {
+		parts = append(parts, partSums{md5: h.md5.Sum(nil), crc32c: h.crc32c.Sum(nil)})
+	}
+	return parts
+}
+
+// ETag of a single or multipart upload of what was read
+func (h *partHasher) ETag(multipart bool) string {
+	parts := h.sums()
+	if !multipart {
+		return hex.EncodeToString(parts[0].md5)
+	}
+	combined := md5.New()
+	for _, part := range parts {
+		combined.Write(part.md5)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(combined.Sum(nil)), len(parts))
+}
+
+// CRC32C of a single or multipart upload of what was read, in base64 as S3 reports it
+func (h *partHasher) CRC32C(multipart bool) string {
+	parts := h.sums()
+	if !multipart {
+		return base64.StdEncoding.EncodeToString(parts[0].crc32c)
+	}
+	combined := crc32.New(crc32c)
+	for _, part := range parts {
+		combined.Write(part.crc32c)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(combined.Sum(nil)), len(parts))
+}
@@ -0,0 +1,63 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartHasherETag(t *testing.T) {
+	h := newPartHasher(strings.NewReader("abcdefghij"), 4)
+	_, err := io.Copy(io.Discard, h)
+	require.NoError(t, err)
+
+	// S3 hashes the MD5s of the parts, and appends how many there are
+	combined := md5.New()
+	for _, part := range []string{"abcd", "efgh", "ij"} {
+		sum := md5.Sum([]byte(part))
+		combined.Write(sum[:])
+	}
+	require.Equal(t, hex.EncodeToString(combined.Sum(nil))+"-3", h.ETag(true))
+
+	// Which is not the MD5 of the object
+	whole := md5.Sum([]byte("abcdefghij"))
+	require.NotContains(t, h.ETag(true), hex.EncodeToString(whole[:]))
+
+	// A single part upload reports the MD5 of the object
+	h = newPartHasher(strings.NewReader("abc"), 4)
+	_, err = io.Copy(io.Discard, h)
+	require.NoError(t, err)
+	single := md5.Sum([]byte("abc"))
+	require.Equal(t, hex.EncodeToString(single[:]), h.ETag(false))
+}
+
+func TestPartHasherCRC32C(t *testing.T) {
+	h := newPartHasher(strings.NewReader("abcdefghij"), 4)
+	_, err := io.Copy(io.Discard, h)
+	require.NoError(t, err)
+
+	// S3 hashes the CRC32Cs of the parts the same way
+	combined := crc32.New(crc32c)
+	for _, part := range []string{"abcd", "efgh", "ij"} {
+		sum := crc32.Checksum([]byte(part), crc32c)
+		combined.Write([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+	}
+	require.Equal(t, base64.StdEncoding.EncodeToString(combined.Sum(nil))+"-3", h.CRC32C(true))
+	require.NotContains(t, h.CRC32C(true), base64CRC32C([]byte("abcdefghij")))
+
+	h = newPartHasher(strings.NewReader("abc"), 4)
+	_, err = io.Copy(io.Discard, h)
+	require.NoError(t, err)
+	require.Equal(t, base64CRC32C([]byte("abc")), h.CRC32C(false))
+}
+
+func TestVerifyIgnoresCase(t *testing.T) {
+	require.NoError(t, verify("MD5", "8d777f385d3dfec8815d20f7496026dc", "8D777F385D3DFEC8815D20F7496026DC"))
+	require.ErrorIs(t, verify("MD5", "8d777f385d3dfec8815d20f7496026dc", "00"), ErrChecksumMismatch)
+}
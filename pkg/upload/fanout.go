@@ -0,0 +1,260 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Policy decides when an upload to several destinations succeeds, so the local file can be deleted
+type Policy string
+
+const (
+	// Every destination has the file
+	PolicyAll Policy = "all"
+	// At least one destination has it
+	PolicyAny Policy = "any"
+	// The first destination has it, the others are best effort
+	PolicyPrimary Policy = "primary"
+)
+
+var (
+	ErrInvalidPolicy      = errors.New("upload policy must be all, any or primary")
+	ErrNoDestinations     = errors.New("no upload destinations")
+	ErrInvalidDestination = errors.New("each upload destination needs a name and exactly one storage")
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyAll, PolicyAny, PolicyPrimary:
+		return p, nil
+	case "":
+		return PolicyAll, nil
+	default:
+		return "", ErrInvalidPolicy
+	}
+}
+
+type Destination struct {
+	Name     string
+	Uploader Uploader
+}
+
+// FanOutError lists the destinations which failed. Key: destination name.
+type FanOutError struct {
+	Failed map[string]error
+}
+
+func (e *FanOutError) Error() string {
+	var names []string
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failures []string
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, e.Failed[name]))
+	}
+	return "cannot upload to " + strings.Join(failures, "; ")
+}
+
+type fanOutUploader struct {
+	policy       Policy
+	destinations []Destination
+}
+
+// NewFanOutUploader uploads every object to all destinations at once. The first destination is the primary one,
+// which gives the location of the recordings.
+func NewFanOutUploader(policy Policy, destinations ...Destination) (Uploader, error) {
+	policy, err := ParsePolicy(string(policy))
+	if err != nil {
+		return nil, err
+	}
+	if len(destinations) == 0 {
+		return nil, ErrNoDestinations
+	}
+	names := make(map[string]bool)
+	for _, d := range destinations {
+		if d.Name == "" || d.Uploader == nil || names[d.Name] {
+			return nil, ErrInvalidDestination
+		}
+		names[d.Name] = true
+	}
+	return &fanOutUploader{
+		policy:       policy,
+		destinations: destinations,
+	}, nil
+}
+
+func (f *fanOutUploader) GetDirectory() string {
+	return f.destinations[0].Uploader.GetDirectory()
+}
+
+func (f *fanOutUploader) Locate(object Object) string {
+	return Location(f.destinations[0].Uploader, object)
+}
+
+func (f *fanOutUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	return f.deliver(ctx, object, body, make(map[string]bool))
+}
+
+// deliver uploads to the destinations which are not delivered yet, and adds those it uploads to.
+// The queue keeps what was delivered with each upload, so its retries skip them. Key: destination name.
+func (f *fanOutUploader) deliver(ctx context.Context, object Object, body io.Reader, delivered map[string]bool) error {
+	// Each destination reads the body on its own, which needs random access
+	source, ok := body.(io.ReaderAt)
+	if !ok || object.Size < 0 {
+		spooled, size, err := spool(body)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			spooled.Close()
+			os.Remove(spooled.Name())
+		}()
+		source, object.Size = spooled, size
+	}
+
+	var pending []Destination
+	for _, d := range f.destinations {
+		if !delivered[d.Name] {
+			pending = append(pending, d)
+		}
+	}
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, d := range pending {
+		wg.Add(1)
+		go func(i int, d Destination) {
+			defer wg.Done()
+			errs[i] = d.Uploader.Upload(ctx, object, io.NewSectionReader(source, 0, object.Size))
+		}(i, d)
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, d := range pending {
+		if errs[i] != nil {
+			failed[d.Name] = errs[i]
+			continue
+		}
+		delivered[d.Name] = true
+	}
+
+	if len(failed) == 0 || f.satisfied(delivered) {
+		if len(failed) > 0 {
+			log.Errorf("upload policy satisfied without every destination | policy: %s, key: %s, error: %v", f.policy, object.Key, &FanOutError{failed})
+		}
+		return nil
+	}
+	return &FanOutError{failed}
+}
+
+// undelivered lists the destinations which don't have the file yet
+func (f *fanOutUploader) undelivered(delivered map[string]bool) []string {
+	var names []string
+	for _, d := range f.destinations {
+		if !delivered[d.Name] {
+			names = append(names, d.Name)
+		}
+	}
+	return names
+}
+
+func (f *fanOutUploader) satisfied(delivered map[string]bool) bool {
+	switch f.policy {
+	case PolicyAny:
+		return len(delivered) > 0
+	case PolicyPrimary:
+		return delivered[f.destinations[0].Name]
+	default:
+		return len(delivered) == len(f.destinations)
+	}
+}
+
+// spool copies a body to a temporary file, so it can be read several times
+func spool(body io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, body)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// FanOutConfig describes extra destinations in a JSON file, e.g.
+// {"destinations": [{"name": "customer", "s3": {"region": "eu-west-1", "bucket": "recordings"}}]}
+type FanOutConfig struct {
+	Destinations []DestinationConfig `json:"destinations"`
+}
+
+// DestinationConfig sets exactly one storage. Fields of the storage configs are matched by name, e.g. "bucket".
+type DestinationConfig struct {
+	Name   string        `json:"name"`
+	S3     *S3Config     `json:"s3,omitempty"`
+	GCS    *GCSConfig    `json:"gcs,omitempty"`
+	Azure  *AzureConfig  `json:"azure,omitempty"`
+	SFTP   *SFTPConfig   `json:"sftp,omitempty"`
+	WebDAV *WebDAVConfig `json:"webdav,omitempty"`
+	File   *FileConfig   `json:"file,omitempty"`
+}
+
+func LoadDestinations(filename string) ([]Destination, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config FanOutConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	var destinations []Destination
+	for i, c := range config.Destinations {
+		uploader, err := c.uploader()
+		if err != nil {
+			return nil, fmt.Errorf("destination %d (%s): %w", i, c.Name, err)
+		}
+		destinations = append(destinations, Destination{Name: c.Name, Uploader: uploader})
+	}
+	return destinations, nil
+}
+
+func (c DestinationConfig) uploader() (Uploader, error) {
+	var uploaders []func() (Uploader, error)
+	if c.S3 != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewS3Uploader(*c.S3) })
+	}
+	if c.GCS != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewGCSUploader(*c.GCS) })
+	}
+	if c.Azure != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewAzureUploader(*c.Azure) })
+	}
+	if c.SFTP != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewSFTPUploader(*c.SFTP) })
+	}
+	if c.WebDAV != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewWebDAVUploader(*c.WebDAV) })
+	}
+	if c.File != nil {
+		uploaders = append(uploaders, func() (Uploader, error) { return NewFileUploader(*c.File) })
+	}
+	if c.Name == "" || len(uploaders) != 1 {
+		return nil, ErrInvalidDestination
+	}
+	return uploaders[0]()
+}
@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryUploader keeps what it receives, or fails while err is set
+type memoryUploader struct {
+	lock    sync.Mutex
+	err     error
+	objects map[string][]byte
+}
+
+func newMemoryUploader() *memoryUploader {
+	return &memoryUploader{objects: make(map[string][]byte)}
+}
+
+func (m *memoryUploader) GetDirectory() string {
+	return "memory"
+}
+
+func (m *memoryUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.objects[object.Key] = data
+	return nil
+}
+
+func TestFanOutAll(t *testing.T) {
+	primary, customer := newMemoryUploader(), newMemoryUploader()
+	customer.err = errors.New("denied")
+	uploader, err := NewFanOutUploader(PolicyAll, Destination{"primary", primary}, Destination{"customer", customer})
+	require.NoError(t, err)
+
+	object := Object{Key: "a.mp4", Size: -1}
+	delivered := make(map[string]bool)
+	err = uploader.(*fanOutUploader).deliver(context.Background(), object, strings.NewReader("data"), delivered)
+	var fanOutErr *FanOutError
+	require.ErrorAs(t, err, &fanOutErr)
+	require.Len(t, fanOutErr.Failed, 1)
+	require.Contains(t, fanOutErr.Failed, "customer")
+	require.Equal(t, []byte("data"), primary.objects["a.mp4"])
+	require.Equal(t, map[string]bool{"primary": true}, delivered)
+
+	// The retry only goes to the destination which failed
+	delete(primary.objects, "a.mp4")
+	customer.err = nil
+	require.NoError(t, uploader.(*fanOutUploader).deliver(context.Background(), object, strings.NewReader("data"), delivered))
+	require.NotContains(t, primary.objects, "a.mp4")
+	require.Equal(t, []byte("data"), customer.objects["a.mp4"])
+}
+
+func TestFanOutAny(t *testing.T) {
+	primary, customer := newMemoryUploader(), newMemoryUploader()
+	primary.err = errors.New("unavailable")
+	uploader, err := NewFanOutUploader(PolicyAny, Destination{"primary", primary}, Destination{"customer", customer})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: -1}, strings.NewReader("data")))
+
+	customer.err = errors.New("unavailable")
+	require.Error(t, uploader.Upload(context.Background(), Object{Key: "b.mp4", Size: -1}, strings.NewReader("data")))
+}
+
+func TestFanOutPrimary(t *testing.T) {
+	primary, customer := newMemoryUploader(), newMemoryUploader()
+	customer.err = errors.New("unavailable")
+	uploader, err := NewFanOutUploader(PolicyPrimary, Destination{"primary", primary}, Destination{"customer", customer})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: -1}, strings.NewReader("data")))
+
+	primary.err, customer.err = errors.New("unavailable"), nil
+	require.Error(t, uploader.Upload(context.Background(), Object{Key: "b.mp4", Size: -1}, strings.NewReader("data")))
+	require.Equal(t, "memory/a.mp4", Location(uploader, Object{Key: "a.mp4"}))
+}
+
+func TestFanOutReadsFilesConcurrently(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.mp4")
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0644))
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, b := newMemoryUploader(), newMemoryUploader()
+	uploader, err := NewFanOutUploader(PolicyAll, Destination{"a", a}, Destination{"b", b})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, f))
+	require.Equal(t, []byte("data"), a.objects["a.mp4"])
+	require.Equal(t, []byte("data"), b.objects["a.mp4"])
+}
+
+func TestFanOutValidation(t *testing.T) {
+	_, err := NewFanOutUploader("most", Destination{"a", newMemoryUploader()})
+	require.ErrorIs(t, err, ErrInvalidPolicy)
+	_, err = NewFanOutUploader(PolicyAll)
+	require.ErrorIs(t, err, ErrNoDestinations)
+	_, err = NewFanOutUploader(PolicyAll, Destination{"a", newMemoryUploader()}, Destination{"a", newMemoryUploader()})
+	require.ErrorIs(t, err, ErrInvalidDestination)
+}
+
+func TestLoadDestinations(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "destinations.json")
+	config := `{"destinations": [
+		{"name": "archive", "file": {"root": "` + filepath.Join(dir, "archive") + `"}},
+		{"name": "customer", "webdav": {"url": "https://dav.example.com", "directory": "recordings"}}
+	]}`
+	require.NoError(t, os.WriteFile(file, []byte(config), 0644))
+
+	destinations, err := LoadDestinations(file)
+	require.NoError(t, err)
+	require.Len(t, destinations, 2)
+	require.Equal(t, "archive", destinations[0].Name)
+	require.Equal(t, "recordings", destinations[1].Uploader.GetDirectory())
+
+	require.NoError(t, os.WriteFile(file, []byte(`{"destinations": [{"name": "both", "file": {"root": "a"}, "webdav": {"url": "b"}}]}`), 0644))
+	_, err = LoadDestinations(file)
+	require.ErrorIs(t, err, ErrInvalidDestination)
+}
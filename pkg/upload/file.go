@@ -0,0 +1,196 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type FileConfig struct {
+	// Directory the files are moved to, e.g. a mounted network share
+	Root string
+
+	// Optional, layout of the directories under the root as a text/template,
+	// e.g. "{{.Room}}/{{.Date}}". Fields are Room, Identity, RecordingID, Date, Year, Month and Day.
+	Template string
+}
+
+var (
+	ErrEmptyRoot      = errors.New("empty upload directory")
+	ErrOutsideOfRoot  = errors.New("templated directory is outside of the upload directory")
+	ErrInvalidSegment = errors.New("templated directory has an empty segment")
+)
+
+type fileUploader struct {
+	root     string
+	template *template.Template
+}
+
+// templateData is what directory templates can use. Values never contain path separators.
+type templateData struct {
+	Room        string
+	Identity    string
+	RecordingID string
+	Date        string
+	Year        string
+	Month       string
+	Day         string
+}
+
+// NewFileUploader writes files to a directory, so recordings can be kept without an object store
+func NewFileUploader(config FileConfig) (Uploader, error) {
+	if config.Root == "" {
+		return nil, ErrEmptyRoot
+	}
+	root, err := filepath.Abs(config.Root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	u := &fileUploader{root: root}
+	if config.Template != "" {
+		if u.template, err = template.New("directory").Option("missingkey=error").Parse(config.Template); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (f *fileUploader) GetDirectory() string {
+	return f.root
+}
+
+func (f *fileUploader) Locate(object Object) string {
+	path, err := f.path(object)
+	if err != nil {
+		return filepath.Join(f.root, object.Key)
+	}
+	return path
+}
+
+// path renders the directory of the object, which always stays under the root
+func (f *fileUploader) path(object Object) (string, error) {
+	if f.template == nil {
+		return f.inRoot(filepath.Join(f.root, object.Key))
+	}
+
+	t := object.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.UTC()
+	data := templateData{
+		Room:        sanitise(object.Metadata[MetadataRoom]),
+		Identity:    sanitise(object.Metadata[MetadataIdentity]),
+		RecordingID: sanitise(object.Metadata[MetadataRecordingID]),
+		Date:        t.Format("2006-01-02"),
+		Year:        t.Format("2006"),
+		Month:       t.Format("01"),
+		Day:         t.Format("02"),
+	}
+	var dir bytes.Buffer
+	if err := f.template.Execute(&dir, data); err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(dir.String(), "/") {
+		if segment == "" {
+			return "", ErrInvalidSegment
+		}
+	}
+	return f.inRoot(filepath.Join(f.root, dir.String(), filepath.Base(object.Key)))
+}
+
+func (f *fileUploader) inRoot(path string) (string, error) {
+	if !strings.HasPrefix(path, f.root+string(filepath.Separator)) {
+		return "", ErrOutsideOfRoot
+	}
+	return path, nil
+}
+
+// sanitise keeps a value to a single directory name
+func sanitise(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// Upload writes to a temporary file next to the destination, syncs it, then renames it into place,
+// so readers of the directory never see a partial file
+func (f *fileUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	path, err := f.path(object)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	sums := newChecksummer(&contextReader{ctx, body})
+	if _, err = io.Copy(tmp, sums); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// Read back what was written, in case the disk didn't keep it
+	written, err := FileChecksums(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err = verify("file SHA-256", sums.Checksums().SHA256, written.SHA256); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// contextReader stops reading once the context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
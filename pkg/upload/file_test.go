@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileUploader(t *testing.T) {
+	root := t.TempDir()
+	uploader, err := NewFileUploader(FileConfig{Root: root})
+	require.NoError(t, err)
+
+	object := Object{Key: "a.webm", Size: 4}
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+
+	data, err := os.ReadFile(filepath.Join(root, "a.webm"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+	require.Equal(t, filepath.Join(root, "a.webm"), Location(uploader, object))
+
+	// No temporary files are left behind
+	files, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestFileUploaderTemplate(t *testing.T) {
+	root := t.TempDir()
+	uploader, err := NewFileUploader(FileConfig{Root: root, Template: "{{.Room}}/{{.Date}}/{{.Identity}}"})
+	require.NoError(t, err)
+
+	object := Object{
+		Key:      "a.mp4",
+		Metadata: map[string]string{MetadataRoom: "team/room", MetadataIdentity: ".."},
+		Time:     time.Date(2022, 3, 4, 10, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+
+	// Values can't add directories or escape the root
+	path := filepath.Join(root, "team_room", "2022-03-04", "_", "a.mp4")
+	require.FileExists(t, path)
+	require.Equal(t, path, Location(uploader, object))
+}
+
+func TestFileUploaderStaysInRoot(t *testing.T) {
+	uploader, err := NewFileUploader(FileConfig{Root: t.TempDir(), Template: "../{{.Room}}"})
+	require.NoError(t, err)
+
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4"}, strings.NewReader("data"))
+	require.ErrorIs(t, err, ErrOutsideOfRoot)
+}
+
+func TestFileUploaderCancelled(t *testing.T) {
+	root := t.TempDir()
+	uploader, err := NewFileUploader(FileConfig{Root: root})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = uploader.Upload(ctx, Object{Key: "a.mp4"}, strings.NewReader("data"))
+	require.ErrorIs(t, err, context.Canceled)
+
+	files, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
@@ -0,0 +1,438 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+type GCSConfig struct {
+	Bucket    string
+	Directory string
+
+	// Optional, the emulator URL when testing, e.g. fake-gcs-server
+	Endpoint string
+
+	// Optional, service account key file. Without it, tokens come from the metadata server,
+	// unless an endpoint is set, as emulators don't need any.
+	CredentialsFile string
+
+	// Optional, size of the chunks of resumable uploads, rounded down to a multiple of 256KiB
+	ChunkSize int64
+}
+
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// GCS requires chunks to be multiples of this, except for the last one
+	gcsChunkUnit        int64 = 256 << 10
+	DefaultGCSChunkSize int64 = 8 << 20
+	gcsStatusIncomplete       = 308
+
+	// Times a chunk is sent again after an interruption, or after GCS kept none of it, before the upload fails
+	gcsMaxRetries = 5
+	gcsRetryWait  = time.Second
+)
+
+var (
+	ErrEmptyGCSBucketName = errors.New("empty GCS bucket name")
+	ErrInvalidCredentials = errors.New("invalid service account credentials")
+
+	// The session is still valid, it can be asked how much it has and resumed
+	errGCSInterrupted = errors.New("GCS upload interrupted")
+)
+
+type gcsUploader struct {
+	bucket    string
+	directory string
+	endpoint  string
+	chunkSize int64
+	client    *http.Client
+	tokens    tokenSource
+	retryWait time.Duration
+}
+
+// NewGCSUploader uploads to Google Cloud Storage through its JSON API, with resumable uploads
+func NewGCSUploader(config GCSConfig) (Uploader, error) {
+	if config.Bucket == "" {
+		return nil, ErrEmptyGCSBucketName
+	}
+	u := &gcsUploader{
+		bucket:    config.Bucket,
+		directory: config.Directory,
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		chunkSize: config.ChunkSize / gcsChunkUnit * gcsChunkUnit,
+		client:    http.DefaultClient,
+		retryWait: gcsRetryWait,
+	}
+	if u.chunkSize <= 0 {
+		u.chunkSize = DefaultGCSChunkSize
+	}
+
+	switch {
+	case config.CredentialsFile != "":
+		tokens, err := newServiceAccountTokens(config.CredentialsFile, u.client)
+		if err != nil {
+			return nil, err
+		}
+		u.tokens = tokens
+	case u.endpoint == "":
+		u.tokens = &cachedTokens{fetch: metadataToken(u.client)}
+	}
+	if u.endpoint == "" {
+		u.endpoint = gcsEndpoint
+	}
+	return u, nil
+}
+
+func (g *gcsUploader) GetDirectory() string {
+	return g.directory
+}
+
+func (g *gcsUploader) objectKey(key string) string {
+	if g.directory != "" {
+		return fmt.Sprintf("%s/%s", g.directory, key)
+	}
+	return key
+}
+
+// Upload starts a resumable upload, then sends the body one chunk at a time. GCS may keep only part of a chunk,
+// and after an interruption it is asked how much it has, so the rest is sent again rather than the whole body.
+func (g *gcsUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	session, err := g.startSession(ctx, object)
+	if err != nil {
+		return err
+	}
+
+	sums := newChecksummer(body)
+	// What GCS doesn't have yet, starting at offset
+	chunk := make([]byte, 0, g.chunkSize)
+	var offset int64
+	last := false
+	retries := 0
+	for {
+		if !last {
+			n, err := io.ReadFull(sums, chunk[len(chunk):cap(chunk)])
+			chunk = chunk[:len(chunk)+n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		persisted, stored, err := g.sendChunk(ctx, session, chunk, offset, last)
+		for errors.Is(err, errGCSInterrupted) && retries < gcsMaxRetries {
+			retries++
+			log.Warnf("GCS upload interrupted, resuming | error: %v, key: %s, offset: %d", err, object.Key, offset)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(retries) * g.retryWait):
+			}
+			persisted, stored, err = g.sendChunk(ctx, session, nil, 0, false)
+		}
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			return stored.verify(sums.Checksums())
+		}
+
+		// Keep what GCS doesn't have at the front of the next chunk
+		if persisted < offset || persisted > offset+int64(len(chunk)) {
+			return fmt.Errorf("GCS has %d bytes of the upload, expected %d to %d", persisted, offset, offset+int64(len(chunk)))
+		}
+		if persisted > offset {
+			retries = 0
+		} else if retries++; retries > gcsMaxRetries {
+			return fmt.Errorf("GCS kept none of the upload from %d", offset)
+		}
+		chunk = chunk[:copy(chunk, chunk[persisted-offset:])]
+		offset = persisted
+	}
+}
+
+func (g *gcsUploader) startSession(ctx context.Context, object Object) (string, error) {
+	metadata, err := json.Marshal(map[string]interface{}{
+		"name":        g.objectKey(object.Key),
+		"contentType": object.ContentType,
+		"metadata":    object.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"uploadType": {"resumable"}, "name": {g.objectKey(object.Key)}}
+	endpoint := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(g.bucket), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if object.ContentType != "" {
+		req.Header.Set("X-Upload-Content-Type", object.ContentType)
+	}
+	if object.Size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", fmt.Sprint(object.Size))
+	}
+
+	res, err := g.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", responseError("start GCS upload", res)
+	}
+	session := res.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("GCS upload has no session")
+	}
+	return session, nil
+}
+
+// gcsObject is what GCS reports of an uploaded object
+type gcsObject struct {
+	MD5Hash string `json:"md5Hash"`
+	CRC32C  string `json:"crc32c"`
+}
+
+// verify compares the checksums GCS computed with those of what was sent. Both are base64.
+func (o gcsObject) verify(sent Checksums) error {
+	if o.MD5Hash != "" {
+		if err := verify("GCS MD5", base64Digest(sent.MD5), o.MD5Hash); err != nil {
+			return err
+		}
+	}
+	if o.CRC32C != "" {
+		return verify("GCS CRC32C", base64Digest(sent.CRC32C), o.CRC32C)
+	}
+	return nil
+}
+
+// sendChunk sends part of the body, and returns how many bytes of the upload GCS has, or the object once complete.
+// The total size is only given with the last chunk. An empty chunk which isn't the last asks for the status.
+func (g *gcsUploader) sendChunk(ctx context.Context, session string, chunk []byte, offset int64, last bool) (int64, *gcsObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, nil, err
+	}
+	total := "*"
+	if last {
+		total = fmt.Sprint(offset + int64(len(chunk)))
+	}
+	if len(chunk) == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%s", total))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, total))
+	}
+
+	res, err := g.do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		return 0, nil, fmt.Errorf("%w: %v", errGCSInterrupted, err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated:
+		var stored gcsObject
+		if err = json.NewDecoder(res.Body).Decode(&stored); err != nil {
+			return 0, nil, err
+		}
+		return 0, &stored, nil
+	case res.StatusCode == gcsStatusIncomplete:
+		return persistedRange(res.Header.Get("Range"))
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return 0, nil, fmt.Errorf("%w: %v", errGCSInterrupted, responseError("upload GCS chunk", res))
+	default:
+		return 0, nil, responseError("upload GCS chunk", res)
+	}
+}
+
+// persistedRange reads the Range header of an incomplete upload, e.g. "bytes=0-262143". There is none before the first byte.
+func persistedRange(header string) (int64, *gcsObject, error) {
+	if header == "" {
+		return 0, nil, nil
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &start, &end); err != nil || start != 0 {
+		return 0, nil, fmt.Errorf("invalid GCS range %q", header)
+	}
+	return end + 1, nil, nil
+}
+
+func (g *gcsUploader) do(req *http.Request) (*http.Response, error) {
+	if g.tokens != nil {
+		token, err := g.tokens.Token(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return g.client.Do(req)
+}
+
+// responseError reports an unexpected response with what the server said
+func responseError(action string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("cannot %s: %s: %s", action, res.Status, strings.TrimSpace(string(body)))
+}
+
+type tokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// cachedTokens reuses a token until shortly before it expires
+type cachedTokens struct {
+	fetch func(ctx context.Context) (string, time.Duration, error)
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (c *cachedTokens) Token(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	token, ttl, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expires = time.Now().Add(ttl - time.Minute)
+	return token, nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func readToken(res *http.Response) (string, time.Duration, error) {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", 0, responseError("get GCS token", res)
+	}
+	var token tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// metadataToken gets tokens of the service account of the instance, when running on GCP
+func metadataToken(client *http.Client) func(ctx context.Context) (string, time.Duration, error) {
+	return func(ctx context.Context) (string, time.Duration, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataToken, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		res, err := client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readToken(res)
+	}
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// newServiceAccountTokens exchanges JWTs signed with the service account key for tokens
+func newServiceAccountTokens(file string, client *http.Client) (tokenSource, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if account.ClientEmail == "" || account.TokenURI == "" || block == nil {
+		return nil, ErrInvalidCredentials
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &cachedTokens{fetch: func(ctx context.Context) (string, time.Duration, error) {
+		assertion, err := signJWT(key, account, time.Now())
+		if err != nil {
+			return "", 0, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readToken(res)
+	}}, nil
+}
+
+func signJWT(key *rsa.PrivateKey, account serviceAccount, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,234 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCS accepts resumable uploads like fake-gcs-server does
+type fakeGCS struct {
+	metadata map[string]interface{}
+	ranges   []string
+	body     bytes.Buffer
+	auth     string
+
+	// Reports checksums of something else
+	corrupt bool
+	// Keeps at most this much of each chunk, if set
+	keep int64
+	// Chunks failed before one is accepted
+	failures int
+	sessions int
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.auth = r.Header.Get("Authorization")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "resumable":
+		_ = json.NewDecoder(r.Body).Decode(&f.metadata)
+		f.sessions++
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+	case r.Method == http.MethodPut && r.URL.Path == "/session":
+		contentRange := r.Header.Get("Content-Range")
+		f.ranges = append(f.ranges, contentRange)
+		data, _ := io.ReadAll(r.Body)
+		if f.failures > 0 && len(data) > 0 {
+			f.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// Chunks must carry on from what is stored
+		start := int64(f.body.Len())
+		if !strings.HasPrefix(contentRange, "bytes */") {
+			var end int64
+			_, _ = fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end)
+		}
+		if start != int64(f.body.Len()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.HasSuffix(contentRange, "/*") {
+			if f.keep > 0 && int64(len(data)) > f.keep {
+				data = data[:f.keep]
+			}
+			f.body.Write(data)
+			if f.body.Len() > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", f.body.Len()-1))
+			}
+			w.WriteHeader(gcsStatusIncomplete)
+			return
+		}
+		f.body.Write(data)
+		stored := f.body.Bytes()
+		if f.corrupt {
+			stored = []byte("corrupt")
+		}
+		md5Hash := md5.Sum(stored)
+		_ = json.NewEncoder(w).Encode(gcsObject{
+			MD5Hash: base64.StdEncoding.EncodeToString(md5Hash[:]),
+			CRC32C:  base64CRC32C(stored),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGCSUploaderResumable(t *testing.T) {
+	fake := &fakeGCS{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{
+		Bucket:    "recordings",
+		Directory: "livekit",
+		Endpoint:  server.URL,
+		ChunkSize: gcsChunkUnit + 1,
+	})
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("a"), int(2*gcsChunkUnit+10))
+	err = uploader.Upload(context.Background(), Object{
+		Key:         "a.mp4",
+		ContentType: "video/mp4",
+		Size:        int64(len(data)),
+		Metadata:    map[string]string{MetadataRoom: "room"},
+	}, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	require.Equal(t, "livekit/a.mp4", fake.metadata["name"])
+	require.Equal(t, "video/mp4", fake.metadata["contentType"])
+	require.Equal(t, map[string]interface{}{MetadataRoom: "room"}, fake.metadata["metadata"])
+	require.Equal(t, []string{
+		"bytes 0-262143/*",
+		"bytes 262144-524287/*",
+		"bytes 524288-524297/524298",
+	}, fake.ranges)
+	require.Equal(t, data, fake.body.Bytes())
+	require.Empty(t, fake.auth)
+}
+
+func TestGCSUploaderResendsWhatWasNotKept(t *testing.T) {
+	fake := &fakeGCS{keep: gcsChunkUnit}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{Bucket: "recordings", Endpoint: server.URL, ChunkSize: 2 * gcsChunkUnit})
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), int(3*gcsChunkUnit/10+1))
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: int64(len(data))}, bytes.NewReader(data)))
+	require.Equal(t, data, fake.body.Bytes())
+	require.Equal(t, []string{
+		"bytes 0-524287/*",
+		"bytes 262144-786431/*",
+		"bytes 524288-786439/786440",
+	}, fake.ranges)
+}
+
+func TestGCSUploaderResumesAfterInterruption(t *testing.T) {
+	fake := &fakeGCS{failures: 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{Bucket: "recordings", Endpoint: server.URL, ChunkSize: gcsChunkUnit})
+	require.NoError(t, err)
+	uploader.(*gcsUploader).retryWait = time.Millisecond
+
+	data := bytes.Repeat([]byte("a"), int(gcsChunkUnit+10))
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: int64(len(data))}, bytes.NewReader(data)))
+	require.Equal(t, data, fake.body.Bytes())
+
+	// The session is asked what it has, and the chunk is sent again in the same session
+	require.Equal(t, 1, fake.sessions)
+	require.Equal(t, []string{
+		"bytes 0-262143/*",
+		"bytes */*",
+		"bytes 0-262143/*",
+		"bytes 262144-262153/262154",
+	}, fake.ranges)
+}
+
+func TestGCSUploaderEmptyObject(t *testing.T) {
+	fake := &fakeGCS{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{Bucket: "recordings", Endpoint: server.URL})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.ogg", Size: 0}, strings.NewReader("")))
+	require.Equal(t, []string{"bytes */0"}, fake.ranges)
+}
+
+func TestGCSUploaderServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var assertion string
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assertion = r.PostForm.Get("assertion")
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+
+	encoded, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	credentials, err := json.Marshal(serviceAccount{
+		ClientEmail: "recorder@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded})),
+		TokenURI:    tokens.URL,
+	})
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(file, credentials, 0600))
+
+	fake := &fakeGCS{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{Bucket: "recordings", Endpoint: server.URL, CredentialsFile: file})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.ogg", Size: -1}, strings.NewReader("data")))
+	require.Equal(t, "Bearer token", fake.auth)
+	require.Len(t, strings.Split(assertion, "."), 3)
+}
+
+func TestGCSConfigValidation(t *testing.T) {
+	_, err := NewGCSUploader(GCSConfig{})
+	require.ErrorIs(t, err, ErrEmptyGCSBucketName)
+
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"client_email":"a"}`), 0600))
+	_, err = NewGCSUploader(GCSConfig{Bucket: "b", CredentialsFile: file})
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestGCSUploaderVerifiesChecksums(t *testing.T) {
+	fake := &fakeGCS{corrupt: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewGCSUploader(GCSConfig{Bucket: "recordings", Endpoint: server.URL})
+	require.NoError(t, err)
+	err = uploader.Upload(context.Background(), Object{Key: "a.ogg", Size: -1}, strings.NewReader("data"))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
@@ -0,0 +1,199 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTPTarget is where a single recording is sent, e.g. a presigned S3 PUT URL
+type HTTPTarget struct {
+	URL string `json:"url"`
+
+	// Optional, PUT by default
+	Method string `json:"method,omitempty"`
+
+	// Optional, sent as they are, e.g. the headers a presigned URL was signed with
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+var (
+	ErrInvalidUploadURL     = errors.New("upload URL must be an absolute http or https URL")
+	ErrInvalidUploadMethod  = errors.New("upload method must be PUT or POST")
+	ErrUploadHostNotAllowed = errors.New("upload URL host is not allowed")
+)
+
+// Validate checks the target before any recording is made for it
+func (t HTTPTarget) Validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidUploadURL
+	}
+	switch strings.ToUpper(t.Method) {
+	case "", http.MethodPut, http.MethodPost:
+		return nil
+	default:
+		return ErrInvalidUploadMethod
+	}
+}
+
+// HTTPPolicy restricts where upload URLs send recordings, as they come from API requests
+type HTTPPolicy struct {
+	// Optional, the only hosts allowed, "*.example.com" allows its subdomains
+	Hosts []string
+
+	// Allows private, loopback and link-local addresses, which are refused otherwise
+	AllowPrivate bool
+}
+
+// Check validates the target and its host. Addresses are checked again when connecting, since names may resolve anywhere.
+func (p HTTPPolicy) Check(t HTTPTarget) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	u, _ := url.Parse(t.URL)
+	host := strings.ToLower(u.Hostname())
+	if len(p.Hosts) > 0 && !p.allowsHost(host) {
+		return fmt.Errorf("%w: %s", ErrUploadHostNotAllowed, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !p.allowsIP(ip) {
+		return fmt.Errorf("%w: %s", ErrUploadHostNotAllowed, host)
+	}
+	return nil
+}
+
+func (p HTTPPolicy) allowsHost(host string) bool {
+	for _, allowed := range p.Hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p HTTPPolicy) allowsIP(ip net.IP) bool {
+	if p.AllowPrivate {
+		return true
+	}
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// client refuses addresses the policy doesn't allow, once resolved, and doesn't follow redirects.
+// It connects directly, without the proxy of the environment, so the address checked is the one reached.
+func (p HTTPPolicy) client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !p.allowsIP(ip) {
+				return fmt.Errorf("%w: %s", ErrUploadHostNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+type httpUploader struct {
+	target HTTPTarget
+	client *http.Client
+}
+
+// NewHTTPUploader streams files to the URL of the target, so the recorder doesn't need credentials of its own.
+// The URL only takes one file, every upload goes to the same place.
+func NewHTTPUploader(target HTTPTarget, policy HTTPPolicy) (Uploader, error) {
+	if err := policy.Check(target); err != nil {
+		return nil, err
+	}
+	if target.Method == "" {
+		target.Method = http.MethodPut
+	}
+	target.Method = strings.ToUpper(target.Method)
+	return &httpUploader{target: target, client: policy.client()}, nil
+}
+
+func (h *httpUploader) GetDirectory() string {
+	return ""
+}
+
+// Locate leaves out the query, where presigned URLs keep their signature
+func (h *httpUploader) Locate(object Object) string {
+	u, err := url.Parse(h.target.URL)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
+
+func (h *httpUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	sums := newChecksummer(body)
+	req, err := http.NewRequestWithContext(ctx, h.target.Method, h.target.URL, sums)
+	if err != nil {
+		return err
+	}
+	// Presigned URLs don't accept chunked uploads, the size is sent whenever it's known
+	if object.Size >= 0 {
+		req.ContentLength = object.Size
+	}
+	if object.ContentType != "" {
+		req.Header.Set("Content-Type", object.ContentType)
+	}
+	for key, value := range h.target.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return responseError("upload to URL", res)
+	}
+
+	if crc := res.Header.Get("X-Amz-Checksum-Crc32c"); crc != "" {
+		return verify("URL CRC32C", base64Digest(sums.Checksums().CRC32C), crc)
+	}
+
+	// Stores such as S3 and GCS reply with the MD5 as the ETag of single uploads they don't encrypt with other keys
+	if etag := md5ETag.FindStringSubmatch(res.Header.Get("ETag")); etag != nil && etag[2] == "" && etagIsMD5(res.Header) {
+		return verify("URL ETag", sums.Checksums().MD5, etag[1])
+	}
+	return nil
+}
+
+// etagIsMD5 reports whether S3 or GCS would send the MD5 as the ETag of an object encrypted this way.
+// Objects encrypted with KMS or customer keys have other ETags, even when they look like MD5s.
+func etagIsMD5(header http.Header) bool {
+	switch header.Get("X-Amz-Server-Side-Encryption") {
+	case "", "AES256":
+	default:
+		return false
+	}
+	return header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == "" &&
+		header.Get("X-Goog-Encryption-Algorithm") == "" &&
+		header.Get("X-Goog-Encryption-Kms-Key-Name") == ""
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPUploader(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	uploader, err := NewHTTPUploader(HTTPTarget{
+		URL:     server.URL + "/recordings/a.mp4?X-Amz-Signature=secret",
+		Headers: map[string]string{"Content-Type": "application/octet-stream", "X-Custom": "value"},
+	}, HTTPPolicy{AllowPrivate: true})
+	require.NoError(t, err)
+
+	object := Object{Key: "a.mp4", ContentType: "video/mp4", Size: 4}
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+	require.Equal(t, http.MethodPut, received.Method)
+	require.Equal(t, "X-Amz-Signature=secret", received.URL.RawQuery)
+	require.Equal(t, int64(4), received.ContentLength)
+	require.Empty(t, received.TransferEncoding)
+	require.Equal(t, "application/octet-stream", received.Header.Get("Content-Type"))
+	require.Equal(t, "value", received.Header.Get("X-Custom"))
+	require.Equal(t, []byte("data"), body)
+
+	// The signature is kept out of the output
+	require.Equal(t, server.URL+"/recordings/a.mp4", Location(uploader, object))
+}
+
+func TestHTTPUploaderVerifiesETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", `"8d777f385d3dfec8815d20f7496026dc"`)
+	}))
+	defer server.Close()
+
+	uploader, err := NewHTTPUploader(HTTPTarget{URL: server.URL + "/a.mp4"}, HTTPPolicy{AllowPrivate: true})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, strings.NewReader("data")))
+
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, strings.NewReader("atad"))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestHTTPUploaderSkipsETagOfEncryptedObjects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", `"00000000000000000000000000000000"`)
+		w.Header().Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	}))
+	defer server.Close()
+
+	uploader, err := NewHTTPUploader(HTTPTarget{URL: server.URL + "/a.mp4"}, HTTPPolicy{AllowPrivate: true})
+	require.NoError(t, err)
+	require.NoError(t, uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, strings.NewReader("data")))
+}
+
+func TestHTTPUploaderFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	uploader, err := NewHTTPUploader(HTTPTarget{URL: server.URL, Method: "post"}, HTTPPolicy{AllowPrivate: true})
+	require.NoError(t, err)
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: -1}, strings.NewReader("data"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "403")
+}
+
+func TestHTTPTargetValidation(t *testing.T) {
+	require.ErrorIs(t, HTTPTarget{URL: "recordings/a.mp4"}.Validate(), ErrInvalidUploadURL)
+	require.ErrorIs(t, HTTPTarget{URL: "ftp://example.com/a.mp4"}.Validate(), ErrInvalidUploadURL)
+	require.ErrorIs(t, HTTPTarget{URL: "https://example.com/a.mp4", Method: "DELETE"}.Validate(), ErrInvalidUploadMethod)
+	require.NoError(t, HTTPTarget{URL: "https://example.com/a.mp4", Method: "POST"}.Validate())
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	target := func(url string) HTTPTarget {
+		return HTTPTarget{URL: url}
+	}
+	require.NoError(t, HTTPPolicy{}.Check(target("https://bucket.s3.amazonaws.com/a.mp4")))
+	require.ErrorIs(t, HTTPPolicy{}.Check(target("http://169.254.169.254/latest")), ErrUploadHostNotAllowed)
+	require.ErrorIs(t, HTTPPolicy{}.Check(target("http://10.0.0.1/a.mp4")), ErrUploadHostNotAllowed)
+	require.ErrorIs(t, HTTPPolicy{}.Check(target("http://[::1]/a.mp4")), ErrUploadHostNotAllowed)
+	require.NoError(t, HTTPPolicy{AllowPrivate: true}.Check(target("http://10.0.0.1/a.mp4")))
+
+	hosts := HTTPPolicy{Hosts: []string{"uploads.example.com", "*.s3.amazonaws.com"}}
+	require.NoError(t, hosts.Check(target("https://uploads.example.com/a.mp4")))
+	require.NoError(t, hosts.Check(target("https://bucket.s3.amazonaws.com/a.mp4")))
+	require.ErrorIs(t, hosts.Check(target("https://example.com/a.mp4")), ErrUploadHostNotAllowed)
+	require.ErrorIs(t, hosts.Check(target("https://evils3.amazonaws.com/a.mp4")), ErrUploadHostNotAllowed)
+}
+
+func TestHTTPUploaderRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request reached a private address")
+	}))
+	defer server.Close()
+
+	// Names are checked once resolved
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	uploader, err := NewHTTPUploader(HTTPTarget{URL: url}, HTTPPolicy{})
+	require.NoError(t, err)
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, strings.NewReader("data"))
+	require.ErrorIs(t, err, ErrUploadHostNotAllowed)
+}
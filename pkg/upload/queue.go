@@ -0,0 +1,542 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/labstack/gommon/log"
+	"github.com/livekit/protocol/utils"
+)
+
+type UploadStatus string
+
+const (
+	UploadPending   UploadStatus = "pending"
+	UploadUploading UploadStatus = "uploading"
+	UploadDone      UploadStatus = "done"
+	// Out of attempts, the file is kept until the upload is retried
+	UploadDead UploadStatus = "dead"
+)
+
+// Upload of a local file, retried until it succeeds or runs out of attempts
+type Upload struct {
+	ID     string `json:"id"`
+	File   string `json:"file"`
+	Object Object `json:"object"`
+
+	// Set for recordings sent to their own URL instead of the queue's uploader. The URL and headers can carry
+	// credentials, so they are never listed, and only stored when they can be sealed.
+	Target    *HTTPTarget `json:"-"`
+	hasTarget bool
+
+	// Where the file ends up
+	Location string `json:"location"`
+
+	// Destinations which already have the file when uploading to several of them, so retries skip them
+	Delivered []string `json:"delivered,omitempty"`
+
+	// Of the file, once it's uploaded
+	Checksums *Checksums `json:"checksums,omitempty"`
+
+	Status      UploadStatus `json:"status"`
+	Attempts    int          `json:"attempts"`
+	Error       string       `json:"error,omitempty"`
+	NextAttempt time.Time    `json:"nextAttempt"`
+	Created     time.Time    `json:"created"`
+	Updated     time.Time    `json:"updated"`
+}
+
+type QueueConfig struct {
+	// Optional, uploads become dead after this many failed attempts
+	MaxAttempts int
+
+	// Optional, the wait after the first failure, which doubles up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Applies to the upload URLs of recordings
+	Policy HTTPPolicy
+
+	// Optional, seals the upload URLs of recordings in the store. Without it they are only kept in memory.
+	TargetKey *crypt.MasterKey
+
+	// Optional, number of uploads at once
+	Workers int
+}
+
+const (
+	uploadsBucket = "uploads"
+
+	DefaultMaxAttempts = 10
+	DefaultMinBackoff  = 5 * time.Second
+	DefaultMaxBackoff  = 10 * time.Minute
+	DefaultWorkers     = 2
+
+	queuePollInterval = time.Second
+
+	// Done uploads are listed for a day, then forgotten
+	uploadRetention = 24 * time.Hour
+)
+
+var (
+	ErrUploadNotFound     = errors.New("upload not found")
+	ErrUploadNotRetryable = errors.New("only pending or dead uploads can be retried")
+	ErrUploadTargetLost   = errors.New("upload URL was not kept across the restart")
+	ErrTargetKeyMissing   = errors.New("upload URLs can only be queued or shared with an encryption key")
+	ErrUndelivered        = errors.New("upload policy satisfied, retrying the other destinations")
+)
+
+// Queue uploads local files in the background, retrying failures with exponential backoff.
+// With a store, uploads survive restarts, and those interrupted are attempted again.
+type Queue struct {
+	uploader Uploader
+	config   QueueConfig
+	store    *store.Store
+
+	lock    sync.Mutex
+	uploads map[string]*Upload
+	wake    chan struct{}
+
+	// Called when an upload is done or dead
+	onFinished func(u Upload)
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+// NewQueue uploads with uploader. The store is optional.
+func NewQueue(uploader Uploader, st *store.Store, config QueueConfig) (*Queue, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	if config.Workers <= 0 {
+		config.Workers = DefaultWorkers
+	}
+	q := &Queue{
+		uploader: uploader,
+		config:   config,
+		store:    st,
+		uploads:  make(map[string]*Upload),
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	if st == nil {
+		return q, nil
+	}
+
+	err := st.ForEach(uploadsBucket, func(key string, value []byte) error {
+		stored := &storedUpload{}
+		if err := json.Unmarshal(value, stored); err != nil {
+			return err
+		}
+		u := &stored.Upload
+		u.hasTarget = stored.HasTarget
+		if stored.SealedTarget != nil && config.TargetKey != nil {
+			target, err := OpenTarget(config.TargetKey, stored.SealedTarget)
+			if err != nil {
+				log.Errorf("cannot open upload URL | error: %v, id: %s", err, u.ID)
+			}
+			u.Target = target
+		}
+		// The previous instance stopped in the middle of it
+		if u.Status == UploadUploading {
+			u.Status = UploadPending
+		}
+		q.uploads[u.ID] = u
+		return nil
+	})
+	return q, err
+}
+
+// SetCallback is called whenever an upload is done or dead
+func (q *Queue) SetCallback(onFinished func(u Upload)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.onFinished = onFinished
+}
+
+// Enqueue uploads the file with uploader, or the uploader of the queue if nil. The file is deleted once uploaded.
+func (q *Queue) Enqueue(file string, object Object, uploader Uploader) (Upload, error) {
+	if uploader == nil {
+		uploader = q.uploader
+	}
+	now := q.now()
+	u := &Upload{
+		ID:          utils.NewGuid("UP_"),
+		File:        file,
+		Object:      object,
+		Location:    Location(uploader, object),
+		Status:      UploadPending,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
+	}
+	// Only URL targets can be saved, other uploaders are the queue's own
+	if h, ok := uploader.(*httpUploader); ok {
+		target := h.target
+		u.Target = &target
+		u.hasTarget = true
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.save(u); err != nil {
+		return Upload{}, err
+	}
+	q.uploads[u.ID] = u
+	q.signal()
+	return *u, nil
+}
+
+func (q *Queue) Get(id string) (Upload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	u, found := q.uploads[id]
+	if !found {
+		return Upload{}, ErrUploadNotFound
+	}
+	return *u, nil
+}
+
+// List returns the uploads with the status, or all of them if empty, oldest first
+func (q *Queue) List(status UploadStatus) []Upload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	uploads := []Upload{}
+	for _, u := range q.uploads {
+		if status == "" || u.Status == status {
+			uploads = append(uploads, *u)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Created.Before(uploads[j].Created)
+	})
+	return uploads
+}
+
+// Retry attempts an upload again right away, with a fresh count of attempts
+func (q *Queue) Retry(id string) (Upload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u, found := q.uploads[id]
+	if !found {
+		return Upload{}, ErrUploadNotFound
+	}
+	if u.Status != UploadPending && u.Status != UploadDead {
+		return Upload{}, ErrUploadNotRetryable
+	}
+	u.Status = UploadPending
+	u.Attempts = 0
+	u.NextAttempt = q.now()
+	u.Updated = q.now()
+	if err := q.save(u); err != nil {
+		return Upload{}, err
+	}
+	q.signal()
+	return *u, nil
+}
+
+// Run uploads files until the context is cancelled
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		if u := q.claim(); u != nil {
+			q.attempt(ctx, u)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// signal wakes up a waiting worker. Must hold the lock.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// claim takes the oldest upload which is due, and forgets old done uploads
+func (q *Queue) claim() *Upload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.now()
+	var next *Upload
+	for id, u := range q.uploads {
+		if u.Status == UploadDone && now.Sub(u.Updated) > uploadRetention {
+			if err := q.remove(id); err != nil {
+				log.Errorf("cannot forget upload | error: %v, id: %s", err, id)
+			}
+			continue
+		}
+		if u.Status != UploadPending || u.NextAttempt.After(now) {
+			continue
+		}
+		if next == nil || u.Created.Before(next.Created) {
+			next = u
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	next.Status = UploadUploading
+	next.Attempts++
+	next.Updated = now
+	if err := q.save(next); err != nil {
+		log.Errorf("cannot save upload | error: %v, id: %s", err, next.ID)
+	}
+	claimed := *next
+	return &claimed
+}
+
+func (q *Queue) attempt(ctx context.Context, u *Upload) {
+	log.Infof("uploading file | id: %s, file: %s, location: %s, attempt: %d", u.ID, u.File, u.Location, u.Attempts)
+	delivered := make(map[string]bool)
+	for _, name := range u.Delivered {
+		delivered[name] = true
+	}
+	sums, err := q.upload(ctx, *u, delivered)
+
+	// Uploads cut short by a shutdown are attempted again on the next start
+	if ctx.Err() != nil {
+		q.finish(u.ID, func(u *Upload) {
+			u.Status = UploadPending
+			u.Attempts--
+			u.Delivered = deliveredNames(delivered)
+		})
+		return
+	}
+
+	u = q.finish(u.ID, func(u *Upload) {
+		u.Delivered = nil
+		if err == nil {
+			u.Status = UploadDone
+			u.Error = ""
+			u.Checksums = &sums
+			return
+		}
+		u.Error = err.Error()
+		if u.Attempts >= q.config.MaxAttempts || os.IsNotExist(err) || errors.Is(err, ErrUploadTargetLost) {
+			u.Status = UploadDead
+			return
+		}
+		u.Status = UploadPending
+		u.NextAttempt = q.now().Add(q.backoff(u.Attempts))
+		u.Delivered = deliveredNames(delivered)
+	})
+	if u == nil {
+		return
+	}
+
+	switch u.Status {
+	case UploadDone:
+		log.Infof("uploaded file | id: %s, location: %s", u.ID, u.Location)
+	case UploadDead:
+		log.Errorf("giving up upload | error: %s, id: %s, file: %s, attempts: %d", u.Error, u.ID, u.File, u.Attempts)
+	default:
+		log.Warnf("upload failed, retrying | error: %s, id: %s, attempt: %d, next: %v", u.Error, u.ID, u.Attempts, u.NextAttempt)
+		return
+	}
+
+	q.lock.Lock()
+	onFinished := q.onFinished
+	q.lock.Unlock()
+	if onFinished != nil {
+		onFinished(*u)
+	}
+}
+
+// upload adds the destinations which got the file to delivered, when uploading to several of them
+func (q *Queue) upload(ctx context.Context, u Upload, delivered map[string]bool) (Checksums, error) {
+	uploader := q.uploader
+	if u.hasTarget && u.Target == nil {
+		return Checksums{}, ErrUploadTargetLost
+	}
+	if u.Target != nil {
+		var err error
+		if uploader, err = NewHTTPUploader(*u.Target, q.config.Policy); err != nil {
+			return Checksums{}, err
+		}
+	}
+	if uploader == nil {
+		return Checksums{}, errors.New("no uploader")
+	}
+
+	// Read once beforehand, so uploaders can still read the file in parallel
+	sums, err := FileChecksums(u.File)
+	if err != nil {
+		return Checksums{}, err
+	}
+	file, err := os.Open(u.File)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return Checksums{}, err
+	}
+	object := u.Object
+	object.Size = info.Size()
+
+	// Stored with the object, so it can be checked after downloading
+	object.Metadata = make(map[string]string, len(u.Object.Metadata)+1)
+	for k, v := range u.Object.Metadata {
+		object.Metadata[k] = v
+	}
+	object.Metadata[MetadataSHA256] = sums.SHA256
+	if f, ok := uploader.(*fanOutUploader); ok {
+		err = f.deliver(ctx, object, file, delivered)
+
+		// Best effort destinations which failed are retried with the file kept, until attempts run out
+		if undelivered := f.undelivered(delivered); err == nil && len(undelivered) > 0 && u.Attempts < q.config.MaxAttempts {
+			return Checksums{}, fmt.Errorf("%w: %s", ErrUndelivered, strings.Join(undelivered, ", "))
+		}
+	} else {
+		err = uploader.Upload(ctx, object, file)
+	}
+	if err != nil {
+		return Checksums{}, err
+	}
+
+	// If there are no errors after uploading, delete the file
+	if err = os.Remove(u.File); err != nil {
+		log.Warnf("cannot remove uploaded file | error: %v, file: %s", err, u.File)
+	}
+	return sums, nil
+}
+
+// finish updates a claimed upload, and returns a copy of it
+func (q *Queue) finish(id string, fn func(u *Upload)) *Upload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u, found := q.uploads[id]
+	if !found {
+		return nil
+	}
+	fn(u)
+	u.Updated = q.now()
+	if err := q.save(u); err != nil {
+		log.Errorf("cannot save upload | error: %v, id: %s", err, id)
+	}
+	finished := *u
+	return &finished
+}
+
+func deliveredNames(delivered map[string]bool) []string {
+	var names []string
+	for name := range delivered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backoff doubles the wait with each attempt
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.config.MinBackoff
+	for i := 1; i < attempts && wait < q.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > q.config.MaxBackoff {
+		wait = q.config.MaxBackoff
+	}
+	return wait
+}
+
+// storedUpload is an upload as it is saved, with its target sealed if it has one
+type storedUpload struct {
+	Upload
+	HasTarget    bool   `json:"hasTarget,omitempty"`
+	SealedTarget []byte `json:"sealedTarget,omitempty"`
+}
+
+// save must hold the lock
+func (q *Queue) save(u *Upload) error {
+	if q.store == nil {
+		return nil
+	}
+	stored := storedUpload{Upload: *u, HasTarget: u.hasTarget}
+	if u.Target != nil && q.config.TargetKey != nil {
+		sealed, err := SealTarget(q.config.TargetKey, *u.Target)
+		if err != nil {
+			return err
+		}
+		stored.SealedTarget = sealed
+	}
+	return q.store.Put(uploadsBucket, u.ID, stored)
+}
+
+// SealTarget encrypts an upload target with the master key, since its URL and headers carry credentials
+func SealTarget(key *crypt.MasterKey, target HTTPTarget) ([]byte, error) {
+	if key == nil {
+		return nil, ErrTargetKeyMissing
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+	return key.Seal(data)
+}
+
+func OpenTarget(key *crypt.MasterKey, sealed []byte) (*HTTPTarget, error) {
+	if key == nil {
+		return nil, ErrTargetKeyMissing
+	}
+	data, err := key.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	target := &HTTPTarget{}
+	if err = json.Unmarshal(data, target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// remove must hold the lock
+func (q *Queue) remove(id string) error {
+	delete(q.uploads, id)
+	if q.store == nil {
+		return nil
+	}
+	return q.store.Delete(uploadsBucket, id)
+}
@@ -0,0 +1,275 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/crypt"
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T) *store.Store {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		st.Close()
+	})
+	return st
+}
+
+func writeFile(t *testing.T, data string) string {
+	file := filepath.Join(t.TempDir(), "a.mp4")
+	require.NoError(t, os.WriteFile(file, []byte(data), 0644))
+	return file
+}
+
+// step claims and attempts the next upload which is due, and returns false if there was none
+func step(q *Queue) bool {
+	u := q.claim()
+	if u == nil {
+		return false
+	}
+	q.attempt(context.Background(), u)
+	return true
+}
+
+func TestQueueUploadsAndRemovesFile(t *testing.T) {
+	uploader := newMemoryUploader()
+	q, err := NewQueue(uploader, nil, QueueConfig{})
+	require.NoError(t, err)
+	var finished []Upload
+	q.SetCallback(func(u Upload) {
+		finished = append(finished, u)
+	})
+
+	file := writeFile(t, "data")
+	u, err := q.Enqueue(file, Object{Key: "a.mp4", Size: -1}, nil)
+	require.NoError(t, err)
+	require.Equal(t, UploadPending, u.Status)
+	require.Equal(t, "memory/a.mp4", u.Location)
+
+	require.True(t, step(q))
+	require.Equal(t, []byte("data"), uploader.objects["a.mp4"])
+	_, err = os.Stat(file)
+	require.True(t, os.IsNotExist(err))
+	require.Len(t, finished, 1)
+	require.Equal(t, UploadDone, finished[0].Status)
+	require.Equal(t, &Checksums{
+		SHA256: "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+		MD5:    "8d777f385d3dfec8815d20f7496026dc",
+		CRC32C: "aed87dd1",
+	}, finished[0].Checksums)
+	require.False(t, step(q))
+}
+
+func TestQueueBacksOffUntilDead(t *testing.T) {
+	uploader := newMemoryUploader()
+	uploader.err = errors.New("unavailable")
+	q, err := NewQueue(uploader, nil, QueueConfig{MaxAttempts: 3, MinBackoff: time.Second, MaxBackoff: time.Minute})
+	require.NoError(t, err)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	file := writeFile(t, "data")
+	u, err := q.Enqueue(file, Object{Key: "a.mp4", Size: -1}, nil)
+	require.NoError(t, err)
+
+	require.True(t, step(q))
+	u, err = q.Get(u.ID)
+	require.NoError(t, err)
+	require.Equal(t, UploadPending, u.Status)
+	require.Equal(t, "unavailable", u.Error)
+	require.Equal(t, now.Add(time.Second), u.NextAttempt)
+
+	// Not due yet
+	require.False(t, step(q))
+	now = now.Add(time.Second)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, now.Add(2*time.Second), u.NextAttempt)
+
+	now = now.Add(2 * time.Second)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadDead, u.Status)
+	require.Equal(t, 3, u.Attempts)
+	require.Len(t, q.List(UploadDead), 1)
+
+	// The file is kept for a retry
+	_, err = os.Stat(file)
+	require.NoError(t, err)
+	uploader.err = nil
+	u, err = q.Retry(u.ID)
+	require.NoError(t, err)
+	require.Equal(t, 0, u.Attempts)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadDone, u.Status)
+
+	_, err = q.Retry(u.ID)
+	require.ErrorIs(t, err, ErrUploadNotRetryable)
+	_, err = q.Retry("unknown")
+	require.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestQueueBackoffIsCapped(t *testing.T) {
+	q, err := NewQueue(nil, nil, QueueConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, q.backoff(1))
+	require.Equal(t, 4*time.Second, q.backoff(3))
+	require.Equal(t, 5*time.Second, q.backoff(10))
+}
+
+func TestQueueMissingFileIsDead(t *testing.T) {
+	q, err := NewQueue(newMemoryUploader(), nil, QueueConfig{})
+	require.NoError(t, err)
+	u, err := q.Enqueue(filepath.Join(t.TempDir(), "missing.mp4"), Object{Key: "missing.mp4"}, nil)
+	require.NoError(t, err)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadDead, u.Status)
+}
+
+func TestQueueKeepsDeliveredDestinations(t *testing.T) {
+	st := openStore(t)
+	primary, customer := newMemoryUploader(), newMemoryUploader()
+	customer.err = errors.New("denied")
+	uploader, err := NewFanOutUploader(PolicyAll, Destination{"primary", primary}, Destination{"customer", customer})
+	require.NoError(t, err)
+	q, err := NewQueue(uploader, st, QueueConfig{MinBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	// Two recordings with the same key are tracked apart
+	a, err := q.Enqueue(writeFile(t, "a"), Object{Key: "a.mp4"}, nil)
+	require.NoError(t, err)
+	require.True(t, step(q))
+	a, _ = q.Get(a.ID)
+	require.Equal(t, []string{"primary"}, a.Delivered)
+	b, err := q.Enqueue(writeFile(t, "b"), Object{Key: "a.mp4"}, nil)
+	require.NoError(t, err)
+
+	// What was delivered survives a restart, and the retry only goes to the destination which failed
+	q, err = NewQueue(uploader, st, QueueConfig{MinBackoff: time.Millisecond})
+	require.NoError(t, err)
+	q.now = func() time.Time { return time.Now().Add(time.Second) }
+	delete(primary.objects, "a.mp4")
+	customer.err = nil
+	require.True(t, step(q))
+	require.True(t, step(q))
+	a, _ = q.Get(a.ID)
+	require.Equal(t, UploadDone, a.Status)
+	require.Empty(t, a.Delivered)
+	b, _ = q.Get(b.ID)
+	require.Equal(t, UploadDone, b.Status)
+	require.Equal(t, []byte("b"), primary.objects["a.mp4"])
+}
+
+func TestQueueRetriesBestEffortDestinations(t *testing.T) {
+	primary, customer := newMemoryUploader(), newMemoryUploader()
+	customer.err = errors.New("denied")
+	uploader, err := NewFanOutUploader(PolicyPrimary, Destination{"primary", primary}, Destination{"customer", customer})
+	require.NoError(t, err)
+	q, err := NewQueue(uploader, nil, QueueConfig{MaxAttempts: 3, MinBackoff: time.Millisecond})
+	require.NoError(t, err)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	// The file is kept for the destination which failed
+	file := writeFile(t, "a")
+	u, err := q.Enqueue(file, Object{Key: "a.mp4"}, nil)
+	require.NoError(t, err)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadPending, u.Status)
+	require.Equal(t, []string{"primary"}, u.Delivered)
+	require.Contains(t, u.Error, "customer")
+	require.FileExists(t, file)
+
+	customer.err = nil
+	now = now.Add(time.Second)
+	require.True(t, step(q))
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadDone, u.Status)
+	require.Equal(t, []byte("a"), customer.objects["a.mp4"])
+	require.NoFileExists(t, file)
+
+	// Once out of attempts, the policy is enough
+	customer.err = errors.New("denied")
+	file = writeFile(t, "b")
+	u, err = q.Enqueue(file, Object{Key: "b.mp4"}, nil)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		require.True(t, step(q))
+	}
+	u, _ = q.Get(u.ID)
+	require.Equal(t, UploadDone, u.Status)
+	require.Equal(t, 3, u.Attempts)
+	require.NoFileExists(t, file)
+}
+
+func TestQueueRestoresUploads(t *testing.T) {
+	st := openStore(t)
+	key, err := crypt.ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	q, err := NewQueue(newMemoryUploader(), st, QueueConfig{TargetKey: key})
+	require.NoError(t, err)
+
+	target, err := NewHTTPUploader(HTTPTarget{URL: "https://example.com/a.mp4?signature=secret"}, HTTPPolicy{})
+	require.NoError(t, err)
+	u, err := q.Enqueue(writeFile(t, "data"), Object{Key: "a.mp4"}, target)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/a.mp4", u.Location)
+
+	// Interrupted while uploading
+	claimed := q.claim()
+	require.NotNil(t, claimed)
+
+	q, err = NewQueue(newMemoryUploader(), st, QueueConfig{TargetKey: key})
+	require.NoError(t, err)
+	restored, err := q.Get(u.ID)
+	require.NoError(t, err)
+	require.Equal(t, UploadPending, restored.Status)
+	require.Equal(t, "https://example.com/a.mp4?signature=secret", restored.Target.URL)
+}
+
+func TestQueueKeepsTargetsSecret(t *testing.T) {
+	st := openStore(t)
+	uploader := newMemoryUploader()
+	q, err := NewQueue(uploader, st, QueueConfig{})
+	require.NoError(t, err)
+
+	target, err := NewHTTPUploader(HTTPTarget{
+		URL:     "https://example.com/a.mp4?signature=secret",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}, HTTPPolicy{})
+	require.NoError(t, err)
+	u, err := q.Enqueue(writeFile(t, "data"), Object{Key: "a.mp4"}, target)
+	require.NoError(t, err)
+
+	// Neither listed nor stored
+	listed, err := json.Marshal(q.List(""))
+	require.NoError(t, err)
+	require.NotContains(t, string(listed), "secret")
+	err = st.ForEach(uploadsBucket, func(key string, value []byte) error {
+		require.NotContains(t, string(value), "secret")
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Without a key to seal it, the URL is lost on restart rather than uploading to the queue's uploader
+	q, err = NewQueue(uploader, st, QueueConfig{})
+	require.NoError(t, err)
+	require.True(t, step(q))
+	u, err = q.Get(u.ID)
+	require.NoError(t, err)
+	require.Equal(t, UploadDead, u.Status)
+	require.Equal(t, ErrUploadTargetLost.Error(), u.Error)
+	require.Empty(t, uploader.objects)
+}
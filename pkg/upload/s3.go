@@ -5,55 +5,281 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 type S3Config struct {
 	Region    string
 	Bucket    string
 	Directory string
+
+	// Optional, for S3-compatible storage such as MinIO, Ceph or R2. Most of them need path-style addressing.
+	Endpoint  string
+	PathStyle bool
+
+	// Optional, the default AWS credential chain is used without an access key
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Optional, role assumed with the credentials above
+	AssumeRoleARN string
+
+	// Optional, applied to every object
+	StorageClass string
+	// AES256 or aws:kms, which uses the default KMS key unless one is set
+	SSE         string
+	SSEKMSKeyID string
+	Tags        map[string]string
 }
 
-var ErrEmptyS3BucketName = errors.New("empty S3 bucket name")
+var (
+	ErrEmptyS3BucketName   = errors.New("empty S3 bucket name")
+	ErrInvalidStorageClass = errors.New("invalid S3 storage class")
+	ErrInvalidSSE          = errors.New("S3 server-side encryption must be AES256 or aws:kms")
+	ErrMissingSecretKey    = errors.New("S3 access key set without a secret key")
+)
 
 type s3Uploader struct {
 	bucket    string
 	directory string
+	client    *s3.Client
 	service   *manager.Uploader
+
+	// Applied to every object
+	storageClass types.StorageClass
+	sse          types.ServerSideEncryption
+	sseKMSKeyID  string
+	tagging      string
+
+	// S3 checks each part against it, only AWS supports it
+	checksum types.ChecksumAlgorithm
 }
 
 func NewS3Uploader(config S3Config) (Uploader, error) {
 	// Create a TODO context
 	ctx := context.TODO()
 
+	if config.Bucket == "" {
+		return nil, ErrEmptyS3BucketName
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	// Load S3 config
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(config.Region))
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(config.Region)}
+	if config.AccessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.SecretAccessKey, config.SessionToken),
+		))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
 	if err != nil {
 		return nil, err
 	}
+	if config.AssumeRoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), config.AssumeRoleARN))
+	}
 
 	// Create service
-	service := s3.NewFromConfig(cfg)
+	service := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if config.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(config.Endpoint)
+		}
+		o.UsePathStyle = config.PathStyle
+	})
 	uploader := manager.NewUploader(service)
 
-	return &s3Uploader{config.Bucket, config.Directory, uploader}, nil
+	u := &s3Uploader{
+		bucket:       config.Bucket,
+		directory:    config.Directory,
+		client:       service,
+		service:      uploader,
+		storageClass: types.StorageClass(config.StorageClass),
+		sse:          types.ServerSideEncryption(config.SSE),
+		sseKMSKeyID:  config.SSEKMSKeyID,
+		tagging:      tagging(config.Tags),
+	}
+	if config.Endpoint == "" {
+		u.checksum = types.ChecksumAlgorithmCrc32c
+	}
+	return u, nil
+}
+
+func (c S3Config) validate() error {
+	if c.AccessKeyID != "" && c.SecretAccessKey == "" {
+		return ErrMissingSecretKey
+	}
+	if c.StorageClass != "" && !isStorageClass(types.StorageClass(c.StorageClass)) {
+		return fmt.Errorf("%w: %s", ErrInvalidStorageClass, c.StorageClass)
+	}
+	switch types.ServerSideEncryption(c.SSE) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidSSE, c.SSE)
+	}
+	return nil
+}
+
+func isStorageClass(class types.StorageClass) bool {
+	for _, c := range class.Values() {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// tagging encodes tags as the query string S3 expects
+func tagging(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// ParseS3Tags reads tags written as key=value pairs separated by commas
+func ParseS3Tags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid S3 tag %q, expected key=value", pair)
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// optional returns nil for empty strings, so S3 doesn't receive empty headers
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
 }
 
-func (s *s3Uploader) Upload(key string, body io.Reader) error {
-	// Append directory if it's not empty
-	var uploadKey = key
+// objectKey appends the directory to the key if it's not empty
+func (s *s3Uploader) objectKey(key string) string {
 	if s.directory != "" {
-		uploadKey = fmt.Sprintf("%s/%s", s.directory, key)
+		return fmt.Sprintf("%s/%s", s.directory, key)
+	}
+	return key
+}
+
+func (s *s3Uploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	// The manager reads the body in parts of the same size, hashed as they are read
+	partSize := s.service.PartSize
+	if partSize <= 0 {
+		partSize = manager.DefaultUploadPartSize
+	}
+	parts := newPartHasher(body, partSize)
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.objectKey(object.Key)),
+		Body:                 parts,
+		ContentType:          optional(object.ContentType),
+		Metadata:             object.Metadata,
+		StorageClass:         s.storageClass,
+		ChecksumAlgorithm:    s.checksum,
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          optional(s.sseKMSKeyID),
+		Tagging:              optional(s.tagging),
+	}
+	if object.Size >= 0 {
+		input.ContentLength = object.Size
 	}
+	out, err := s.service.Upload(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	multipart := out.UploadID != ""
+	if out.ChecksumCRC32C != nil {
+		return verify("S3 CRC32C", parts.CRC32C(multipart), aws.ToString(out.ChecksumCRC32C))
+	}
+
+	// ETags are MD5s only of objects S3 doesn't encrypt or encrypts with its own keys, whatever the bucket defaults to
+	switch out.ServerSideEncryption {
+	case "", types.ServerSideEncryptionAes256:
+	default:
+		return nil
+	}
+	etag := aws.ToString(out.ETag)
+	if s.sse == types.ServerSideEncryptionAwsKms || !md5ETag.MatchString(etag) {
+		return nil
+	}
+	return verify("S3 ETag", parts.ETag(multipart), strings.Trim(etag, `"`))
+}
+
+func (s *s3Uploader) CreateMultipartUpload(ctx context.Context, object Object) (string, error) {
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.objectKey(object.Key)),
+		ContentType:          optional(object.ContentType),
+		Metadata:             object.Metadata,
+		StorageClass:         s.storageClass,
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          optional(s.sseKMSKeyID),
+		Tagging:              optional(s.tagging),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *s3Uploader) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker) (string, error) {
+	out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(s.objectKey(key)),
+		UploadId:   aws.String(uploadID),
+		PartNumber: number,
+		Body:       body,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (s *s3Uploader) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: part.Number,
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(s.objectKey(key)),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
 
-	_, err := s.service.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(uploadKey),
-		Body:   body,
+func (s *s3Uploader) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.objectKey(key)),
+		UploadId: aws.String(uploadID),
 	})
 	return err
 }
@@ -0,0 +1,139 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3UploaderCompatibleEndpoint(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer server.Close()
+
+	uploader, err := NewS3Uploader(S3Config{
+		Region:          "us-east-1",
+		Bucket:          "recordings",
+		Directory:       "livekit",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+		StorageClass:    "STANDARD_IA",
+		SSE:             "aws:kms",
+		SSEKMSKeyID:     "key",
+		Tags:            map[string]string{"env": "test"},
+	})
+	require.NoError(t, err)
+
+	err = uploader.Upload(context.Background(), Object{
+		Key:         "a.mp4",
+		ContentType: "video/mp4",
+		Size:        4,
+		Metadata:    map[string]string{MetadataRoom: "room"},
+	}, strings.NewReader("data"))
+	require.NoError(t, err)
+
+	require.Equal(t, http.MethodPut, received.Method)
+	require.Equal(t, "/recordings/livekit/a.mp4", received.URL.Path)
+	require.Equal(t, "video/mp4", received.Header.Get("Content-Type"))
+	require.Equal(t, "room", received.Header.Get("X-Amz-Meta-Room"))
+	require.Equal(t, "STANDARD_IA", received.Header.Get("X-Amz-Storage-Class"))
+	require.Equal(t, "aws:kms", received.Header.Get("X-Amz-Server-Side-Encryption"))
+	require.Equal(t, "key", received.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	require.Equal(t, "env=test", received.Header.Get("X-Amz-Tagging"))
+	require.Contains(t, received.Header.Get("Authorization"), "Credential=minio/")
+	require.Equal(t, []byte("data"), body)
+}
+
+func TestS3UploaderVerifiesETag(t *testing.T) {
+	etag := `"8d777f385d3dfec8815d20f7496026dc"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", etag)
+	}))
+	defer server.Close()
+
+	uploader, err := NewS3Uploader(S3Config{
+		Region:          "us-east-1",
+		Bucket:          "recordings",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	})
+	require.NoError(t, err)
+
+	// The MD5 of "data"
+	object := Object{Key: "a.mp4", Size: 4}
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+
+	err = uploader.Upload(context.Background(), object, strings.NewReader("atad"))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestS3UploaderChecksEncryptedObjects(t *testing.T) {
+	header := http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+	}))
+	defer server.Close()
+
+	uploader, err := NewS3Uploader(S3Config{
+		Region:          "us-east-1",
+		Bucket:          "recordings",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	})
+	require.NoError(t, err)
+	object := Object{Key: "a.mp4", Size: 4}
+
+	// Encrypted with KMS by default, the ETag is not the MD5 even if it looks like one
+	header.Set("ETag", `"00000000000000000000000000000000"`)
+	header.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+
+	// The CRC32C is checked whatever the encryption
+	header.Set("X-Amz-Checksum-Crc32c", base64CRC32C([]byte("data")))
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+	err = uploader.Upload(context.Background(), object, strings.NewReader("atad"))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestS3ConfigValidation(t *testing.T) {
+	_, err := NewS3Uploader(S3Config{Region: "us-east-1", Bucket: "b", StorageClass: "COLD"})
+	require.ErrorIs(t, err, ErrInvalidStorageClass)
+
+	_, err = NewS3Uploader(S3Config{Region: "us-east-1", Bucket: "b", SSE: "rot13"})
+	require.ErrorIs(t, err, ErrInvalidSSE)
+
+	_, err = NewS3Uploader(S3Config{Region: "us-east-1", Bucket: "b", AccessKeyID: "key"})
+	require.ErrorIs(t, err, ErrMissingSecretKey)
+
+	_, err = NewS3Uploader(S3Config{Region: "us-east-1"})
+	require.ErrorIs(t, err, ErrEmptyS3BucketName)
+}
+
+func TestParseS3Tags(t *testing.T) {
+	tags, err := ParseS3Tags("env=prod, team=video")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod", "team": "video"}, tags)
+
+	_, err = ParseS3Tags("env")
+	require.Error(t, err)
+}
@@ -0,0 +1,485 @@
+package upload
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPConfig struct {
+	// host:port, the port defaults to 22
+	Address string
+	User    string
+
+	// Either a password or a private key, or both
+	Password      string
+	KeyFile       string
+	KeyPassphrase string
+
+	// Optional, defaults to ~/.ssh/known_hosts. Host keys are only ignored with InsecureIgnoreHostKey.
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+
+	// Optional, remote directory the files are written to, created when missing
+	Directory string
+}
+
+var (
+	ErrEmptySFTPAddress = errors.New("empty SFTP address")
+	ErrMissingSFTPAuth  = errors.New("either an SFTP password or private key is required")
+)
+
+const (
+	sftpTimeout = 30 * time.Second
+
+	// Most servers accept writes of up to 32KB, which are pipelined to make up for the latency
+	sftpWriteSize   = 32 << 10
+	sftpWriteWindow = 16
+)
+
+type sftpUploader struct {
+	address   string
+	directory string
+	config    *ssh.ClientConfig
+}
+
+// NewSFTPUploader delivers recordings to an SFTP server. Files are written under a temporary name
+// and renamed once complete, so whoever picks them up never sees a partial file.
+func NewSFTPUploader(config SFTPConfig) (Uploader, error) {
+	if config.Address == "" {
+		return nil, ErrEmptySFTPAddress
+	}
+	address := config.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if config.KeyFile != "" {
+		key, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if config.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(config.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, ErrMissingSFTPAuth
+	}
+
+	hostKeys := ssh.InsecureIgnoreHostKey()
+	if !config.InsecureIgnoreHostKey {
+		file := config.KnownHostsFile
+		if file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		var err error
+		if hostKeys, err = knownhosts.New(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return &sftpUploader{
+		address:   address,
+		directory: strings.TrimSuffix(config.Directory, "/"),
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         sftpTimeout,
+		},
+	}, nil
+}
+
+func (s *sftpUploader) GetDirectory() string {
+	return s.directory
+}
+
+func (s *sftpUploader) Locate(object Object) string {
+	return fmt.Sprintf("sftp://%s@%s/%s", s.config.User, s.address, strings.TrimPrefix(s.remotePath(object), "/"))
+}
+
+func (s *sftpUploader) remotePath(object Object) string {
+	if s.directory != "" {
+		return path.Join(s.directory, object.Key)
+	}
+	return object.Key
+}
+
+// Upload connects for every file, as recordings are few and far between
+func (s *sftpUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	conn, err := (&net.Dialer{Timeout: sftpTimeout}).DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	// Closing the connection interrupts whatever is in progress when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, s.address, s.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+
+	sftp := &sftpClient{r: r, w: w}
+	if err = sftp.init(); err != nil {
+		return err
+	}
+	remote := s.remotePath(object)
+	if err = sftp.mkdirAll(path.Dir(remote)); err != nil {
+		return err
+	}
+	partial := remote + ".part"
+	if err = sftp.write(partial, body); err != nil {
+		_ = sftp.remove(partial)
+		return checkContext(ctx, err)
+	}
+	return checkContext(ctx, sftp.rename(partial, remote))
+}
+
+// checkContext prefers the context error, as a cancelled upload otherwise fails on a closed connection
+func checkContext(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// SFTP version 3, the one OpenSSH speaks, as described in
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpInit     byte = 1
+	sftpVersion  byte = 2
+	sftpOpen     byte = 3
+	sftpClose    byte = 4
+	sftpWrite    byte = 6
+	sftpRemove   byte = 13
+	sftpMkdir    byte = 14
+	sftpStat     byte = 17
+	sftpRename   byte = 18
+	sftpStatus   byte = 101
+	sftpHandle   byte = 102
+	sftpAttrs    byte = 105
+	sftpExtended byte = 200
+
+	sftpFlagWrite    uint32 = 0x02
+	sftpFlagCreate   uint32 = 0x08
+	sftpFlagTruncate uint32 = 0x10
+
+	sftpAttrPermissions uint32 = 0x04
+
+	sftpStatusOK         uint32 = 0
+	sftpStatusNoSuchFile uint32 = 2
+
+	// Replaces the target like rename(2), where SSH_FXP_RENAME fails if it exists
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+type sftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (code %d)", e.Message, e.Code)
+}
+
+// sftpClient sends one request at a time, except for pipelined writes
+type sftpClient struct {
+	r      io.Reader
+	w      io.Writer
+	nextID uint32
+
+	// The server supports posix-rename@openssh.com
+	posixRename bool
+}
+
+type sftpPacket []byte
+
+func (p sftpPacket) uint32(v uint32) sftpPacket {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(p, b[:]...)
+}
+
+func (p sftpPacket) uint64(v uint64) sftpPacket {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(p, b[:]...)
+}
+
+func (p sftpPacket) string(v []byte) sftpPacket {
+	return append(p.uint32(uint32(len(v))), v...)
+}
+
+func (c *sftpClient) send(kind byte, payload sftpPacket) error {
+	packet := sftpPacket{}.uint32(uint32(len(payload) + 1))
+	packet = append(packet, kind)
+	_, err := c.w.Write(append(packet, payload...))
+	return err
+}
+
+// request sends a packet with a new ID in front of the payload
+func (c *sftpClient) request(kind byte, payload sftpPacket) error {
+	c.nextID++
+	return c.send(kind, append(sftpPacket{}.uint32(c.nextID), payload...))
+}
+
+func (c *sftpClient) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// response reads the response of a request, without its ID, turning failed statuses into errors
+func (c *sftpClient) response(expected byte) ([]byte, error) {
+	kind, payload, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 {
+		return nil, errors.New("sftp: short packet")
+	}
+	payload = payload[4:]
+	if kind == sftpStatus {
+		if len(payload) < 4 {
+			return nil, errors.New("sftp: short status")
+		}
+		status := &sftpStatusError{Code: binary.BigEndian.Uint32(payload)}
+		if message, ok := readString(payload[4:]); ok {
+			status.Message = string(message)
+		}
+		if status.Code != sftpStatusOK || expected != sftpStatus {
+			return nil, status
+		}
+		return nil, nil
+	}
+	if kind != expected {
+		return nil, fmt.Errorf("sftp: unexpected packet %d", kind)
+	}
+	return payload, nil
+}
+
+func readString(b []byte) ([]byte, bool) {
+	if len(b) < 4 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < length {
+		return nil, false
+	}
+	return b[4 : 4+length], true
+}
+
+// init negotiates the version, and reads the extensions the server lists after it as pairs of name and data
+func (c *sftpClient) init() error {
+	if err := c.send(sftpInit, sftpPacket{}.uint32(3)); err != nil {
+		return err
+	}
+	kind, payload, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if kind != sftpVersion || len(payload) < 4 {
+		return fmt.Errorf("sftp: unexpected packet %d", kind)
+	}
+	for extensions := payload[4:]; len(extensions) > 0; {
+		name, ok := readString(extensions)
+		if !ok {
+			break
+		}
+		extensions = extensions[4+len(name):]
+		data, ok := readString(extensions)
+		if !ok {
+			break
+		}
+		extensions = extensions[4+len(data):]
+		if string(name) == sftpPosixRename && string(data) == "1" {
+			c.posixRename = true
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates the directory and its parents, like os.MkdirAll
+func (c *sftpClient) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	if err := c.request(sftpStat, sftpPacket{}.string([]byte(dir))); err != nil {
+		return err
+	}
+	if _, err := c.response(sftpAttrs); err == nil {
+		return nil
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := c.request(sftpMkdir, sftpPacket{}.string([]byte(dir)).uint32(sftpAttrPermissions).uint32(0755)); err != nil {
+		return err
+	}
+	_, err := c.response(sftpStatus)
+	return err
+}
+
+func (c *sftpClient) write(file string, body io.Reader) error {
+	open := sftpPacket{}.string([]byte(file)).
+		uint32(sftpFlagWrite | sftpFlagCreate | sftpFlagTruncate).
+		uint32(sftpAttrPermissions).uint32(0644)
+	if err := c.request(sftpOpen, open); err != nil {
+		return err
+	}
+	payload, err := c.response(sftpHandle)
+	if err != nil {
+		return err
+	}
+	handle, ok := readString(payload)
+	if !ok {
+		return errors.New("sftp: invalid handle")
+	}
+
+	err = c.writeAll(handle, body)
+	if err := c.request(sftpClose, sftpPacket{}.string(handle)); err != nil {
+		return err
+	}
+	if _, closeErr := c.response(sftpStatus); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeAll keeps a window of writes in flight, checking their statuses as they come back
+func (c *sftpClient) writeAll(handle []byte, body io.Reader) error {
+	chunk := make([]byte, sftpWriteSize)
+	var offset uint64
+	var inFlight int
+	var err error
+	for {
+		var n int
+		n, err = io.ReadFull(body, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			if n == 0 {
+				break
+			}
+		} else if err != nil {
+			break
+		}
+
+		if inFlight == sftpWriteWindow {
+			if _, err = c.response(sftpStatus); err != nil {
+				break
+			}
+			inFlight--
+		}
+		if err = c.request(sftpWrite, sftpPacket{}.string(handle).uint64(offset).string(chunk[:n])); err != nil {
+			return err
+		}
+		inFlight++
+		offset += uint64(n)
+		if n < len(chunk) {
+			break
+		}
+	}
+
+	// Every write is acknowledged, even after a failure
+	for ; inFlight > 0; inFlight-- {
+		if _, writeErr := c.response(sftpStatus); err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// rename replaces the target if it exists, as a retried upload finds the file of a previous attempt. Without
+// posix-rename, the target is removed first, so it is briefly missing.
+func (c *sftpClient) rename(from string, to string) error {
+	if c.posixRename {
+		if err := c.request(sftpExtended, sftpPacket{}.string([]byte(sftpPosixRename)).string([]byte(from)).string([]byte(to))); err != nil {
+			return err
+		}
+		_, err := c.response(sftpStatus)
+		return err
+	}
+
+	var status *sftpStatusError
+	if err := c.remove(to); err != nil && !(errors.As(err, &status) && status.Code == sftpStatusNoSuchFile) {
+		return err
+	}
+	if err := c.request(sftpRename, sftpPacket{}.string([]byte(from)).string([]byte(to))); err != nil {
+		return err
+	}
+	_, err := c.response(sftpStatus)
+	return err
+}
+
+func (c *sftpClient) remove(file string) error {
+	if err := c.request(sftpRemove, sftpPacket{}.string([]byte(file))); err != nil {
+		return err
+	}
+	_, err := c.response(sftpStatus)
+	return err
+}
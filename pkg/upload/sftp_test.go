@@ -0,0 +1,257 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSFTP serves the SFTP requests the uploader makes from a local directory
+type fakeSFTP struct {
+	root  string
+	files map[string]*os.File
+
+	// Lists posix-rename@openssh.com, like OpenSSH
+	posixRename bool
+}
+
+func (f *fakeSFTP) serve(rw io.ReadWriter) {
+	c := &sftpClient{r: rw, w: rw}
+	kind, _, err := c.receive()
+	if err != nil || kind != sftpInit {
+		return
+	}
+	version := sftpPacket{}.uint32(3)
+	if f.posixRename {
+		version = version.string([]byte(sftpPosixRename)).string([]byte("1"))
+	}
+	_ = c.send(sftpVersion, version)
+
+	for {
+		kind, payload, err := c.receive()
+		if err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		first, _ := readString(payload)
+		name := filepath.Join(f.root, path.Clean("/"+string(first)))
+
+		var opErr error
+		switch kind {
+		case sftpStat:
+			if _, opErr = os.Stat(name); opErr == nil {
+				_ = c.send(sftpAttrs, sftpPacket{}.uint32(id).uint32(0))
+				continue
+			}
+		case sftpMkdir:
+			opErr = os.Mkdir(name, 0755)
+		case sftpOpen:
+			var file *os.File
+			if file, opErr = os.Create(name); opErr == nil {
+				f.files[string(first)] = file
+				_ = c.send(sftpHandle, sftpPacket{}.uint32(id).string(first))
+				continue
+			}
+		case sftpWrite:
+			rest := payload[4+len(first):]
+			offset := binary.BigEndian.Uint64(rest)
+			data, _ := readString(rest[8:])
+			_, opErr = f.files[string(first)].WriteAt(data, int64(offset))
+		case sftpClose:
+			opErr = f.files[string(first)].Close()
+		case sftpRename:
+			// Like OpenSSH, which refuses to replace the target
+			second, _ := readString(payload[4+len(first):])
+			target := filepath.Join(f.root, path.Clean("/"+string(second)))
+			if _, opErr = os.Stat(target); opErr == nil {
+				opErr = os.ErrExist
+			} else {
+				opErr = os.Rename(name, target)
+			}
+		case sftpExtended:
+			if string(first) != sftpPosixRename || !f.posixRename {
+				opErr = errors.New("unsupported")
+				break
+			}
+			from, _ := readString(payload[4+len(first):])
+			to, _ := readString(payload[8+len(first)+len(from):])
+			opErr = os.Rename(filepath.Join(f.root, path.Clean("/"+string(from))), filepath.Join(f.root, path.Clean("/"+string(to))))
+		case sftpRemove:
+			opErr = os.Remove(name)
+		}
+
+		code := sftpStatusOK
+		if os.IsNotExist(opErr) {
+			code = sftpStatusNoSuchFile
+		} else if opErr != nil {
+			code = 4
+		}
+		_ = c.send(sftpStatus, sftpPacket{}.uint32(id).uint32(code).string(nil).string(nil))
+	}
+}
+
+// newSFTPServer accepts a single user with a password, and returns its address and a known_hosts file
+func newSFTPServer(t *testing.T, root string) (string, string) {
+	return startSFTPServer(t, root, true)
+}
+
+func startSFTPServer(t *testing.T, root string, posixRename bool) (string, string) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "partner" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, &fakeSFTP{root: root, posixRename: posixRename})
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, signer.PublicKey())
+	require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+	return listener.Addr().String(), knownHosts
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, fake *fakeSFTP) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				_ = req.Reply(req.Type == "subsystem", nil)
+				if req.Type == "subsystem" {
+					go func() {
+						(&fakeSFTP{root: fake.root, files: map[string]*os.File{}, posixRename: fake.posixRename}).serve(channel)
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPUploader(t *testing.T) {
+	root := t.TempDir()
+	address, knownHosts := newSFTPServer(t, root)
+
+	uploader, err := NewSFTPUploader(SFTPConfig{
+		Address:        address,
+		User:           "partner",
+		Password:       "secret",
+		KnownHostsFile: knownHosts,
+		Directory:      "incoming/livekit",
+	})
+	require.NoError(t, err)
+
+	// Large enough for the writes to be pipelined
+	data := bytes.Repeat([]byte("0123456789"), sftpWriteSize*sftpWriteWindow/4)
+	object := Object{Key: "a.mp4", Size: int64(len(data))}
+	require.NoError(t, uploader.Upload(context.Background(), object, bytes.NewReader(data)))
+
+	uploaded, err := os.ReadFile(filepath.Join(root, "incoming", "livekit", "a.mp4"))
+	require.NoError(t, err)
+	require.Equal(t, data, uploaded)
+	_, err = os.Stat(filepath.Join(root, "incoming", "livekit", "a.mp4.part"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, "sftp://partner@"+address+"/incoming/livekit/a.mp4", Location(uploader, object))
+}
+
+func TestSFTPUploaderReplacesExistingFile(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		root := t.TempDir()
+		address, knownHosts := startSFTPServer(t, root, posixRename)
+		uploader, err := NewSFTPUploader(SFTPConfig{Address: address, User: "partner", Password: "secret", KnownHostsFile: knownHosts})
+		require.NoError(t, err)
+
+		// A retry after the file was renamed, but the upload wasn't reported done
+		for _, data := range []string{"data", "retry"} {
+			object := Object{Key: "a.mp4", Size: int64(len(data))}
+			require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader(data)), "posix-rename: %v", posixRename)
+		}
+		uploaded, err := os.ReadFile(filepath.Join(root, "a.mp4"))
+		require.NoError(t, err)
+		require.Equal(t, "retry", string(uploaded))
+	}
+}
+
+func TestSFTPUploaderVerifiesHostKey(t *testing.T) {
+	address, _ := newSFTPServer(t, t.TempDir())
+	_, otherKnownHosts := newSFTPServer(t, t.TempDir())
+
+	// The known host has the key of another server
+	data, err := os.ReadFile(otherKnownHosts)
+	require.NoError(t, err)
+	_, _, key, _, _, err := ssh.ParseKnownHosts(data)
+	require.NoError(t, err)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+	require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	uploader, err := NewSFTPUploader(SFTPConfig{Address: address, User: "partner", Password: "secret", KnownHostsFile: knownHosts})
+	require.NoError(t, err)
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: 4}, bytes.NewReader([]byte("data")))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "key mismatch")
+}
+
+func TestSFTPConfigValidation(t *testing.T) {
+	_, err := NewSFTPUploader(SFTPConfig{})
+	require.ErrorIs(t, err, ErrEmptySFTPAddress)
+
+	_, err = NewSFTPUploader(SFTPConfig{Address: "example.com", User: "partner"})
+	require.ErrorIs(t, err, ErrMissingSFTPAuth)
+
+	// Private keys are read from a file
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	encoded, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded}), 0600))
+	_, err = NewSFTPUploader(SFTPConfig{Address: "example.com", User: "partner", KeyFile: file, InsecureIgnoreHostKey: true})
+	require.NoError(t, err)
+}
@@ -0,0 +1,469 @@
+package upload
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/labstack/gommon/log"
+)
+
+// MultipartUploader uploads an object in parts, so it can be streamed while it is written
+type MultipartUploader interface {
+	Uploader
+	// The size of the object is ignored, it isn't known until the upload completes
+	CreateMultipartUpload(ctx context.Context, object Object) (string, error)
+	UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker) (string, error)
+	CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) error
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+}
+
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+const (
+	// S3 rejects smaller parts, except for the last one
+	MinPartSize int64 = 5 << 20
+
+	streamsBucket = "streams"
+
+	// Parts are retried this many times on resume, and until they are uploaded while recording
+	partAttempts   = 5
+	partRetryWait  = time.Second
+	partMaxBackoff = time.Minute
+)
+
+var ErrStreamNotReadable = errors.New("stream sink cannot be read")
+
+// spoolPart is a part kept on disk until it is uploaded
+type spoolPart struct {
+	Number int32  `json:"number"`
+	File   string `json:"file"`
+}
+
+// streamState is persisted so uploads interrupted by a restart can be completed
+type streamState struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	UploadID    string            `json:"uploadId"`
+	Parts       []Part            `json:"parts"`
+	Pending     []spoolPart       `json:"pending"`
+}
+
+func (st *streamState) removePending(number int32) {
+	for i, p := range st.Pending {
+		if p.Number == number {
+			st.Pending = append(st.Pending[:i], st.Pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Streamer uploads recordings while they are written. Only the parts not uploaded yet are kept on disk.
+type Streamer struct {
+	uploader MultipartUploader
+	store    *store.Store
+	dir      string
+	partSize int64
+
+	// Replaced in tests
+	retryWait time.Duration
+}
+
+// NewStreamer spools parts in dir. Upload state is persisted in st if it isn't nil, so uploads can resume after a restart.
+func NewStreamer(uploader MultipartUploader, st *store.Store, dir string, partSize int64) *Streamer {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	return &Streamer{uploader: uploader, store: st, dir: dir, partSize: partSize, retryWait: partRetryWait}
+}
+
+func (s *Streamer) GetDirectory() string {
+	return s.uploader.GetDirectory()
+}
+
+// StreamSink writes to spool files of the part size, each uploaded in the background as soon as it is full.
+// Parts wait on disk however far behind uploads fall, so writing never waits for them.
+type StreamSink struct {
+	streamer *Streamer
+
+	// Used by the writer only
+	file *os.File
+	bw   *bufio.Writer
+	size int64
+
+	// Guards the state, which is also updated by the upload goroutine
+	lock  sync.Mutex
+	state streamState
+
+	// Parts sealed by the writer, in order, until the upload goroutine takes them
+	sealed  []spoolPart
+	closed  bool
+	aborted bool
+	wake    chan struct{}
+	done    chan struct{}
+
+	// Cancelled on abort or with the parent, to stop retrying. The parent completes or aborts the upload.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewSink starts streaming the object until ctx is cancelled, which keeps what is left for the next resume.
+// The multipart upload is created with the first part.
+func (s *Streamer) NewSink(ctx context.Context, object Object) (*StreamSink, error) {
+	sink := &StreamSink{
+		streamer: s,
+		state:    streamState{Key: object.Key, ContentType: object.ContentType, Metadata: object.Metadata},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		parent:   ctx,
+	}
+	sink.ctx, sink.cancel = context.WithCancel(ctx)
+	if err := sink.openSpool(1); err != nil {
+		return nil, err
+	}
+	go sink.upload()
+	return sink, nil
+}
+
+func (s *StreamSink) Name() string {
+	return s.state.Key
+}
+
+func (s *StreamSink) Read([]byte) (int, error) {
+	return 0, ErrStreamNotReadable
+}
+
+func (s *StreamSink) Write(b []byte) (int, error) {
+	n, err := s.bw.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if s.size >= s.streamer.partSize {
+		err = s.seal(true)
+	}
+	return n, err
+}
+
+// Close uploads the remaining bytes and completes the upload in the background
+func (s *StreamSink) Close() error {
+	err := s.seal(false)
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.signal()
+	return err
+}
+
+// Abort closes the sink and throws away whatever was written
+func (s *StreamSink) Abort() error {
+	s.lock.Lock()
+	s.aborted = true
+	s.lock.Unlock()
+	s.cancel()
+	return s.Close()
+}
+
+// signal wakes up the upload goroutine
+func (s *StreamSink) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *StreamSink) openSpool(number int32) error {
+	name := filepath.Join(s.streamer.dir, fmt.Sprintf("%s.part%d", filepath.Base(s.state.Key), number))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.bw = bufio.NewWriter(f)
+	s.size = 0
+
+	// The spool is pending from the start, so it is uploaded on resume if the process stops
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.Pending = append(s.state.Pending, spoolPart{Number: number, File: name})
+	return s.save()
+}
+
+// seal hands the current spool to the upload goroutine, and opens the next one if there is more to write
+func (s *StreamSink) seal(next bool) error {
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	part := s.state.Pending[len(s.state.Pending)-1]
+	s.lock.Unlock()
+
+	// An empty last part is dropped, S3 doesn't accept it
+	if s.size == 0 {
+		s.dropPending(part)
+	} else {
+		s.lock.Lock()
+		s.sealed = append(s.sealed, part)
+		s.lock.Unlock()
+		s.signal()
+	}
+	if next {
+		return s.openSpool(part.Number + 1)
+	}
+	return nil
+}
+
+func (s *StreamSink) dropPending(part spoolPart) {
+	if err := os.Remove(part.File); err != nil {
+		log.Errorf("cannot remove spool | error: %v, file: %s", err, part.File)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.removePending(part.Number)
+	if err := s.save(); err != nil {
+		log.Errorf("cannot save stream | error: %v, key: %s", err, s.state.Key)
+	}
+}
+
+// upload sends parts as they are sealed, retrying each until it is uploaded, then completes the upload once the
+// sink is closed. If a part can't be uploaded at all, the remaining parts are kept for the next resume.
+func (s *StreamSink) upload() {
+	defer close(s.done)
+
+	var err error
+	for {
+		part, found, closed := s.next()
+		if !found {
+			if closed {
+				break
+			}
+			<-s.wake
+			continue
+		}
+		if err != nil || s.isAborted() {
+			continue
+		}
+		if err = s.streamer.uploadPart(s.ctx, &s.lock, &s.state, part, 0); err != nil && !s.isAborted() {
+			log.Errorf("cannot upload part, keeping it for resume | error: %v, key: %s, part: %d", err, s.state.Key, part.Number)
+		}
+	}
+
+	if s.isAborted() {
+		s.streamer.abort(s.parent, &s.state)
+		return
+	}
+	if err != nil {
+		return
+	}
+	s.streamer.complete(s.parent, &s.state)
+}
+
+// next takes the oldest sealed part, if any, and tells whether the sink is closed
+func (s *StreamSink) next() (spoolPart, bool, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.sealed) == 0 {
+		return spoolPart{}, false, s.closed
+	}
+	part := s.sealed[0]
+	s.sealed = s.sealed[1:]
+	return part, true, s.closed
+}
+
+func (s *StreamSink) isAborted() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.aborted
+}
+
+// uploadPart uploads a spool file with retries, until it is uploaded if attempts is 0, and records it as uploaded
+func (s *Streamer) uploadPart(ctx context.Context, lock *sync.Mutex, state *streamState, part spoolPart, attempts int) error {
+	var etag string
+	var err error
+	backoff := s.retryWait
+	for attempt := 1; ; attempt++ {
+		if etag, err = s.tryPart(ctx, lock, state, part); err == nil {
+			break
+		}
+		// Without its spool there is nothing to retry
+		if os.IsNotExist(err) || (attempts > 0 && attempt >= attempts) {
+			return err
+		}
+		log.Warnf("cannot upload part | error: %v, key: %s, part: %d, attempt: %d", err, state.Key, part.Number, attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > partMaxBackoff {
+			backoff = partMaxBackoff
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	state.Parts = append(state.Parts, Part{Number: part.Number, ETag: etag})
+	state.removePending(part.Number)
+	if err = s.saveState(state); err != nil {
+		log.Errorf("cannot save stream | error: %v, key: %s", err, state.Key)
+	}
+	if err = os.Remove(part.File); err != nil {
+		log.Errorf("cannot remove spool | error: %v, file: %s", err, part.File)
+	}
+	return nil
+}
+
+// tryPart creates the multipart upload with the first part, then uploads the part once. Only the upload goroutine
+// creates it, so the writer isn't held up by the request.
+func (s *Streamer) tryPart(ctx context.Context, lock *sync.Mutex, state *streamState, part spoolPart) (string, error) {
+	lock.Lock()
+	key, uploadID := state.Key, state.UploadID
+	lock.Unlock()
+
+	if uploadID == "" {
+		var err error
+		uploadID, err = s.uploader.CreateMultipartUpload(ctx, Object{
+			Key:         key,
+			ContentType: state.ContentType,
+			Size:        -1,
+			Metadata:    state.Metadata,
+		})
+		if err != nil {
+			return "", err
+		}
+		lock.Lock()
+		state.UploadID = uploadID
+		if err = s.saveState(state); err != nil {
+			log.Errorf("cannot save stream | error: %v, key: %s", err, key)
+		}
+		lock.Unlock()
+	}
+	return s.uploadSpool(ctx, key, uploadID, part)
+}
+
+func (s *Streamer) uploadSpool(ctx context.Context, key string, uploadID string, part spoolPart) (string, error) {
+	f, err := os.Open(part.File)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.uploader.UploadPart(ctx, key, uploadID, part.Number, f)
+}
+
+// complete finishes an upload once every part is uploaded. An upload without parts is aborted.
+func (s *Streamer) complete(ctx context.Context, state *streamState) {
+	if len(state.Parts) == 0 {
+		s.abort(ctx, state)
+		return
+	}
+	parts := append([]Part(nil), state.Parts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	if err := s.uploader.CompleteMultipartUpload(ctx, state.Key, state.UploadID, parts); err != nil {
+		log.Errorf("cannot complete upload, keeping it for resume | error: %v, key: %s", err, state.Key)
+		return
+	}
+	s.forget(state)
+	log.Infof("uploaded stream | key: %s, parts: %d", state.Key, len(parts))
+}
+
+func (s *Streamer) abort(ctx context.Context, state *streamState) {
+	if state.UploadID != "" {
+		if err := s.uploader.AbortMultipartUpload(ctx, state.Key, state.UploadID); err != nil {
+			log.Errorf("cannot abort upload | error: %v, key: %s", err, state.Key)
+		}
+	}
+	for _, part := range state.Pending {
+		if err := os.Remove(part.File); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot remove spool | error: %v, file: %s", err, part.File)
+		}
+	}
+	s.forget(state)
+}
+
+func (s *Streamer) forget(state *streamState) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Delete(streamsBucket, state.Key); err != nil {
+		log.Errorf("cannot delete stream | error: %v, key: %s", err, state.Key)
+	}
+}
+
+// save persists the state. Must hold the lock.
+func (s *StreamSink) save() error {
+	return s.streamer.saveState(&s.state)
+}
+
+func (s *Streamer) saveState(state *streamState) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Put(streamsBucket, state.Key, state)
+}
+
+// Resume completes the uploads left by a previous run in the background. Must be called before streaming new recordings.
+func (s *Streamer) Resume(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+
+	var states []*streamState
+	err := s.store.ForEach(streamsBucket, func(key string, value []byte) error {
+		var state streamState
+		if err := json.Unmarshal(value, &state); err != nil {
+			return err
+		}
+		states = append(states, &state)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for _, state := range states {
+			s.resume(ctx, state)
+		}
+	}()
+	return nil
+}
+
+func (s *Streamer) resume(ctx context.Context, state *streamState) {
+	log.Infof("resuming stream | key: %s, uploaded: %d, pending: %d", state.Key, len(state.Parts), len(state.Pending))
+	lock := &sync.Mutex{}
+	for _, part := range append([]spoolPart(nil), state.Pending...) {
+		// Spools being written when the process stopped may be empty or gone
+		if info, err := os.Stat(part.File); err != nil || info.Size() == 0 {
+			lock.Lock()
+			state.removePending(part.Number)
+			lock.Unlock()
+			os.Remove(part.File)
+			continue
+		}
+		if err := s.uploadPart(ctx, lock, state, part, partAttempts); err != nil {
+			log.Errorf("cannot resume stream | error: %v, key: %s, part: %d", err, state.Key, part.Number)
+			return
+		}
+	}
+	s.complete(ctx, state)
+}
@@ -0,0 +1,246 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudgroundcontrol/livekit-recorder/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMultipart keeps uploaded parts in memory
+type fakeMultipart struct {
+	lock      sync.Mutex
+	parts     map[int32][]byte
+	objects   map[string][]byte
+	aborted   []string
+	failParts bool
+	// Parts failed before one is accepted
+	failures int
+	// Parts wait for it to be closed, if set
+	block chan struct{}
+}
+
+func newFakeMultipart() *fakeMultipart {
+	return &fakeMultipart{
+		parts:   make(map[int32][]byte),
+		objects: make(map[string][]byte),
+	}
+}
+
+func (f *fakeMultipart) Upload(ctx context.Context, object Object, body io.Reader) error {
+	return nil
+}
+
+func (f *fakeMultipart) GetDirectory() string {
+	return ""
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, object Object) (string, error) {
+	return "upload-" + object.Key, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker) (string, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failParts {
+		return "", errors.New("unavailable")
+	}
+	if f.failures > 0 {
+		f.failures--
+		return "", errors.New("unavailable")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	f.parts[number] = data
+	return "etag", nil
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number }) {
+		return errors.New("parts are not sorted")
+	}
+	var object []byte
+	for _, part := range parts {
+		object = append(object, f.parts[part.Number]...)
+	}
+	f.objects[key] = object
+	return nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.aborted = append(f.aborted, key)
+	return nil
+}
+
+func newTestStreamer(t *testing.T, uploader MultipartUploader, st *store.Store) *Streamer {
+	s := NewStreamer(uploader, st, t.TempDir(), 0)
+	s.partSize = 4
+	s.retryWait = time.Millisecond
+	return s
+}
+
+func TestStreamSinkUploadsParts(t *testing.T) {
+	uploader := newFakeMultipart()
+	s := newTestStreamer(t, uploader, nil)
+
+	sink, err := s.NewSink(context.Background(), Object{Key: "video.ivf"})
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("ghij"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	<-sink.done
+
+	require.Equal(t, []byte("abcdefghij"), uploader.objects["video.ivf"])
+	require.Len(t, uploader.parts, 2)
+
+	// Spools are removed once uploaded
+	files, err := os.ReadDir(s.dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestStreamSinkAbort(t *testing.T) {
+	uploader := newFakeMultipart()
+	s := newTestStreamer(t, uploader, nil)
+
+	sink, err := s.NewSink(context.Background(), Object{Key: "video.ivf"})
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Abort())
+	<-sink.done
+
+	require.Empty(t, uploader.objects)
+	files, err := os.ReadDir(s.dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestStreamSinkRetriesParts(t *testing.T) {
+	uploader := newFakeMultipart()
+	uploader.failures = 3
+	s := newTestStreamer(t, uploader, nil)
+
+	sink, err := s.NewSink(context.Background(), Object{Key: "video.ivf"})
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("abcdefghij"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	<-sink.done
+	require.Equal(t, []byte("abcdefghij"), uploader.objects["video.ivf"])
+
+	// Aborting stops retrying
+	uploader.failParts = true
+	sink, err = s.NewSink(context.Background(), Object{Key: "audio.ogg"})
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Abort())
+	<-sink.done
+	require.NotContains(t, uploader.objects, "audio.ogg")
+	files, err := os.ReadDir(s.dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestStreamSinkStopsRetryingOnShutdown(t *testing.T) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer st.Close()
+
+	uploader := newFakeMultipart()
+	uploader.failParts = true
+	s := newTestStreamer(t, uploader, st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink, err := s.NewSink(ctx, Object{Key: "video.ivf"})
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	cancel()
+	require.NoError(t, sink.Close())
+	select {
+	case <-sink.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kept retrying after shutdown")
+	}
+
+	// What is left is kept for the next resume
+	var state streamState
+	require.NoError(t, st.Get(streamsBucket, "video.ivf", &state))
+	require.Len(t, state.Pending, 1)
+	require.FileExists(t, state.Pending[0].File)
+	require.Empty(t, uploader.aborted)
+}
+
+func TestStreamSinkWritesWhileUploadsLag(t *testing.T) {
+	uploader := newFakeMultipart()
+	uploader.block = make(chan struct{})
+	s := newTestStreamer(t, uploader, nil)
+
+	sink, err := s.NewSink(context.Background(), Object{Key: "video.ivf"})
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("abcd"), 200)
+	written := make(chan error)
+	go func() {
+		_, err := sink.Write(data)
+		written <- err
+	}()
+	select {
+	case err = <-written:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing waited for uploads")
+	}
+
+	close(uploader.block)
+	require.NoError(t, sink.Close())
+	<-sink.done
+	require.Equal(t, data, uploader.objects["video.ivf"])
+}
+
+func TestStreamerResumesFailedUpload(t *testing.T) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer st.Close()
+
+	uploader := newFakeMultipart()
+	uploader.failParts = true
+	s := newTestStreamer(t, uploader, st)
+
+	// Simulate a spool left behind by a stopped process, without waiting for retries
+	sink, err := s.NewSink(context.Background(), Object{Key: "audio.ogg"})
+	require.NoError(t, err)
+	_, err = sink.bw.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, sink.bw.Flush())
+
+	var state streamState
+	require.NoError(t, st.Get(streamsBucket, "audio.ogg", &state))
+	require.Len(t, state.Pending, 1)
+
+	uploader.failParts = false
+	s.resume(context.Background(), &state)
+	require.True(t, bytes.Equal([]byte("abc"), uploader.objects["audio.ogg"]))
+	require.ErrorIs(t, st.Get(streamsBucket, "audio.ogg", &state), store.ErrNotFound)
+}
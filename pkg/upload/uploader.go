@@ -1,9 +1,69 @@
 package upload
 
-import "io"
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
 
 type Uploader interface {
-	// Key is a unique identifier for the file.
-	Upload(key string, body io.Reader) error
+	Upload(ctx context.Context, object Object, body io.Reader) error
 	GetDirectory() string
 }
+
+// Object describes what is uploaded along with the body
+type Object struct {
+	// Key is a unique identifier for the file
+	Key         string `json:"key"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Size of the body in bytes, -1 if unknown
+	Size int64 `json:"size"`
+
+	// Stored with the object, see the Metadata keys
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// When the recording started, used to lay out files by date
+	Time time.Time `json:"time"`
+}
+
+// Locator is implemented by uploaders which don't store objects under GetDirectory()/key
+type Locator interface {
+	Locate(object Object) string
+}
+
+// Location returns where the uploader stores the object
+func Location(u Uploader, object Object) string {
+	if l, ok := u.(Locator); ok {
+		return l.Locate(object)
+	}
+	return fmt.Sprintf("%s/%s", u.GetDirectory(), object.Key)
+}
+
+// Metadata keys set on recordings
+const (
+	MetadataRoom        = "room"
+	MetadataIdentity    = "identity"
+	MetadataRecordingID = "recording-id"
+	MetadataSHA256      = "sha256"
+)
+
+var contentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".ivf":  "video/x-ivf",
+	".h264": "video/h264",
+	".ogg":  "audio/ogg",
+}
+
+// ContentType guesses the content type of a recording from its extension
+func ContentType(key string) string {
+	if contentType, found := contentTypes[strings.ToLower(filepath.Ext(key))]; found {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,14 @@
+package upload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentType(t *testing.T) {
+	require.Equal(t, "video/mp4", ContentType("recording.mp4"))
+	require.Equal(t, "audio/ogg", ContentType("dir/recording.OGG"))
+	require.Equal(t, "video/x-ivf", ContentType("recording.ivf"))
+	require.Equal(t, "application/octet-stream", ContentType("recording"))
+}
@@ -0,0 +1,127 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type WebDAVConfig struct {
+	// URL of the server, e.g. https://dav.example.com/remote.php/webdav
+	URL string
+
+	// Optional, collection the files are put in, created when missing
+	Directory string
+
+	// Optional, basic auth
+	User     string
+	Password string
+}
+
+var ErrEmptyWebDAVURL = errors.New("empty WebDAV URL")
+
+type webDAVUploader struct {
+	base      *url.URL
+	directory string
+	user      string
+	password  string
+	client    *http.Client
+}
+
+// NewWebDAVUploader puts recordings on a WebDAV server, creating the collections above them when missing
+func NewWebDAVUploader(config WebDAVConfig) (Uploader, error) {
+	if config.URL == "" {
+		return nil, ErrEmptyWebDAVURL
+	}
+	base, err := url.Parse(strings.TrimSuffix(config.URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &webDAVUploader{
+		base:      base,
+		directory: strings.Trim(config.Directory, "/"),
+		user:      config.User,
+		password:  config.Password,
+		client:    http.DefaultClient,
+	}, nil
+}
+
+func (w *webDAVUploader) GetDirectory() string {
+	return w.directory
+}
+
+func (w *webDAVUploader) Locate(object Object) string {
+	return w.url(w.remotePath(object))
+}
+
+func (w *webDAVUploader) remotePath(object Object) string {
+	return path.Join(w.directory, object.Key)
+}
+
+func (w *webDAVUploader) url(name string) string {
+	u := *w.base
+	u.Path = path.Join(u.Path, name)
+	return u.String()
+}
+
+func (w *webDAVUploader) Upload(ctx context.Context, object Object, body io.Reader) error {
+	// Collections are created top down, those which exist already are answered with 405
+	remote := w.remotePath(object)
+	if dir := path.Dir(remote); dir != "." {
+		var parent string
+		for _, segment := range strings.Split(dir, "/") {
+			parent = path.Join(parent, segment)
+			if err := w.mkcol(ctx, parent); err != nil {
+				return err
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, w.url(remote), body)
+	if err != nil {
+		return err
+	}
+	if object.Size >= 0 {
+		req.ContentLength = object.Size
+	}
+	if object.ContentType != "" {
+		req.Header.Set("Content-Type", object.ContentType)
+	}
+	res, err := w.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return responseError("put WebDAV file", res)
+	}
+	return nil
+}
+
+func (w *webDAVUploader) mkcol(ctx context.Context, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", w.url(dir)+"/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := w.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusMethodNotAllowed {
+		return responseError(fmt.Sprintf("create WebDAV collection %s", dir), res)
+	}
+	return nil
+}
+
+func (w *webDAVUploader) do(req *http.Request) (*http.Response, error) {
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+	return w.client.Do(req)
+}
@@ -0,0 +1,73 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAVUploader(t *testing.T) {
+	collections := map[string]bool{"/webdav/": true}
+	var body []byte
+	var contentType, user, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ = r.BasicAuth()
+		switch r.Method {
+		case "MKCOL":
+			if collections[r.URL.Path] {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			collections[r.URL.Path] = true
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodPut:
+			require.Equal(t, "/webdav/recordings/livekit/a.mp4", r.URL.Path)
+			body, _ = io.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	uploader, err := NewWebDAVUploader(WebDAVConfig{
+		URL:       server.URL + "/webdav/",
+		Directory: "recordings/livekit",
+		User:      "partner",
+		Password:  "secret",
+	})
+	require.NoError(t, err)
+
+	object := Object{Key: "a.mp4", ContentType: "video/mp4", Size: 4}
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+	require.Equal(t, []byte("data"), body)
+	require.Equal(t, "video/mp4", contentType)
+	require.Equal(t, "partner", user)
+	require.Equal(t, "secret", password)
+	require.True(t, collections["/webdav/recordings/"])
+	require.True(t, collections["/webdav/recordings/livekit/"])
+	require.Equal(t, server.URL+"/webdav/recordings/livekit/a.mp4", Location(uploader, object))
+
+	// Existing collections are fine
+	require.NoError(t, uploader.Upload(context.Background(), object, strings.NewReader("data")))
+}
+
+func TestWebDAVUploaderFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	uploader, err := NewWebDAVUploader(WebDAVConfig{URL: server.URL})
+	require.NoError(t, err)
+	err = uploader.Upload(context.Background(), Object{Key: "a.mp4", Size: -1}, strings.NewReader("data"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "403")
+
+	_, err = NewWebDAVUploader(WebDAVConfig{})
+	require.ErrorIs(t, err, ErrEmptyWebDAVURL)
+}